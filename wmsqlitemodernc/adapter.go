@@ -0,0 +1,403 @@
+package wmsqlitemodernc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SchemaAdapter produces SQL queries that create topic tables, insert messages,
+// and select message batches. Implement it in order to add columns,
+// use STRICT tables, or fit an existing schema.
+//
+// Default value is [DefaultSchemaAdapter].
+type SchemaAdapter interface {
+	// SchemaInitializingQueries create the topic table if it is absent.
+	SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string
+
+	// InsertQuery inserts messages into the topic table.
+	InsertQuery(params InsertQueryParams) (query string, args []any, err error)
+
+	// NextBatchQuery selects at most params.BatchSize messages ordered by offset
+	// following the offset bound as the only argument. Selected columns are the offset, UUID,
+	// publish time in [time.RFC3339Nano] format, payload, JSON metadata, and the number of delivery attempts.
+	NextBatchQuery(params SubscriptionQueryParams) string
+}
+
+// OffsetsAdapter produces SQL queries that track the progress of consumer groups
+// in the offsets and deliveries tables. Queries of a subscription are built once
+// and executed with arguments bound by position as documented for each method.
+//
+// Default value is [DefaultOffsetsAdapter].
+type OffsetsAdapter interface {
+	// SchemaInitializingQueries create the offsets table and,
+	// if params.DeliveriesTable is set, the deliveries table, if they are absent.
+	SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string
+
+	// ConsumerGroupInitializingQuery inserts the consumer group offset row, if it is absent.
+	// The acknowledged offset of a new row is given by [Position.OffsetAckedExpression] of params.InitialPosition.
+	ConsumerGroupInitializingQuery(params SubscriptionQueryParams) string
+
+	// LockConsumerGroupQuery returns a single row with the acknowledged offset,
+	// or no rows, if the consumer group is locked by another subscription.
+	LockConsumerGroupQuery(params SubscriptionQueryParams) string
+
+	// ExtendLockQuery extends the consumer group lock and records the acknowledged offset,
+	// which is bound as the first argument, provided that the consumer group offset still
+	// matches the locked offset bound as the second argument. Returns a single row on success.
+	//
+	// With message leases, it extends the leases held by the subscription instead
+	// and takes no arguments.
+	ExtendLockQuery(params SubscriptionQueryParams) string
+
+	// AcknowledgeMessagesQuery records the acknowledged offset, which is bound as the first
+	// argument, and releases the consumer group lock, provided that the consumer group offset
+	// still matches the locked offset bound as the second argument.
+	//
+	// With message leases, it advances the consumer group offset past
+	// acknowledged deliveries instead and takes no arguments.
+	AcknowledgeMessagesQuery(params SubscriptionQueryParams) string
+
+	// AcknowledgeDeliveryQuery marks the message, whose offset is bound
+	// as the only argument, acknowledged in the deliveries table.
+	AcknowledgeDeliveryQuery(params SubscriptionQueryParams) string
+
+	// CountDeliveryAttemptQuery increments the number of delivery attempts of the message,
+	// whose offset is bound as the only argument, and returns a single row with the new count.
+	CountDeliveryAttemptQuery(params SubscriptionQueryParams) string
+
+	// ForgetDeliveriesQuery removes deliveries of messages
+	// at or before the consumer group offset.
+	ForgetDeliveriesQuery(params SubscriptionQueryParams) string
+
+	// LeaseMessageQuery leases the message, whose offset is bound
+	// as the only argument, to params.LeaseOwner for params.LockTimeout.
+	LeaseMessageQuery(params SubscriptionQueryParams) string
+
+	// ReleaseLeasesQuery releases leases of unacknowledged messages held by params.LeaseOwner.
+	ReleaseLeasesQuery(params SubscriptionQueryParams) string
+}
+
+// SchemaInitializingQueriesParams name the tables of a topic for schema initialization.
+type SchemaInitializingQueriesParams struct {
+	Topic        string
+	TopicTable   string
+	OffsetsTable string
+
+	// DeliveriesTable is empty, unless a subscription tracks individual message deliveries.
+	DeliveriesTable string
+
+	// UniqueUUIDs is set when the topic table needs a unique index on message UUIDs.
+	UniqueUUIDs bool
+}
+
+// InsertQueryParams hold the messages to insert into a topic table.
+type InsertQueryParams struct {
+	Topic      string
+	TopicTable string
+	Messages   message.Messages
+
+	// UniqueUUIDs is set when messages with UUIDs that are already
+	// in the topic table must be skipped instead of inserted again.
+	// The topic table was initialized with the unique index.
+	UniqueUUIDs bool
+}
+
+// SubscriptionQueryParams describe a subscription for building its queries.
+type SubscriptionQueryParams struct {
+	Topic         string
+	TopicTable    string
+	OffsetsTable  string
+	ConsumerGroup string
+	BatchSize     int
+	LockTimeout   time.Duration
+
+	// DeliveriesTable is empty, unless the subscription tracks individual message deliveries.
+	DeliveriesTable string
+
+	// DelayedDelivery is set when messages are held back until their delivery time.
+	// Acknowledgements are then recorded in the deliveries table.
+	DelayedDelivery bool
+
+	// MessageLeases is set when messages are leased individually instead of locking
+	// the consumer group. Acknowledgements are then recorded in the deliveries table.
+	MessageLeases bool
+
+	// LeaseOwner identifies the subscription holding message leases.
+	LeaseOwner string
+
+	// InitialPosition is the first message received by a consumer group that does not exist yet.
+	InitialPosition Position
+
+	// MetadataFilter is empty, unless the subscription selects only messages with matching metadata.
+	// It is validated before the queries are built.
+	MetadataFilter MetadataFilter
+}
+
+// DefaultSchemaAdapter is the [SchemaAdapter] that stores each topic in its own table
+// with an AUTOINCREMENT offset column.
+type DefaultSchemaAdapter struct{}
+
+// SchemaInitializingQueries satisfies the [SchemaAdapter] interface.
+func (a DefaultSchemaAdapter) SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string {
+	// adding UNIQUE(uuid) constraint slows the driver down without benefit,
+	// unless publishers must skip duplicate messages
+	queries := []string{`CREATE TABLE IF NOT EXISTS '` + params.TopicTable + `' (
+		'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		metadata JSON NOT NULL,
+		deliver_at INTEGER NOT NULL DEFAULT 0
+	);`}
+	if params.UniqueUUIDs {
+		queries = append(queries, `CREATE UNIQUE INDEX IF NOT EXISTS '`+params.TopicTable+`_uuid' ON '`+params.TopicTable+`' (uuid);`)
+	}
+	return queries
+}
+
+// InsertQuery satisfies the [SchemaAdapter] interface.
+func (a DefaultSchemaAdapter) InsertQuery(params InsertQueryParams) (query string, args []any, err error) {
+	b := strings.Builder{}
+	_, _ = b.WriteString("INSERT INTO '")
+	_, _ = b.WriteString(params.TopicTable)
+	_, _ = b.WriteString("' (uuid, created_at, payload, metadata, deliver_at) VALUES ")
+
+	args = make([]any, 0, len(params.Messages)*5)
+	for _, msg := range params.Messages {
+		metadata, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to encode message %q metadata to JSON: %w", msg.UUID, err)
+		}
+		deliverAt, err := parseDeliverAt(msg)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, msg.UUID, time.Now().UTC().Format(createdAtLayout), msg.Payload, metadata, deliverAt)
+		b.WriteString(`(?,?,?,?,?),`)
+	}
+	query = strings.TrimRight(b.String(), ",")
+	if params.UniqueUUIDs {
+		query += ` ON CONFLICT(uuid) DO NOTHING`
+	}
+	return query, args, nil
+}
+
+// NextBatchQuery satisfies the [SchemaAdapter] interface.
+func (a DefaultSchemaAdapter) NextBatchQuery(params SubscriptionQueryParams) string {
+	if params.DeliveriesTable == "" {
+		var condition string
+		if len(params.MetadataFilter) > 0 {
+			condition = ` AND ` + params.MetadataFilter.Condition("metadata")
+		}
+		return fmt.Sprintf(`
+			SELECT "offset", uuid, created_at, payload, metadata, 0
+			FROM '%s'
+			WHERE "offset">?%s ORDER BY offset LIMIT %d;
+		`, params.TopicTable, condition, params.BatchSize)
+	}
+
+	var condition string
+	if len(params.MetadataFilter) > 0 {
+		condition = ` AND ` + params.MetadataFilter.Condition("t.metadata")
+	}
+	if params.DelayedDelivery {
+		condition += ` AND t.deliver_at<=CAST(unixepoch('subsec')*1000 AS INTEGER)`
+	}
+	if params.DelayedDelivery || params.MessageLeases {
+		condition += ` AND COALESCE(d.acked, 0)=0`
+	}
+	if params.MessageLeases {
+		condition += ` AND ` + lockedUntil("d.leased_until") + `<CAST(unixepoch('subsec')*1000 AS INTEGER)`
+	}
+	return fmt.Sprintf(`
+		SELECT t."offset", t.uuid, t.created_at, t.payload, t.metadata, COALESCE(d.attempts, 0)
+		FROM '%s' AS t LEFT JOIN '%s' AS d ON d.consumer_group='%s' AND d."offset"=t."offset"
+		WHERE t."offset">?%s ORDER BY t."offset" LIMIT %d;
+	`, params.TopicTable, params.DeliveriesTable, params.ConsumerGroup, condition, params.BatchSize)
+}
+
+// DefaultOffsetsAdapter is the [OffsetsAdapter] that locks consumer groups
+// with a time stamp in the offsets table and tracks individual message
+// deliveries in the deliveries table.
+type DefaultOffsetsAdapter struct{}
+
+// SchemaInitializingQueries satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string {
+	queries := []string{`CREATE TABLE IF NOT EXISTS '` + params.OffsetsTable + `' (
+		consumer_group TEXT NOT NULL,
+		offset_acked INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL,
+		locked_until_ms INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(consumer_group)
+	);`}
+	if params.DeliveriesTable != "" {
+		queries = append(queries, `CREATE TABLE IF NOT EXISTS '`+params.DeliveriesTable+`' (
+			consumer_group TEXT NOT NULL,
+			'offset' INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			acked INTEGER NOT NULL DEFAULT 0,
+			leased_until INTEGER NOT NULL DEFAULT 0,
+			leased_until_ms INTEGER NOT NULL DEFAULT 0,
+			lease_owner TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY(consumer_group, 'offset')
+		) WITHOUT ROWID;`)
+	}
+	return queries
+}
+
+// ConsumerGroupInitializingQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) ConsumerGroupInitializingQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (consumer_group, offset_acked, locked_until)
+		VALUES ("%s", %s, 0)
+		ON CONFLICT(consumer_group) DO NOTHING;
+	`, params.OffsetsTable, params.ConsumerGroup, params.InitialPosition.OffsetAckedExpression(params.TopicTable))
+}
+
+// LockConsumerGroupQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) LockConsumerGroupQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		// consumer group is never locked: the offset advances past acknowledged messages
+		// while the batch query skips messages leased by other subscriptions
+		return a.advanceOffsetQuery(params) + ` RETURNING offset_acked;`
+	}
+	return fmt.Sprintf(
+		`UPDATE '%s' SET %s WHERE consumer_group="%s" AND %s<CAST(unixepoch('subsec')*1000 AS INTEGER) RETURNING offset_acked`,
+		params.OffsetsTable,
+		lockUntil("locked_until", params.LockTimeout),
+		params.ConsumerGroup,
+		lockedUntil("locked_until"),
+	)
+}
+
+// ExtendLockQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) ExtendLockQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		return fmt.Sprintf(
+			`UPDATE '%s' SET %s WHERE consumer_group='%s' AND lease_owner='%s' AND acked=0;`,
+			params.DeliveriesTable,
+			lockUntil("leased_until", params.LockTimeout),
+			params.ConsumerGroup,
+			params.LeaseOwner,
+		)
+	}
+	return fmt.Sprintf(
+		`UPDATE '%s' SET %s, offset_acked=? WHERE consumer_group="%s" AND offset_acked=? AND %s>=CAST(unixepoch('subsec')*1000 AS INTEGER) RETURNING locked_until_ms`,
+		params.OffsetsTable,
+		lockUntil("locked_until", params.LockTimeout),
+		params.ConsumerGroup,
+		lockedUntil("locked_until"),
+	)
+}
+
+// AcknowledgeMessagesQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) AcknowledgeMessagesQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		return a.advanceOffsetQuery(params) + `;`
+	}
+	if params.DelayedDelivery {
+		// offset advances up to the first message that was not acknowledged yet
+		return fmt.Sprintf(`
+			UPDATE '%s' SET locked_until=0, locked_until_ms=0, offset_acked=COALESCE(
+				(SELECT MIN(t."offset")-1 FROM '%s' AS t WHERE t."offset">?2 AND NOT EXISTS (
+					SELECT 1 FROM '%s' AS d WHERE d.consumer_group='%s' AND d."offset"=t."offset" AND d.acked=1
+				)),
+				(SELECT MAX("offset") FROM '%s' WHERE "offset">?2),
+				?2
+			) WHERE consumer_group='%s' AND offset_acked=?2;
+		`, params.OffsetsTable, params.TopicTable, params.DeliveriesTable, params.ConsumerGroup, params.TopicTable, params.ConsumerGroup)
+	}
+	return fmt.Sprintf(`
+		UPDATE '%s' SET offset_acked=?, locked_until=0, locked_until_ms=0 WHERE consumer_group="%s" AND offset_acked = ?;
+	`, params.OffsetsTable, params.ConsumerGroup)
+}
+
+// advanceOffsetQuery moves the consumer group offset up to the first message that was not acknowledged yet.
+func (a DefaultOffsetsAdapter) advanceOffsetQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		UPDATE '%s' SET offset_acked=COALESCE(
+			(SELECT MIN(t."offset")-1 FROM '%s' AS t WHERE t."offset">offset_acked AND NOT EXISTS (
+				SELECT 1 FROM '%s' AS d WHERE d.consumer_group='%s' AND d."offset"=t."offset" AND d.acked=1
+			)),
+			(SELECT MAX("offset") FROM '%s' WHERE "offset">offset_acked),
+			offset_acked
+		) WHERE consumer_group='%s'`,
+		params.OffsetsTable, params.TopicTable, params.DeliveriesTable, params.ConsumerGroup, params.TopicTable, params.ConsumerGroup)
+}
+
+// AcknowledgeDeliveryQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) AcknowledgeDeliveryQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (consumer_group, "offset", acked) VALUES ('%s', ?, 1)
+		ON CONFLICT(consumer_group, "offset") DO UPDATE SET acked=1;
+	`, params.DeliveriesTable, params.ConsumerGroup)
+}
+
+// CountDeliveryAttemptQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) CountDeliveryAttemptQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (consumer_group, "offset", attempts) VALUES ('%s', ?, 1)
+		ON CONFLICT(consumer_group, "offset") DO UPDATE SET attempts=attempts+1
+		RETURNING attempts;
+	`, params.DeliveriesTable, params.ConsumerGroup)
+}
+
+// ForgetDeliveriesQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) ForgetDeliveriesQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(
+		`DELETE FROM '%s' WHERE consumer_group='%s' AND "offset"<=(SELECT offset_acked FROM '%s' WHERE consumer_group='%s');`,
+		params.DeliveriesTable,
+		params.ConsumerGroup,
+		params.OffsetsTable,
+		params.ConsumerGroup,
+	)
+}
+
+// LeaseMessageQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) LeaseMessageQuery(params SubscriptionQueryParams) string {
+	seconds, milliseconds := lockExpiry(params.LockTimeout)
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (consumer_group, "offset", leased_until, leased_until_ms, lease_owner) VALUES ('%s', ?, %s, %s, '%s')
+		ON CONFLICT(consumer_group, "offset") DO UPDATE SET leased_until=excluded.leased_until, leased_until_ms=excluded.leased_until_ms, lease_owner=excluded.lease_owner;
+	`, params.DeliveriesTable, params.ConsumerGroup, seconds, milliseconds, params.LeaseOwner)
+}
+
+// ReleaseLeasesQuery satisfies the [OffsetsAdapter] interface.
+func (a DefaultOffsetsAdapter) ReleaseLeasesQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(
+		`UPDATE '%s' SET leased_until=0, leased_until_ms=0, lease_owner='' WHERE consumer_group='%s' AND lease_owner='%s' AND acked=0;`,
+		params.DeliveriesTable,
+		params.ConsumerGroup,
+		params.LeaseOwner,
+	)
+}
+
+// lockUntil renders assignments that lock or lease a row until the lock timeout ends.
+// The column with the _ms suffix holds the expiry in milliseconds, which decides the lock.
+// The column itself holds the expiry in whole seconds, rounded up, so that readers
+// that predate the milliseconds column never consider the lock expired early.
+func lockUntil(column string, d time.Duration) string {
+	seconds, milliseconds := lockExpiry(d)
+	return fmt.Sprintf(`%[1]s=%[2]s, %[1]s_ms=%[3]s`, column, seconds, milliseconds)
+}
+
+// lockExpiry renders the time when the lock timeout ends in Unix seconds, rounded up, and in Unix milliseconds.
+func lockExpiry(d time.Duration) (seconds, milliseconds string) {
+	milliseconds = fmt.Sprintf(`CAST(unixepoch('subsec')*1000 AS INTEGER)+%d`, d.Milliseconds())
+	return `(` + milliseconds + `+999)/1000`, milliseconds
+}
+
+// lockedUntil renders the time when the lock or lease in a column set by [lockUntil] ends in Unix milliseconds.
+// Writers that predate the milliseconds column move only the column in seconds past the rounded up
+// milliseconds column. Their locks are held until the end of that second,
+// the same as they are by readers that compare the column in seconds to unixepoch().
+func lockedUntil(column string) string {
+	return fmt.Sprintf(
+		`MAX(IIF(COALESCE(%[1]s, 0)>(COALESCE(%[1]s_ms, 0)+999)/1000, %[1]s*1000+999, 0), COALESCE(%[1]s_ms, 0))`,
+		column,
+	)
+}
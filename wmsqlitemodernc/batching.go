@@ -0,0 +1,198 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// BatchingPublisherOptions configure the publisher that coalesces concurrent publishing into group commits.
+type BatchingPublisherOptions struct {
+	PublisherOptions
+
+	// Window is the time the publisher waits for more concurrent publishing
+	// after the first message of a batch arrives. Longer windows commit larger batches
+	// at the cost of publishing latency. Default value is one millisecond.
+	Window time.Duration
+
+	// MaxMessages commits the batch without waiting for the window to close
+	// once it holds this many messages. Default value is 256.
+	MaxMessages int
+}
+
+type publishRequest struct {
+	topic    string
+	messages message.Messages
+	result   chan error
+}
+
+// BatchingPublisher collects messages from concurrent publishing calls and writes them
+// in one transaction with a multi-row insert per topic. Each transaction commit
+// costs a file synchronization, which dominates publishing time when many goroutines
+// publish single messages. Each call returns once the transaction with its messages is committed.
+type BatchingPublisher struct {
+	db          SQLiteDatabase
+	publisher   *publisher
+	window      time.Duration
+	maxMessages int
+
+	requests  chan publishRequest
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBatchingPublisher creates a [message.Publisher] that coalesces concurrent publishing into group commits.
+// The database handle must not be a transaction, because the publisher opens its own.
+func NewBatchingPublisher(db SQLiteDatabase, options BatchingPublisherOptions) (*BatchingPublisher, error) {
+	if db == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	if options.Window < 0 {
+		return nil, errors.New("Window must not be negative")
+	}
+	if options.MaxMessages < 0 {
+		return nil, errors.New("MaxMessages must not be negative")
+	}
+	pub, err := NewPublisher(db, options.PublisherOptions)
+	if err != nil {
+		return nil, err
+	}
+	p := &BatchingPublisher{
+		db:          db,
+		publisher:   pub.(*publisher),
+		window:      cmpOrTODO(options.Window, time.Millisecond),
+		maxMessages: cmpOrTODO(options.MaxMessages, 256),
+		requests:    make(chan publishRequest),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go p.loop()
+	return p, nil
+}
+
+// Publish pushes messages into a topic with the next group commit.
+// Returns [ErrPublisherIsClosed] if the publisher is closed.
+func (p *BatchingPublisher) Publish(topic string, messages ...*message.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	request := publishRequest{
+		topic:    topic,
+		messages: messages,
+		result:   make(chan error, 1),
+	}
+	select {
+	case <-p.closed:
+		return ErrPublisherIsClosed
+	case p.requests <- request:
+		return <-request.result
+	}
+}
+
+func (p *BatchingPublisher) loop() {
+	defer close(p.done)
+	timer := time.NewTimer(p.window)
+	timer.Stop()
+
+	for {
+		var batch []publishRequest
+		select {
+		case <-p.closed:
+			return
+		case request := <-p.requests:
+			batch = append(batch, request)
+		}
+
+		size := len(batch[0].messages)
+		timer.Reset(p.window)
+	collect:
+		for size < p.maxMessages {
+			select {
+			case <-p.closed:
+				break collect
+			case <-timer.C:
+				break collect
+			case request := <-p.requests:
+				batch = append(batch, request)
+				size += len(request.messages)
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		p.commit(batch)
+	}
+}
+
+// commit writes the batch in one transaction. If the transaction fails,
+// each request is published separately, so that one bad request
+// does not fail the publishing calls that were batched together with it.
+func (p *BatchingPublisher) commit(batch []publishRequest) {
+	err := p.commitTogether(batch)
+	if err == nil || len(batch) == 1 {
+		for _, request := range batch {
+			request.result <- err
+		}
+		return
+	}
+	p.publisher.Logger.Error("Unable to commit batched messages, publishing them separately", err, watermill.LogFields{
+		"requests": len(batch),
+	})
+	for _, request := range batch {
+		request.result <- p.publisher.Publish(request.topic, request.messages...)
+	}
+}
+
+func (p *BatchingPublisher) commitTogether(batch []publishRequest) (err error) {
+	ctx := context.Background()
+	topics := make([]string, 0, 1)
+	messages := make(map[string]message.Messages)
+	for _, request := range batch {
+		if _, ok := messages[request.topic]; !ok {
+			topics = append(topics, request.topic)
+			if err = p.publisher.initializeSchema(ctx, request.topic, p.publisher.TopicTableNameGenerator(request.topic)); err != nil {
+				return err
+			}
+		}
+		messages[request.topic] = append(messages[request.topic], request.messages...)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin batch transaction: %w", err)
+	}
+	for _, topic := range topics {
+		if err = p.publisher.insert(ctx, tx, topic, messages[topic]); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit batch transaction: %w", err)
+	}
+	for _, topic := range topics {
+		published.Notify(p.publisher.TopicTableNameGenerator(topic))
+	}
+	return nil
+}
+
+// Close stops batching after committing the messages that are already collected.
+func (p *BatchingPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		<-p.done
+	})
+	return p.publisher.Close()
+}
+
+func (p *BatchingPublisher) String() string {
+	return "sqlite3-modernc-batching-publisher-" + p.publisher.UUID
+}
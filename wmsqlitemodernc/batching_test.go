@@ -0,0 +1,73 @@
+package wmsqlitemodernc
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestBatchingPublisher(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub, err := NewBatchingPublisher(db, BatchingPublisherOptions{
+		PublisherOptions: PublisherOptions{
+			InitializeSchema: true,
+		},
+		Window: time.Millisecond * 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, db, SubscriberOptions{})
+
+	topic := "TestBatchingPublisher"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const concurrent = 32
+	errs := make(chan error, concurrent+1)
+	for i := 0; i < concurrent; i++ {
+		go func(i int) {
+			errs <- pub.Publish(topic, message.NewMessage(strconv.Itoa(i), []byte{}))
+		}(i)
+	}
+	go func() {
+		// fails the batch it lands in, which must not fail other publishing calls
+		invalid := message.NewMessage("invalid", []byte{})
+		invalid.Metadata.Set(MetadataKeyDeliverAt, "tomorrow")
+		errs <- pub.Publish(topic, invalid)
+	}()
+	failed := 0
+	for i := 0; i < concurrent+1; i++ {
+		if err = <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected only the invalid message to fail publishing, got %d failures", failed)
+	}
+
+	received := make(map[string]struct{})
+	for len(received) < concurrent {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("expected %d messages, received %d", concurrent, len(received))
+		}
+	}
+
+	if err = pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("closed", []byte{})); !errors.Is(err, ErrPublisherIsClosed) {
+		t.Fatalf("expected %q error, got %v", ErrPublisherIsClosed, err)
+	}
+}
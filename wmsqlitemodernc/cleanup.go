@@ -0,0 +1,216 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// CleanUpOptions configure [CleanUpTopics] and [StartCleanUpRoutine].
+//
+// Messages that were acknowledged by every consumer group of a topic
+// are always removed. MaxAge and MaxRows add a retention policy which
+// removes messages even if some consumer groups did not acknowledge them yet.
+type CleanUpOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// Topics limits the clean up to the listed topics. If empty,
+	// topics are discovered by matching SQLite table names against TableNameGenerators.
+	// Discovery only works for generators that prefix or suffix the topic name.
+	Topics []string
+
+	// MaxAge removes messages published earlier than the given duration ago.
+	// Zero value disables the age limit.
+	MaxAge time.Duration
+
+	// MaxRows keeps at most the given number of latest messages in each topic table.
+	// Zero value disables the row count limit.
+	MaxRows int64
+
+	// Interval is the time between clean ups performed by [StartCleanUpRoutine].
+	// Defaults to one minute.
+	Interval time.Duration
+
+	// Logger tracks any problems that might emerge when cleaning up topics
+	// in the background. Defaults to [watermill.NopLogger].
+	Logger watermill.LoggerAdapter
+}
+
+func (o CleanUpOptions) validate() error {
+	if o.MaxAge < 0 {
+		return errors.New("MaxAge must not be negative")
+	}
+	if o.MaxRows < 0 {
+		return errors.New("MaxRows must not be negative")
+	}
+	if o.Interval < 0 {
+		return errors.New("Interval must not be negative")
+	}
+	if o.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils().sharesTables() {
+		return ErrSingleTableStorageIsNotSupported
+	}
+	for _, topic := range o.Topics {
+		if err := validateTopicName(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanUpTopics removes messages from topic tables once every consumer group
+// in the matching offsets table acknowledged them. Applies the retention
+// policy set by MaxAge and MaxRows [CleanUpOptions]. Deliveries of removed messages
+// are deleted in the same transaction. Returns the number of removed messages.
+func CleanUpTopics(ctx context.Context, db SQLiteConnection, options CleanUpOptions) (removed int64, err error) {
+	if db == nil {
+		return 0, ErrDatabaseConnectionIsNil
+	}
+	if err = options.validate(); err != nil {
+		return 0, err
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	topics := options.Topics
+	if len(topics) == 0 {
+		if topics, err = findTopics(ctx, db, tng); err != nil {
+			return 0, err
+		}
+	}
+
+	var cutOff int64
+	if options.MaxAge > 0 {
+		cutOff = time.Now().Add(-options.MaxAge).Unix()
+	}
+	for _, topic := range topics {
+		affected, err := cleanUpTopic(ctx, db, tng, topic, cutOff, options.MaxRows)
+		if err != nil {
+			return removed, err
+		}
+		removed += affected
+	}
+	return removed, nil
+}
+
+// cleanUpTopic removes messages from a topic table together with their deliveries.
+// Starts a transaction, unless db already is one.
+func cleanUpTopic(
+	ctx context.Context,
+	db SQLiteConnection,
+	tng TableNameGenerators,
+	topic string,
+	cutOff int64,
+	maxRows int64,
+) (removed int64, err error) {
+	if handle, ok := db.(SQLiteDatabase); ok && !isTx(db) {
+		tx, err := handle.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, fmt.Errorf("unable to begin clean up transaction of topic %q: %w", topic, err)
+		}
+		if removed, err = cleanUpTopic(ctx, tx, tng, topic, cutOff, maxRows); err != nil {
+			return 0, errors.Join(err, tx.Rollback())
+		}
+		if err = tx.Commit(); err != nil {
+			return 0, fmt.Errorf("unable to commit clean up transaction of topic %q: %w", topic, err)
+		}
+		return removed, nil
+	}
+
+	topicTable := tng.Topic(topic)
+	query, args := cleanUpQuery(topicTable, tng.Offsets(topic), cutOff, maxRows)
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("unable to clean up topic %q: %w", topic, err)
+	}
+	if removed, err = result.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("unable to count removed messages from topic %q: %w", topic, err)
+	}
+
+	deliveriesTable := tng.Deliveries(topic)
+	var present bool
+	if err = db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type='table' AND name=?)`,
+		deliveriesTable,
+	).Scan(&present); err != nil {
+		return 0, fmt.Errorf("unable to look up table %q: %w", deliveriesTable, err)
+	}
+	if present {
+		if _, err = db.ExecContext(ctx, forgetRemovedDeliveriesQuery(topicTable, deliveriesTable)); err != nil {
+			return 0, fmt.Errorf("unable to clean up deliveries of topic %q: %w", topic, err)
+		}
+	}
+	return removed, nil
+}
+
+// StartCleanUpRoutine runs [CleanUpTopics] periodically in a context-bound background routine.
+// Returns an error only if the options are invalid.
+func StartCleanUpRoutine(ctx context.Context, db SQLiteConnection, options CleanUpOptions) error {
+	if ctx == nil {
+		return errors.New("context is nil")
+	}
+	if db == nil {
+		return ErrDatabaseConnectionIsNil
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if options.Interval == 0 {
+		options.Interval = time.Minute
+	}
+	if options.Logger == nil {
+		options.Logger = defaultLogger
+	}
+
+	go func(ctx context.Context, ticker *time.Ticker, logger watermill.LoggerAdapter) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				removed, err := CleanUpTopics(ctx, db, options)
+				if err != nil {
+					if !errors.Is(err, context.Canceled) {
+						logger.Error("failed to clean up SQLite topic tables", err, nil)
+					}
+				} else {
+					logger.Debug("cleaned up SQLite topic tables", watermill.LogFields{
+						"removed": removed,
+					})
+				}
+			}
+		}
+	}(ctx, time.NewTicker(options.Interval), options.Logger)
+	return nil
+}
+
+func cleanUpQuery(messagesTableName, offsetsTableName string, cutOff int64, maxRows int64) (query string, args []any) {
+	b := strings.Builder{}
+	_, _ = b.WriteString(`DELETE FROM '`)
+	_, _ = b.WriteString(messagesTableName)
+	_, _ = b.WriteString(`' WHERE "offset"<=(SELECT MIN(offset_acked) FROM '`)
+	_, _ = b.WriteString(offsetsTableName)
+	_, _ = b.WriteString(`')`)
+	if cutOff > 0 {
+		_, _ = b.WriteString(` OR unixepoch(created_at)<?`)
+		args = append(args, cutOff)
+	}
+	if maxRows > 0 {
+		_, _ = b.WriteString(` OR "offset"<=(SELECT "offset" FROM '`)
+		_, _ = b.WriteString(messagesTableName)
+		_, _ = b.WriteString(`' ORDER BY "offset" DESC LIMIT 1 OFFSET ?)`)
+		args = append(args, maxRows)
+	}
+	return b.String(), args
+}
+
+// forgetRemovedDeliveriesQuery deletes deliveries of messages that are no longer in the topic table.
+func forgetRemovedDeliveriesQuery(messagesTableName, deliveriesTableName string) string {
+	return `DELETE FROM '` + deliveriesTableName + `' WHERE "offset" NOT IN (SELECT "offset" FROM '` + messagesTableName + `');`
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/dkotik/watermillsqlite/wmsqlitemodernc"
+)
+
+var tableNames = wmsqlitemodernc.TableNameGenerators{}.WithDefaultGeneratorsInsteadOfNils()
+
+func newFlagSet(name string, std streams) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(std.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(std.Stderr, "Usage: wmsqlite -db <data source name> %s [flags]\n\nFlags:\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// requireTopic checks that the topic flag is set and the topic tables exist.
+func requireTopic(ctx context.Context, db *sql.DB, flags *flag.FlagSet, topic string) (state wmsqlitemodernc.TopicState, err error) {
+	if topic == "" {
+		fmt.Fprintln(flags.Output(), "topic flag is required")
+		flags.Usage()
+		return state, errUsage
+	}
+	inspector, err := wmsqlitemodernc.NewInspector(db, wmsqlitemodernc.InspectorOptions{})
+	if err != nil {
+		return state, err
+	}
+	return inspector.Inspect(ctx, topic)
+}
+
+func runTopics(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("topics", std)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	inspector, err := wmsqlitemodernc.NewInspector(db, wmsqlitemodernc.InspectorOptions{})
+	if err != nil {
+		return err
+	}
+	states, err := inspector.InspectAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(std.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tMAX OFFSET\tCONSUMER GROUP\tOFFSET ACKED\tLAG\tLOCKED UNTIL")
+	for _, state := range states {
+		if len(state.ConsumerGroups) == 0 {
+			fmt.Fprintf(w, "%s\t%d\t-\t-\t-\t-\n", state.Topic, state.MaxOffset)
+		}
+		for _, group := range state.ConsumerGroups {
+			lockedUntil := "-"
+			if group.Locked {
+				lockedUntil = group.LockedUntil.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\n", state.Topic, state.MaxOffset, group.Name, group.OffsetAcked, group.Lag, lockedUntil)
+		}
+	}
+	return w.Flush()
+}
+
+// tailedMessage is a line of the tail command output.
+type tailedMessage struct {
+	Offset      int64           `json:"offset"`
+	UUID        string          `json:"uuid"`
+	PublishedAt string          `json:"published_at"`
+	Metadata    json.RawMessage `json:"metadata"`
+	Payload     string          `json:"payload"`
+
+	// EncryptedWithKey names the key of an encrypted message, whose payload is not printed.
+	EncryptedWithKey string `json:"encrypted_with_key,omitempty"`
+}
+
+func runTail(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("tail", std)
+	topic := flags.String("topic", "", "topic to print")
+	lines := flags.Int64("n", 10, "number of the latest messages to print before following")
+	follow := flags.Bool("follow", true, "keep printing messages as they are published")
+	interval := flags.Duration("interval", time.Millisecond*500, "time between checks for new messages")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	state, err := requireTopic(ctx, db, flags, *topic)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	encoder := json.NewEncoder(std.Stdout)
+	last := max(state.MaxOffset-*lines, 0)
+	for {
+		if last, err = tail(ctx, db, tableNames.Topic(*topic), last, encoder); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !*follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tail prints messages following the offset and returns the offset of the last printed message.
+func tail(ctx context.Context, db *sql.DB, topicTable string, offset int64, encoder *json.Encoder) (last int64, err error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT "offset", uuid, created_at, metadata, payload FROM '`+topicTable+`' WHERE "offset">? ORDER BY "offset";`,
+		offset,
+	)
+	if err != nil {
+		return offset, err
+	}
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+
+	last = offset
+	var (
+		next    tailedMessage
+		payload []byte
+	)
+	for rows.Next() {
+		if err = rows.Scan(&next.Offset, &next.UUID, &next.PublishedAt, &next.Metadata, &payload); err != nil {
+			return last, err
+		}
+		if payload, next.EncryptedWithKey, err = decodePayload(next.Metadata, payload); err != nil {
+			return last, fmt.Errorf("unable to decode message %q payload: %w", next.UUID, err)
+		}
+		next.Payload = string(payload)
+		if err = encoder.Encode(next); err != nil {
+			return last, err
+		}
+		last = next.Offset
+	}
+	return last, rows.Err()
+}
+
+// decodePayload decompresses payloads published with a built-in [wmsqlitemodernc.PayloadCodec].
+// Encrypted payloads are left out, and the ID of their key is returned instead.
+func decodePayload(rawMetadata json.RawMessage, payload []byte) (_ []byte, keyID string, err error) {
+	metadata := message.Metadata{}
+	if err = json.Unmarshal(rawMetadata, &metadata); err != nil {
+		return nil, "", err
+	}
+	if keyID = metadata.Get(wmsqlitemodernc.MetadataKeyEncryptionKeyID); keyID != "" {
+		return nil, keyID, nil
+	}
+	name := metadata.Get(wmsqlitemodernc.MetadataKeyPayloadCodec)
+	if name == "" {
+		return payload, "", nil
+	}
+	codec, err := wmsqlitemodernc.PayloadCodecByName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	payload, err = codec.Decode(payload)
+	return payload, "", err
+}
+
+// metadataFlag collects repeated key=value flags.
+type metadataFlag message.Metadata
+
+func (f metadataFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f metadataFlag) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return errors.New("metadata must be set as key=value")
+	}
+	f[key] = value
+	return nil
+}
+
+func runPublish(ctx context.Context, db *sql.DB, args []string, std streams) (err error) {
+	flags := newFlagSet("publish", std)
+	topic := flags.String("topic", "", "topic to publish to")
+	id := flags.String("uuid", "", "message UUID; generated if empty")
+	initialize := flags.Bool("init", false, "create topic tables, if they are absent")
+	metadata := make(metadataFlag)
+	flags.Var(metadata, "m", "metadata `key=value` pair; repeat for more pairs")
+	if err = parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *initialize && *topic == "" {
+		fmt.Fprintln(flags.Output(), "topic flag is required")
+		flags.Usage()
+		return errUsage
+	} else if !*initialize {
+		if _, err = requireTopic(ctx, db, flags, *topic); err != nil {
+			return err
+		}
+	}
+
+	payload, err := io.ReadAll(std.Stdin)
+	if err != nil {
+		return fmt.Errorf("unable to read payload: %w", err)
+	}
+	if *id == "" {
+		*id = watermill.NewUUID()
+	}
+	msg := message.NewMessage(*id, payload)
+	msg.Metadata = message.Metadata(metadata)
+	msg.SetContext(ctx)
+
+	publisher, err := wmsqlitemodernc.NewPublisher(db, wmsqlitemodernc.PublisherOptions{
+		InitializeSchema: *initialize,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, publisher.Close())
+	}()
+	if err = publisher.Publish(*topic, msg); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(std.Stdout, msg.UUID)
+	return err
+}
+
+func parsePosition(value string) (wmsqlitemodernc.Position, error) {
+	kind, argument, _ := strings.Cut(value, ":")
+	switch kind {
+	case "earliest":
+		return wmsqlitemodernc.PositionEarliest(), nil
+	case "latest":
+		return wmsqlitemodernc.PositionLatest(), nil
+	case "offset":
+		offset, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			return wmsqlitemodernc.Position{}, fmt.Errorf("invalid offset position %q: %w", value, err)
+		}
+		return wmsqlitemodernc.PositionAtOffset(offset), nil
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, argument)
+		if err != nil {
+			return wmsqlitemodernc.Position{}, fmt.Errorf("invalid time position %q: %w", value, err)
+		}
+		return wmsqlitemodernc.PositionAtTime(t), nil
+	default:
+		return wmsqlitemodernc.Position{}, fmt.Errorf("unknown position %q: use earliest, latest, offset:N, or time:RFC3339", value)
+	}
+}
+
+func runSeek(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("seek", std)
+	topic := flags.String("topic", "", "topic of the consumer group")
+	group := flags.String("group", wmsqlitemodernc.DefaultConsumerGroupName, "consumer group to move")
+	to := flags.String("to", "", "position: earliest, latest, offset:N, or time:RFC3339")
+	timeout := flags.Duration("timeout", time.Second*30, "time to wait for active subscriptions to release the consumer group lock")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if _, err := requireTopic(ctx, db, flags, *topic); err != nil {
+		return err
+	}
+	position, err := parsePosition(*to)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	offsetAcked, err := wmsqlitemodernc.Seek(ctx, db, wmsqlitemodernc.SeekOptions{
+		Topic:         *topic,
+		ConsumerGroup: *group,
+		Position:      position,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(std.Stdout, "consumer group %q of topic %q moved to %s, acknowledged offset is %d\n", *group, *topic, position, offsetAcked)
+	return err
+}
+
+func runUnlock(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("unlock", std)
+	topic := flags.String("topic", "", "topic of the consumer group")
+	group := flags.String("group", wmsqlitemodernc.DefaultConsumerGroupName, "consumer group to unlock")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	state, err := requireTopic(ctx, db, flags, *topic)
+	if err != nil {
+		return err
+	}
+	for _, consumerGroup := range state.ConsumerGroups {
+		if consumerGroup.Name != *group {
+			continue
+		}
+		if !consumerGroup.Locked {
+			_, err = fmt.Fprintf(std.Stdout, "consumer group %q of topic %q is not locked\n", *group, *topic)
+			return err
+		}
+		var migrated bool
+		if err = db.QueryRowContext(
+			ctx,
+			`SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name='locked_until_ms')`,
+			tableNames.Offsets(*topic),
+		).Scan(&migrated); err != nil {
+			return fmt.Errorf("unable to read offsets table columns: %w", err)
+		}
+		if !migrated {
+			return fmt.Errorf("run the migrate command before unlocking consumer group %q of topic %q: %w", *group, *topic, wmsqlitemodernc.ErrSchemaIsOlder)
+		}
+		if _, err = db.ExecContext(
+			ctx,
+			`UPDATE '`+tableNames.Offsets(*topic)+`' SET locked_until=0, locked_until_ms=0 WHERE consumer_group=?;`,
+			*group,
+		); err != nil {
+			return fmt.Errorf("unable to release consumer group lock: %w", err)
+		}
+		_, err = fmt.Fprintf(std.Stdout, "released consumer group %q of topic %q locked until %s\n", *group, *topic, consumerGroup.LockedUntil.Format(time.RFC3339))
+		return err
+	}
+	return fmt.Errorf("consumer group %q of topic %q does not exist", *group, *topic)
+}
+
+// topicsFlag collects repeated topic flags.
+type topicsFlag []string
+
+func (f *topicsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *topicsFlag) Set(topic string) error {
+	*f = append(*f, topic)
+	return nil
+}
+
+func runPurge(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("purge", std)
+	var topics topicsFlag
+	flags.Var(&topics, "topic", "topic to purge; repeat for more topics; all topics if not set")
+	maxAge := flags.Duration("max-age", 0, "also remove messages older than the given duration, even if they were not acknowledged")
+	maxRows := flags.Int64("max-rows", 0, "also remove all but the given number of latest messages, even if they were not acknowledged")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	removed, err := wmsqlitemodernc.CleanUpTopics(ctx, db, wmsqlitemodernc.CleanUpOptions{
+		Topics:  topics,
+		MaxAge:  *maxAge,
+		MaxRows: *maxRows,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(std.Stdout, "removed %d messages\n", removed)
+	return err
+}
+
+func runMigrate(ctx context.Context, db *sql.DB, args []string, std streams) error {
+	flags := newFlagSet("migrate", std)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := wmsqlitemodernc.Migrate(ctx, db, wmsqlitemodernc.MigrateOptions{
+		TableNameGenerators: tableNames,
+	}); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(std.Stdout, "tables of every topic are at the latest schema")
+	return err
+}
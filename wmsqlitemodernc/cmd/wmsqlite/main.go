@@ -0,0 +1,126 @@
+/*
+Command wmsqlite operates Watermill SQLite message databases without a raw SQLite shell.
+
+Usage:
+
+	wmsqlite -db <data source name> <command> [flags]
+
+The data source name is passed to the modernc.org/sqlite driver as is, for example:
+"file:messages.sqlite3?_pragma=busy_timeout(5000)". Defaults to WMSQLITE_DB environment variable.
+
+Commands:
+
+	topics   list topics and their consumer groups with lag and lock state
+	tail     print messages of a topic as they are published
+	publish  publish a message with the payload read from standard input
+	seek     move a consumer group to the earliest, latest, offset:N, or time:RFC3339 position
+	unlock   force-release a stuck consumer group lock
+	purge    remove messages acknowledged by every consumer group
+	migrate  upgrade tables of every topic to the latest schema
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	_ "modernc.org/sqlite"
+)
+
+var errUsage = errors.New("invalid usage")
+
+// streams are standard input and outputs of a command.
+type streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type command struct {
+	Summary string
+	Run     func(ctx context.Context, db *sql.DB, args []string, std streams) error
+}
+
+var commands = map[string]command{
+	"topics":  {Summary: "list topics and their consumer groups", Run: runTopics},
+	"tail":    {Summary: "print messages of a topic as they are published", Run: runTail},
+	"publish": {Summary: "publish a message with the payload read from standard input", Run: runPublish},
+	"seek":    {Summary: "move a consumer group to a position", Run: runSeek},
+	"unlock":  {Summary: "force-release a stuck consumer group lock", Run: runUnlock},
+	"purge":   {Summary: "remove messages acknowledged by every consumer group", Run: runPurge},
+	"migrate": {Summary: "upgrade tables of every topic to the latest schema", Run: runMigrate},
+}
+
+var commandOrder = []string{"topics", "tail", "publish", "seek", "unlock", "purge", "migrate"}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], streams{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2) // flag package already explained the problem
+		}
+		fmt.Fprintln(os.Stderr, "wmsqlite:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, std streams) (err error) {
+	flags := flag.NewFlagSet("wmsqlite", flag.ContinueOnError)
+	flags.SetOutput(std.Stderr)
+	dsn := flags.String("db", os.Getenv("WMSQLITE_DB"), "SQLite data source name; defaults to WMSQLITE_DB environment variable")
+	flags.Usage = func() {
+		fmt.Fprintln(std.Stderr, "Usage: wmsqlite -db <data source name> <command> [flags]")
+		fmt.Fprintln(std.Stderr, "\nCommands:")
+		for _, name := range commandOrder {
+			fmt.Fprintf(std.Stderr, "  %-8s %s\n", name, commands[name].Summary)
+		}
+		fmt.Fprintln(std.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	if err = parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(std.Stderr, "unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return errUsage
+	}
+	if *dsn == "" {
+		fmt.Fprintln(std.Stderr, "database is not set: use -db flag or WMSQLITE_DB environment variable")
+		return errUsage
+	}
+
+	db, err := sql.Open("sqlite", *dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, db.Close())
+	}()
+	if err = db.PingContext(ctx); err != nil {
+		return fmt.Errorf("unable to open database: %w", err)
+	}
+	return cmd.Run(ctx, db, flags.Args()[1:], std)
+}
+
+// parseFlags reports flag errors as [errUsage], because the flag set prints them along with the usage.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/dkotik/watermillsqlite/wmsqlitemodernc"
+)
+
+func TestCommands(t *testing.T) {
+	// TODO: replace with t.Context() after Watermill bumps to Golang 1.24
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	DSN := "file:" + filepath.Join(t.TempDir(), "messages.sqlite3") + "?_pragma=busy_timeout(5000)"
+	wmsqlite := func(t *testing.T, stdin string, args ...string) string {
+		t.Helper()
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		if err := run(ctx, append([]string{"-db", DSN}, args...), streams{
+			Stdin:  strings.NewReader(stdin),
+			Stdout: stdout,
+			Stderr: stderr,
+		}); err != nil {
+			t.Fatalf("wmsqlite %s: %v\n%s", strings.Join(args, " "), err, stderr)
+		}
+		return stdout.String()
+	}
+	expect := func(t *testing.T, output string, fragments ...string) {
+		t.Helper()
+		for _, fragment := range fragments {
+			if !strings.Contains(output, fragment) {
+				t.Fatalf("output does not contain %q:\n%s", fragment, output)
+			}
+		}
+	}
+
+	wmsqlite(t, "first", "publish", "-topic", "orders", "-init", "-uuid", "1", "-m", "source=cli")
+	wmsqlite(t, "second", "publish", "-topic", "orders", "-uuid", "2")
+	expect(t,
+		wmsqlite(t, "", "tail", "-topic", "orders", "-follow=false"),
+		`"offset":1,"uuid":"1"`,
+		`"metadata":{"source":"cli"},"payload":"first"`,
+		`"payload":"second"`,
+	)
+	t.Run("encrypted payloads are not printed", func(t *testing.T) {
+		db, err := sql.Open("sqlite", DSN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		pub, err := wmsqlitemodernc.NewPublisher(db, wmsqlitemodernc.PublisherOptions{
+			InitializeSchema: true,
+			KeyProvider: wmsqlitemodernc.KeyRing{
+				CurrentKeyID: "first",
+				Keys:         map[string][]byte{"first": make([]byte, 32)},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = pub.Publish("secrets", message.NewMessage("1", []byte("secret"))); err != nil {
+			t.Fatal(err)
+		}
+		output := wmsqlite(t, "", "tail", "-topic", "secrets", "-follow=false")
+		expect(t, output, `"payload":"","encrypted_with_key":"first"`)
+		if strings.Contains(output, "secret\"") {
+			t.Fatalf("output contains the payload:\n%s", output)
+		}
+	})
+	expect(t,
+		wmsqlite(t, "", "seek", "-topic", "orders", "-group", "billing", "-to", "offset:2"),
+		"acknowledged offset is 1",
+	)
+	expect(t,
+		wmsqlite(t, "", "topics"),
+		"orders", "billing", "1", // acknowledged offset
+	)
+	expect(t,
+		wmsqlite(t, "", "unlock", "-topic", "orders", "-group", "billing"),
+		"is not locked",
+	)
+	expect(t,
+		wmsqlite(t, "", "seek", "-topic", "orders", "-group", "billing", "-to", "latest"),
+		"acknowledged offset is 2",
+	)
+	expect(t,
+		wmsqlite(t, "", "purge", "-topic", "orders"),
+		"removed 2 messages",
+	)
+
+	t.Run("unlock refuses tables that were not migrated", func(t *testing.T) {
+		db, err := sql.Open("sqlite", DSN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		// offsets table of the first release
+		if _, err = db.ExecContext(ctx, `
+			CREATE TABLE 'watermill_legacy' ("offset" INTEGER PRIMARY KEY AUTOINCREMENT, uuid TEXT NOT NULL, created_at TEXT NOT NULL, payload BLOB NOT NULL, metadata JSON NOT NULL);
+			CREATE TABLE 'watermill_offsets_legacy' (consumer_group TEXT NOT NULL, offset_acked INTEGER NOT NULL, locked_until INTEGER NOT NULL, PRIMARY KEY(consumer_group));
+			INSERT INTO 'watermill_offsets_legacy' VALUES ('default', 0, unixepoch()+60);
+		`); err != nil {
+			t.Fatal(err)
+		}
+		err = run(ctx, []string{"-db", DSN, "unlock", "-topic", "legacy"}, streams{Stdin: strings.NewReader(""), Stdout: io.Discard, Stderr: io.Discard})
+		if !errors.Is(err, wmsqlitemodernc.ErrSchemaIsOlder) {
+			t.Fatalf("expected an error for the table that was not migrated, got %v", err)
+		}
+		expect(t,
+			wmsqlite(t, "", "migrate"),
+			"latest schema",
+		)
+		expect(t,
+			wmsqlite(t, "", "unlock", "-topic", "legacy"),
+			`released consumer group "default" of topic "legacy"`,
+		)
+	})
+
+	err := run(ctx, []string{"-db", DSN, "tail"}, streams{Stdin: strings.NewReader(""), Stdout: io.Discard, Stderr: io.Discard})
+	if !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error for missing topic flag, got %v", err)
+	}
+}
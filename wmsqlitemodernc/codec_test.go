@@ -0,0 +1,137 @@
+package wmsqlitemodernc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPayloadCodec(t *testing.T) {
+	zstdCodec, err := NewZstdPayloadCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte(`{"key":"value"},`), 1000)
+
+	for _, codec := range []PayloadCodec{GzipPayloadCodec{}, zstdCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			ctx := newTestContext(t)
+
+			db := newTestConnection(t, newTestDSN())
+			legacy := newTestPublisher(t, db, PublisherOptions{})
+			pub := newTestPublisher(t, db, PublisherOptions{
+				PayloadCodec: codec,
+			})
+			sub := newTestSubscriber(t, db, SubscriberOptions{})
+
+			topic := "TestPayloadCodec"
+			if err = legacy.Publish(topic, message.NewMessage("legacy", large)); err != nil {
+				t.Fatal(err)
+			}
+			compressed := message.NewMessage("compressed", large)
+			if err = pub.Publish(topic, compressed, message.NewMessage("small", []byte("small"))); err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Metadata.Get(MetadataKeyPayloadCodec) != "" {
+				t.Fatal("publisher must not change metadata of the published message")
+			}
+
+			stored := make(map[string]int)
+			rows, err := db.QueryContext(ctx, `SELECT uuid, LENGTH(payload) FROM 'watermill_`+topic+`';`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var (
+					id     string
+					length int
+				)
+				if err = rows.Scan(&id, &length); err != nil {
+					t.Fatal(err)
+				}
+				stored[id] = length
+			}
+			if err = rows.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if stored["compressed"] >= len(large) {
+				t.Fatalf("expected compressed payload to be smaller than %d bytes, got %d", len(large), stored["compressed"])
+			}
+			if stored["legacy"] != len(large) || stored["small"] != len("small") {
+				t.Fatalf("payloads below threshold and legacy payloads must be stored as they are: %v", stored)
+			}
+
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range []*message.Message{
+				message.NewMessage("legacy", large),
+				message.NewMessage("compressed", large),
+				message.NewMessage("small", []byte("small")),
+			} {
+				select {
+				case msg := <-messages:
+					if msg.UUID != expected.UUID {
+						t.Fatalf("expected message %q, got %q", expected.UUID, msg.UUID)
+					}
+					if !bytes.Equal(msg.Payload, expected.Payload) {
+						t.Fatalf("message %q payload was not decoded", msg.UUID)
+					}
+					if msg.Metadata.Get(MetadataKeyPayloadCodec) != "" {
+						t.Fatalf("message %q metadata must not name the codec after decoding", msg.UUID)
+					}
+					msg.Ack()
+				case <-time.After(time.Second * 3):
+					t.Fatalf("message %q was not delivered", expected.UUID)
+				}
+			}
+		})
+	}
+}
+
+func TestUndecodablePayload(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestUndecodablePayload"
+	unknown := message.NewMessage("unknown", []byte("unknown"))
+	unknown.Metadata.Set(MetadataKeyPayloadCodec, "unknown")
+	corrupt := message.NewMessage("corrupt", []byte("corrupt"))
+	corrupt.Metadata.Set(MetadataKeyPayloadCodec, GzipPayloadCodec{}.Name())
+	if err := pub.Publish(topic, unknown, corrupt, message.NewMessage("readable", []byte("readable"))); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		MaxDeliveryAttempts: 2,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.UUID != "readable" {
+			t.Fatalf("expected message %q, got %q", "readable", msg.UUID)
+		}
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("undecodable payloads held back the consumer group")
+	}
+
+	var count int
+	if err = db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) FROM 'watermill_`+DefaultDeadLetterTopic(topic)+`' WHERE json_extract(metadata, '$.`+MetadataKeyDeadLetterReason+`')=?`,
+		deadLetterReasonUnreadable,
+	).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected two dead-lettered messages, got %d", count)
+	}
+}
@@ -0,0 +1,81 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type txContextKey struct{}
+
+// TxFromContext returns the transaction of a message delivered by a subscriber
+// with [SubscriberOptions.ConsumeInTransaction] enabled. Handler writes made through
+// the transaction are committed together with the message acknowledgement.
+func TxFromContext(ctx context.Context) (tx *sql.Tx, ok bool) {
+	tx, ok = ctx.Value(txContextKey{}).(*sql.Tx)
+	return tx, ok
+}
+
+// BeginDelivery opens the transaction passed to the message handler.
+// The message is acknowledged first, so the transaction holds
+// the database write lock until it is committed or rolled back.
+func (s *subscription) BeginDelivery(ctx context.Context, offset int64) (tx *sql.Tx, err error) {
+	tx, err = s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.acknowledgesDeliveries {
+		_, err = tx.ExecContext(ctx, s.sqlAcknowledgeDelivery, offset)
+	} else {
+		var lockedUntil int64
+		err = tx.QueryRowContext(ctx, s.sqlExtendLock, offset, s.lockedOffset).Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.metrics.LockLost(ctx)
+			err = errors.New("consumer group lock was lost")
+		}
+	}
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to acknowledge message within transaction: %w", err), tx.Rollback())
+	}
+	return tx, nil
+}
+
+// CommitDelivery refreshes the consumer group lock, which could have expired
+// while the handler was running, and commits the transaction along with the acknowledgement.
+func (s *subscription) CommitDelivery(ctx context.Context, tx *sql.Tx, offset int64) (err error) {
+	if !s.messageLeases {
+		lastAckedOffset, lockedOffset := s.lastAckedOffset, s.lockedOffset
+		if !s.acknowledgesDeliveries {
+			lastAckedOffset, lockedOffset = offset, offset
+		}
+		var lockedUntil int64
+		err = tx.QueryRowContext(ctx, s.sqlExtendLock, lastAckedOffset, lockedOffset).Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the offset is still valid, because no one could write while the transaction was open
+			s.metrics.LockLost(ctx)
+		} else if err != nil {
+			return errors.Join(fmt.Errorf("unable to extend lock: %w", err), tx.Rollback())
+		} else {
+			s.metrics.LockExtended(ctx)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit message transaction: %w", err)
+	}
+	s.lockTicker.Reset(s.lockDuration)
+	if !s.acknowledgesDeliveries {
+		s.lastAckedOffset = offset
+		s.lockedOffset = offset
+	}
+	return nil
+}
+
+// RollbackDelivery discards handler writes along with the acknowledgement.
+// Transactions of cancelled contexts are already rolled back.
+func (s *subscription) RollbackDelivery(tx *sql.Tx) error {
+	if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return fmt.Errorf("unable to roll back message transaction: %w", err)
+	}
+	return nil
+}
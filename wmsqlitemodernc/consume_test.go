@@ -0,0 +1,95 @@
+package wmsqlitemodernc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestConsumeInTransaction(t *testing.T) {
+	for name, options := range map[string]SubscriberOptions{
+		"consumer group lock": {},
+		"message leases":      {MessageLeases: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := newTestContext(t)
+
+			db := newTestConnection(t, newTestDSN())
+			if _, err := db.ExecContext(ctx, `CREATE TABLE processed (uuid TEXT NOT NULL);`); err != nil {
+				t.Fatal(err)
+			}
+			pub := newTestPublisher(t, db, PublisherOptions{})
+			options.PollInterval = time.Millisecond * 20
+			options.InitializeSchema = true
+			options.ConsumeInTransaction = true
+			sub, err := NewSubscriber(db, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := sub.Close(); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			topic := "TestConsumeInTransaction"
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = pub.Publish(topic, message.NewMessage("1", []byte{}), message.NewMessage("2", []byte{})); err != nil {
+				t.Fatal(err)
+			}
+
+			nacked := false
+			for acked := 0; acked < 2; {
+				select {
+				case msg := <-messages:
+					tx, ok := TxFromContext(msg.Context())
+					if !ok {
+						t.Fatal("message context does not carry a transaction")
+					}
+					if _, err = tx.ExecContext(msg.Context(), `INSERT INTO processed (uuid) VALUES (?);`, msg.UUID); err != nil {
+						t.Fatal(err)
+					}
+					if !nacked {
+						nacked = msg.Nack() // rolls back the insert
+						continue
+					}
+					msg.Ack()
+					acked++
+				case <-time.After(time.Second * 3):
+					t.Fatal("message was not delivered")
+				}
+			}
+
+			inspector, err := NewInspector(db, InspectorOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(time.Second * 3)
+			for {
+				state, err := inspector.Inspect(ctx, topic)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(state.ConsumerGroups) == 1 && state.ConsumerGroups[0].OffsetAcked == 2 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("consumer group offset did not advance: %+v", state.ConsumerGroups)
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+
+			var processed int
+			if err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM processed;`).Scan(&processed); err != nil {
+				t.Fatal(err)
+			}
+			if processed != 2 {
+				t.Fatalf("expected each message to be processed once, got %d processed rows", processed)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestDeadLetter(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	newSubscriber := func(t *testing.T) message.Subscriber {
+		return newTestSubscriber(t, db, SubscriberOptions{
+			LockTimeout:         time.Second,
+			MaxDeliveryAttempts: 2,
+		})
+	}
+	receive := func(t *testing.T, messages <-chan *message.Message, expectedUUID string) *message.Message {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			if msg.UUID != expectedUUID {
+				t.Fatalf("expected message %q, got %q", expectedUUID, msg.UUID)
+			}
+			return msg
+		case <-time.After(time.Second * 3):
+			t.Fatalf("message %q was not delivered", expectedUUID)
+		}
+		return nil
+	}
+
+	t.Run("nacked message is dead-lettered", func(t *testing.T) {
+		topic := "TestDeadLetterNacked"
+		if err := pub.Publish(
+			topic,
+			message.NewMessage("poison", []byte("poison")),
+			message.NewMessage("healthy", []byte("healthy")),
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		sub := newSubscriber(t)
+		messages, err := sub.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, messages, "poison").Nack()
+		receive(t, messages, "poison").Nack()
+		receive(t, messages, "healthy").Ack()
+
+		deadLetters, err := sub.Subscribe(ctx, DefaultDeadLetterTopic(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := receive(t, deadLetters, "poison")
+		msg.Ack()
+		if reason := msg.Metadata.Get(MetadataKeyDeadLetterReason); reason != deadLetterReasonNacked {
+			t.Errorf("unexpected dead-letter reason: %q", reason)
+		}
+		if attempts := msg.Metadata.Get(MetadataKeyDeadLetterAttempts); attempts != "2" {
+			t.Errorf("unexpected dead-letter attempts: %q", attempts)
+		}
+		if original := msg.Metadata.Get(MetadataKeyDeadLetterTopic); original != topic {
+			t.Errorf("unexpected dead-letter topic: %q", original)
+		}
+	})
+
+	t.Run("attempts persist between subscriptions", func(t *testing.T) {
+		topic := "TestDeadLetterPersistedAttempts"
+		if err := pub.Publish(
+			topic,
+			message.NewMessage("poison", []byte("poison")),
+			message.NewMessage("healthy", []byte("healthy")),
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		crashingCtx, crash := context.WithCancel(ctx)
+		first := newSubscriber(t)
+		messages, err := first.Subscribe(crashingCtx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, messages, "poison").Nack()
+		receive(t, messages, "poison") // never acknowledged
+		tng := TableNameGenerators{}.WithDefaultGeneratorsInsteadOfNils()
+		var attempts int
+		if err = db.QueryRowContext(ctx, `SELECT attempts FROM '`+tng.Deliveries(topic)+`' WHERE "offset"=1`).Scan(&attempts); err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 2 {
+			t.Fatalf("expected the attempt to be counted before delivery, got %d attempts", attempts)
+		}
+		crash()
+
+		second := newSubscriber(t)
+		messages, err = second.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, messages, "healthy").Ack()
+
+		deadLetters, err := second.Subscribe(ctx, DefaultDeadLetterTopic(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := receive(t, deadLetters, "poison")
+		msg.Ack()
+		if reason := msg.Metadata.Get(MetadataKeyDeadLetterReason); reason != deadLetterReasonExhausted {
+			t.Errorf("unexpected dead-letter reason: %q", reason)
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package wmsqlitemodernc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// MetadataKeyDeliverAt is the reserved metadata key that holds the time in [time.RFC3339Nano] format,
+// before which the message remains invisible to [SubscriberOptions] DelayedDelivery consumer groups.
+const MetadataKeyDeliverAt = "sqlite_deliver_at"
+
+// PublishAt publishes messages that become visible to [SubscriberOptions] DelayedDelivery
+// consumer groups at the given time. Consumer groups without delayed delivery
+// receive the messages immediately. Publishes copies of the messages, so
+// the [MetadataKeyDeliverAt] metadata is never set on the given messages.
+func PublishAt(publisher message.Publisher, topic string, deliverAt time.Time, messages ...*message.Message) error {
+	value := deliverAt.UTC().Format(time.RFC3339Nano)
+	delayed := make([]*message.Message, len(messages))
+	for i, msg := range messages {
+		delayed[i] = msg.Copy()
+		delayed[i].SetContext(msg.Context())
+		delayed[i].Metadata.Set(MetadataKeyDeliverAt, value)
+	}
+	return publisher.Publish(topic, delayed...)
+}
+
+// parseDeliverAt returns the delivery time of a message in Unix milliseconds
+// or zero if the message should be delivered immediately.
+func parseDeliverAt(msg *message.Message) (int64, error) {
+	value := msg.Metadata.Get(MetadataKeyDeliverAt)
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse message %q delivery time: %w", msg.UUID, err)
+	}
+	return t.UnixMilli(), nil
+}
@@ -0,0 +1,130 @@
+package wmsqlitemodernc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestDelayedDelivery(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestDelayedDelivery"
+	delay := time.Millisecond * 500
+	delayed := message.NewMessage("delayed", []byte("delayed"))
+	if err := PublishAt(pub, topic, time.Now().Add(delay), delayed); err != nil {
+		t.Fatal(err)
+	}
+	if deliverAt := delayed.Metadata.Get(MetadataKeyDeliverAt); deliverAt != "" {
+		t.Fatalf("published message metadata was changed: %q", deliverAt)
+	}
+	immediate := message.NewMessage("immediate", []byte("immediate"))
+	immediate.Metadata.Set("deliver_at", "not a time") // application metadata of the same name is left alone
+	if err := pub.Publish(topic, immediate); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(t *testing.T, messages <-chan *message.Message, expectedUUID string, timeout time.Duration) {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			msg.Ack()
+			if msg.UUID != expectedUUID {
+				t.Fatalf("expected message %q, got %q", expectedUUID, msg.UUID)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("message %q was not delivered", expectedUUID)
+		}
+	}
+
+	t.Run("delayed delivery consumer group", func(t *testing.T) {
+		sub := newTestSubscriber(t, db, SubscriberOptions{
+			ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("delayed"),
+			DelayedDelivery:      true,
+		})
+		started := time.Now()
+		messages, err := sub.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, messages, "immediate", delay/2)
+		receive(t, messages, "delayed", delay*4)
+		if time.Since(started) < delay/2 {
+			t.Fatal("delayed message was delivered too early")
+		}
+
+		select {
+		case msg := <-messages:
+			t.Fatalf("message %q was delivered twice", msg.UUID)
+		case <-time.After(delay):
+		}
+		var acked int64
+		if err = db.QueryRowContext(ctx, `SELECT offset_acked FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='delayed'`).Scan(&acked); err != nil {
+			t.Fatal(err)
+		}
+		if acked != 2 {
+			t.Fatalf("expected consumer group offset to advance to 2, got %d", acked)
+		}
+	})
+
+	t.Run("consumer group without delayed delivery", func(t *testing.T) {
+		sub := newTestSubscriber(t, db, SubscriberOptions{
+			ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("immediate"),
+		})
+		messages, err := sub.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, messages, "delayed", time.Second)
+		receive(t, messages, "immediate", time.Second)
+	})
+}
+
+func TestDelayedDeliveryUpgradesOlderTables(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	topic := "TestDelayedDeliveryUpgradesOlderTables"
+	for _, query := range []string{
+		// schema before delayed delivery
+		`CREATE TABLE 'watermill_` + topic + `' (
+			'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uuid TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			metadata JSON NOT NULL
+		);`,
+		`CREATE TABLE 'watermill_deliveries_` + topic + `' (
+			consumer_group TEXT NOT NULL,
+			'offset' INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY(consumer_group, 'offset')
+		) WITHOUT ROWID;`,
+		`INSERT INTO 'watermill_` + topic + `' (uuid, created_at, payload, metadata) VALUES ('old', '', 'old', '{}');`,
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("delayed"),
+		DelayedDelivery:      true,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+		if msg.UUID != "old" {
+			t.Fatalf("expected message %q, got %q", "old", msg.UUID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message published before the upgrade was not delivered")
+	}
+}
@@ -27,6 +27,20 @@ const (
 	// ErrInvalidTopicName indicates that the topic name contains invalid characters.
 	// Valid characters match the following regular expression pattern: `[^A-Za-z0-9\-\$\:\.\_]`.
 	ErrInvalidTopicName
+
+	// ErrSchemaIsNewer indicates that a table schema was upgraded by a newer version of the library.
+	// Older versions refuse to use such tables, because they do not know about the changes.
+	// Upgrade the library before connecting to the database.
+	ErrSchemaIsNewer
+
+	// ErrSingleTableStorageIsNotSupported indicates that an operation addresses topics by their tables,
+	// while [SingleTableNameGenerators] store every topic in one table.
+	ErrSingleTableStorageIsNotSupported
+
+	// ErrSchemaIsOlder indicates that a table was created by an older version of the library
+	// and lacks columns that an operation needs. Run [Migrate] or use a publisher or
+	// a subscriber with the InitializeSchema option to upgrade the table.
+	ErrSchemaIsOlder
 )
 
 func (e Error) Error() string {
@@ -41,6 +55,12 @@ func (e Error) Error() string {
 		return "attempted table initialization with-in a transaction; either use a prior schema or do not combine a transaction with AutoInitializeSchema configuration option"
 	case ErrInvalidTopicName:
 		return "topic name must not contain characters matched by " + disallowedTopicCharacters.String()
+	case ErrSchemaIsNewer:
+		return "database schema is newer than supported by this library version; upgrade the library"
+	case ErrSingleTableStorageIsNotSupported:
+		return "operation does not support table name generators that store every topic in one table"
+	case ErrSchemaIsOlder:
+		return "database schema is older than required by this library version; migrate the database"
 	default:
 		return "unknown error"
 	}
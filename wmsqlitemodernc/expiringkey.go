@@ -20,6 +20,10 @@ type expiringKeyRepository struct {
 	Expiration  time.Duration
 }
 
+// DefaultExpiringKeyTableName is the name of the expiring key repository table
+// used when [ExpiringKeyRepositoryConfiguration] does not set one.
+const DefaultExpiringKeyTableName = "watermill_expiring_keys"
+
 // ExpiringKeyRepositoryConfiguration intializes the expiring key repository in [NewExpiringKeyRepository] constructor.
 type ExpiringKeyRepositoryConfiguration struct {
 	// Database is SQLite3 database handle.
@@ -54,7 +58,7 @@ func NewExpiringKeyRepository(ctx context.Context, config ExpiringKeyRepositoryC
 		return nil, ErrDatabaseConnectionIsNil
 	}
 	if config.TableName == "" {
-		config.TableName = "watermill_expiring_keys"
+		config.TableName = DefaultExpiringKeyTableName
 	} else if err = validateTopicName(config.TableName); err != nil {
 		return nil, fmt.Errorf("table name does not match topic name rules: %w", err)
 	}
@@ -77,6 +81,9 @@ func NewExpiringKeyRepository(ctx context.Context, config ExpiringKeyRepositoryC
 		nil); err != nil {
 		return nil, fmt.Errorf("untable to create %q SQLite table: %w", config.TableName, err)
 	}
+	if err = migrateTable(ctx, config.Database, schemaKindExpiringKeys, config.TableName); err != nil {
+		return nil, err
+	}
 
 	r := &expiringKeyRepository{
 		DB:         config.Database,
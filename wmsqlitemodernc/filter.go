@@ -0,0 +1,55 @@
+package wmsqlitemodernc
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MetadataFilter selects messages whose metadata holds every key with the given value.
+// The filter is a condition of the batch query, so messages that do not match are never read.
+// Skipped messages are acknowledged for the whole consumer group, so filtered subscribers
+// need a consumer group of their own.
+//
+// Filters do not match metadata encrypted by a [KeyProvider].
+type MetadataFilter map[string]string
+
+// Validate checks that keys contain only characters permitted in topic names
+// and that values contain no NUL characters, so that the filter
+// can be rendered into a query without changing its structure.
+func (f MetadataFilter) Validate() error {
+	for key, value := range f {
+		if key == "" || disallowedTopicCharacters.MatchString(key) {
+			return fmt.Errorf("metadata filter key %q must not be empty or contain characters matched by %s", key, disallowedTopicCharacters.String())
+		}
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("metadata filter value of key %q must not contain NUL characters", key)
+		}
+	}
+	return nil
+}
+
+// Condition renders a validated filter as an SQL expression over the JSON metadata column.
+// Values are rendered as quoted SQL string literals. Returns an empty string for an empty filter.
+func (f MetadataFilter) Condition(column string) string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // stable query text for statement caches
+
+	b := strings.Builder{}
+	for i, key := range keys {
+		if i > 0 {
+			_, _ = b.WriteString(" AND ")
+		}
+		_, _ = b.WriteString(`json_extract(`)
+		_, _ = b.WriteString(column)
+		_, _ = b.WriteString(`, '$."`)
+		_, _ = b.WriteString(key)
+		_, _ = b.WriteString(`"')='`)
+		_, _ = b.WriteString(strings.ReplaceAll(f[key], `'`, `''`))
+		_, _ = b.WriteString(`'`)
+	}
+	return b.String()
+}
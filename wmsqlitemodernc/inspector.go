@@ -0,0 +1,138 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// InspectorOptions configure [NewInspector].
+type InspectorOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+}
+
+// TopicState is a snapshot of a topic and its consumer groups.
+type TopicState struct {
+	Topic string
+
+	// MaxOffset is the offset of the latest message retained in the topic table.
+	// Zero if the topic table is empty.
+	MaxOffset int64
+
+	// ConsumerGroups are ordered by name.
+	ConsumerGroups []ConsumerGroupState
+}
+
+// ConsumerGroupState is a snapshot of a consumer group row in the offsets table.
+type ConsumerGroupState struct {
+	Name        string
+	OffsetAcked int64
+
+	// LockedUntil is the expiration time of the consumer group lock.
+	// Zero time if the lock was released.
+	LockedUntil time.Time
+
+	// Locked is true while a subscription is holding the lock.
+	Locked bool
+
+	// Lag is the number of offsets between the acknowledged offset
+	// and the latest message in the topic table.
+	Lag int64
+}
+
+// Inspector reads the state of topics and consumer groups for health dashboards
+// and alerting. It never modifies the database.
+type Inspector struct {
+	db  SQLiteConnection
+	tng TableNameGenerators
+}
+
+// NewInspector creates an [Inspector].
+func NewInspector(db SQLiteConnection, options InspectorOptions) (*Inspector, error) {
+	if db == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return nil, ErrSingleTableStorageIsNotSupported
+	}
+	return &Inspector{
+		db:  db,
+		tng: tng,
+	}, nil
+}
+
+// Topics lists topics discovered by matching SQLite table names against table name generators.
+// Discovery only works for generators that prefix or suffix the topic name.
+func (i *Inspector) Topics(ctx context.Context) ([]string, error) {
+	return findTopics(ctx, i.db, i.tng)
+}
+
+// Inspect takes a snapshot of a topic and its consumer groups.
+func (i *Inspector) Inspect(ctx context.Context, topic string) (state TopicState, err error) {
+	if err = validateTopicName(topic); err != nil {
+		return state, err
+	}
+	state.Topic = topic
+	if err = i.db.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(MAX("offset"), 0) FROM '`+i.tng.Topic(topic)+`';`,
+	).Scan(&state.MaxOffset); err != nil {
+		return state, fmt.Errorf("unable to read topic %q offset: %w", topic, err)
+	}
+
+	offsetsTable := i.tng.Offsets(topic)
+	columns, err := tableColumns(ctx, i.db, offsetsTable)
+	if err != nil {
+		return state, err
+	}
+	expiry := `IIF(locked_until>0, locked_until*1000+999, 0)` // table was not migrated yet
+	if _, ok := columns["locked_until_ms"]; ok {
+		expiry = lockedUntil("locked_until")
+	}
+	rows, err := i.db.QueryContext(
+		ctx,
+		`SELECT consumer_group, offset_acked, `+expiry+`, `+expiry+`>=CAST(unixepoch('subsec')*1000 AS INTEGER) FROM '`+offsetsTable+`' ORDER BY consumer_group;`,
+	)
+	if err != nil {
+		return state, fmt.Errorf("unable to read topic %q consumer groups: %w", topic, err)
+	}
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+
+	var expiresAt int64
+	for rows.Next() {
+		group := ConsumerGroupState{}
+		if err = rows.Scan(&group.Name, &group.OffsetAcked, &expiresAt, &group.Locked); err != nil {
+			return state, err
+		}
+		if expiresAt > 0 {
+			group.LockedUntil = time.UnixMilli(expiresAt)
+		}
+		group.Lag = max(state.MaxOffset-group.OffsetAcked, 0)
+		state.ConsumerGroups = append(state.ConsumerGroups, group)
+	}
+	return state, rows.Err()
+}
+
+// InspectAll takes a snapshot of every topic listed by [Inspector.Topics].
+func (i *Inspector) InspectAll(ctx context.Context) (states []TopicState, err error) {
+	topics, err := i.Topics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states = make([]TopicState, 0, len(topics))
+	for _, topic := range topics {
+		state, err := i.Inspect(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
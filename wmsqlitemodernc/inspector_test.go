@@ -0,0 +1,72 @@
+package wmsqlitemodernc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestInspector(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestInspector"
+	if err := pub.Publish(
+		topic,
+		message.NewMessage("1", []byte{}),
+		message.NewMessage("2", []byte{}),
+		message.NewMessage("3", []byte{}),
+	); err != nil {
+		t.Fatal(err)
+	}
+	for group, position := range map[string]Position{
+		"behind":   PositionAtOffset(2),
+		"caughtUp": PositionLatest(),
+	} {
+		if _, err := Seek(ctx, db, SeekOptions{
+			Topic:         topic,
+			ConsumerGroup: group,
+			Position:      position,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE 'watermill_offsets_`+topic+`' SET locked_until=unixepoch()+60 WHERE consumer_group='behind';`); err != nil {
+		t.Fatal(err)
+	}
+
+	inspector, err := NewInspector(db, InspectorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := inspector.InspectAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Topic != topic {
+		t.Fatalf("expected one topic %q, got %+v", topic, states)
+	}
+	state := states[0]
+	if state.MaxOffset != 3 {
+		t.Fatalf("expected max offset 3, got %d", state.MaxOffset)
+	}
+	if len(state.ConsumerGroups) != 2 {
+		t.Fatalf("expected two consumer groups, got %+v", state.ConsumerGroups)
+	}
+
+	behind, caughtUp := state.ConsumerGroups[0], state.ConsumerGroups[1]
+	if behind.Name != "behind" || behind.OffsetAcked != 1 || behind.Lag != 2 {
+		t.Fatalf("unexpected consumer group state: %+v", behind)
+	}
+	if !behind.Locked || time.Until(behind.LockedUntil) < time.Second*50 {
+		t.Fatalf("consumer group must be locked: %+v", behind)
+	}
+	if caughtUp.Name != "caughtUp" || caughtUp.OffsetAcked != 3 || caughtUp.Lag != 0 {
+		t.Fatalf("unexpected consumer group state: %+v", caughtUp)
+	}
+	if caughtUp.Locked || !caughtUp.LockedUntil.IsZero() {
+		t.Fatalf("consumer group must not be locked: %+v", caughtUp)
+	}
+}
@@ -0,0 +1,115 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestMessageLeases(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	newSubscriber := func(t *testing.T) message.Subscriber {
+		return newTestSubscriber(t, db, SubscriberOptions{
+			BatchSize:     1,
+			LockTimeout:   time.Second,
+			MessageLeases: true,
+		})
+	}
+	receive := func(t *testing.T, messages <-chan *message.Message) *message.Message {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(time.Second * 3):
+			t.Fatal("message was not delivered")
+		}
+		return nil
+	}
+	offsetAcked := func(t *testing.T, topic string) (offset int64) {
+		t.Helper()
+		if err := db.QueryRowContext(ctx, `SELECT offset_acked FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='default'`).Scan(&offset); err != nil {
+			t.Fatal(err)
+		}
+		return offset
+	}
+
+	t.Run("subscribers process messages in parallel", func(t *testing.T) {
+		topic := "TestMessageLeasesParallel"
+		if err := pub.Publish(
+			topic,
+			message.NewMessage("1", []byte("1")),
+			message.NewMessage("2", []byte("2")),
+			message.NewMessage("3", []byte("3")),
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := newSubscriber(t).Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held := receive(t, first)
+		if held.UUID != "1" {
+			t.Fatalf("expected message %q, got %q", "1", held.UUID)
+		}
+
+		second, err := newSubscriber(t).Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := receive(t, second) // while the first message is leased
+		if msg.UUID != "2" {
+			t.Fatalf("expected message %q, got %q", "2", msg.UUID)
+		}
+		msg.Ack()
+		msg = receive(t, second)
+		if msg.UUID != "3" {
+			t.Fatalf("expected message %q, got %q", "3", msg.UUID)
+		}
+		msg.Ack()
+
+		time.Sleep(time.Millisecond * 200)
+		if offset := offsetAcked(t, topic); offset != 0 {
+			t.Fatalf("consumer group offset advanced past a leased message to %d", offset)
+		}
+		held.Ack()
+
+		deadline := time.Now().Add(time.Second * 3)
+		for offsetAcked(t, topic) != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected consumer group offset to advance to 3, got %d", offsetAcked(t, topic))
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	})
+
+	t.Run("expired lease is redelivered", func(t *testing.T) {
+		topic := "TestMessageLeasesExpired"
+		if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+			t.Fatal(err)
+		}
+
+		crashingCtx, crash := context.WithCancel(ctx)
+		first, err := newSubscriber(t).Subscribe(crashingCtx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, first) // never acknowledged
+		crash()
+
+		second, err := newSubscriber(t).Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := receive(t, second)
+		if msg.UUID != "1" {
+			t.Fatalf("expected message %q, got %q", "1", msg.UUID)
+		}
+		msg.Ack()
+	})
+}
@@ -0,0 +1,52 @@
+package wmsqlitemodernc
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// MetadataKeyOffset is the reserved metadata key that holds the offset of a delivered message
+	// in its topic table. Offsets grow with every published message, so handlers can use them
+	// for idempotency checks. Subscribers overwrite the value on every delivery.
+	MetadataKeyOffset = "sqlite_offset"
+
+	// MetadataKeyPublishedAt is the reserved metadata key that holds the time in [time.RFC3339Nano] format
+	// when a delivered message was inserted into its topic table. Subscribers overwrite the value on every delivery.
+	MetadataKeyPublishedAt = "sqlite_published_at"
+)
+
+// createdAtLayout keeps the fractional seconds of the created_at column at a fixed width,
+// so that time stamps in UTC sort as text in the order of publishing.
+const createdAtLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Offset returns the offset of a delivered message in its topic table.
+// Returns false if the message was not delivered by a subscriber.
+func Offset(msg *message.Message) (int64, bool) {
+	offset, err := strconv.ParseInt(msg.Metadata.Get(MetadataKeyOffset), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return offset, true
+}
+
+// PublishedAt returns the time when a delivered message was inserted into its topic table.
+// Returns false if the message was not delivered by a subscriber.
+func PublishedAt(msg *message.Message) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(MetadataKeyPublishedAt))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// setDeliveryMetadata records storage details of a message for [Offset] and [PublishedAt].
+func setDeliveryMetadata(msg *message.Message, next rawMessage) {
+	if msg.Metadata == nil {
+		msg.Metadata = make(message.Metadata)
+	}
+	msg.Metadata.Set(MetadataKeyOffset, strconv.FormatInt(next.Offset, 10))
+	msg.Metadata.Set(MetadataKeyPublishedAt, next.CreatedAt)
+}
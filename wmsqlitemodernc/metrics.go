@@ -0,0 +1,232 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meterName is the instrumentation scope of publisher and subscriber meters.
+const meterName = "github.com/dkotik/watermillsqlite/wmsqlitemodernc"
+
+const (
+	lockAcquired = "acquired"
+	lockBusy     = "busy"
+	lockFailed   = "failed"
+)
+
+var (
+	attributeTopic         = attribute.Key("messaging.destination.name")
+	attributeConsumerGroup = attribute.Key("messaging.consumer.group.name")
+	attributeLockResult    = attribute.Key("result")
+)
+
+// publisherMetrics are nil, unless PublisherOptions set a MeterProvider.
+type publisherMetrics struct {
+	messages   metric.Int64Counter
+	duplicates metric.Int64Counter
+	bytes      metric.Int64Counter
+	duration   metric.Float64Histogram
+}
+
+func newPublisherMetrics(provider metric.MeterProvider) (m *publisherMetrics, err error) {
+	if provider == nil {
+		return nil, nil
+	}
+	meter := provider.Meter(meterName)
+	m = &publisherMetrics{}
+	if m.messages, err = meter.Int64Counter(
+		"watermill.sqlite.published.messages",
+		metric.WithDescription("Number of messages inserted into topic tables."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.duplicates, err = meter.Int64Counter(
+		"watermill.sqlite.published.duplicates",
+		metric.WithDescription("Number of messages skipped, because their UUIDs were already published to topic tables."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.bytes, err = meter.Int64Counter(
+		"watermill.sqlite.published.bytes",
+		metric.WithDescription("Size of published message payloads, including skipped duplicates."),
+		metric.WithUnit("By"),
+	); err != nil {
+		return nil, err
+	}
+	if m.duration, err = meter.Float64Histogram(
+		"watermill.sqlite.publish.duration",
+		metric.WithDescription("Time spent inserting a set of messages into a topic table."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Published records messages published to a topic table since the start time.
+// Messages that were not inserted are counted as skipped duplicates.
+func (m *publisherMetrics) Published(ctx context.Context, topic string, messages message.Messages, inserted int64, start time.Time) {
+	if m == nil {
+		return
+	}
+	attributes := metric.WithAttributes(attributeTopic.String(topic))
+	var size int64
+	for _, msg := range messages {
+		size += int64(len(msg.Payload))
+	}
+	m.messages.Add(ctx, inserted, attributes)
+	if skipped := int64(len(messages)) - inserted; skipped > 0 {
+		m.duplicates.Add(ctx, skipped, attributes)
+	}
+	m.bytes.Add(ctx, size, attributes)
+	m.duration.Record(ctx, time.Since(start).Seconds(), attributes)
+}
+
+// subscriberMetrics are nil, unless SubscriberOptions set a MeterProvider.
+type subscriberMetrics struct {
+	batchSize              metric.Int64Histogram
+	lockAcquisitions       metric.Int64Counter
+	lockExtensions         metric.Int64Counter
+	locksLost              metric.Int64Counter
+	acks                   metric.Int64Counter
+	nacks                  metric.Int64Counter
+	ackDeadlineExpirations metric.Int64Counter
+	lag                    metric.Int64Gauge
+}
+
+func newSubscriberMetrics(provider metric.MeterProvider) (m *subscriberMetrics, err error) {
+	if provider == nil {
+		return nil, nil
+	}
+	meter := provider.Meter(meterName)
+	m = &subscriberMetrics{}
+	if m.batchSize, err = meter.Int64Histogram(
+		"watermill.sqlite.batch.size",
+		metric.WithDescription("Number of messages selected in a batch."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.lockAcquisitions, err = meter.Int64Counter(
+		"watermill.sqlite.lock.acquisitions",
+		metric.WithDescription("Attempts to lock a consumer group by result: acquired, busy, or failed."),
+		metric.WithUnit("{attempt}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.lockExtensions, err = meter.Int64Counter(
+		"watermill.sqlite.lock.extensions",
+		metric.WithDescription("Number of consumer group lock or message lease extensions."),
+		metric.WithUnit("{extension}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.locksLost, err = meter.Int64Counter(
+		"watermill.sqlite.lock.lost",
+		metric.WithDescription("Number of consumer group locks taken over by another subscription before they were extended."),
+		metric.WithUnit("{lock}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.acks, err = meter.Int64Counter(
+		"watermill.sqlite.acks",
+		metric.WithDescription("Number of acknowledged messages."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.nacks, err = meter.Int64Counter(
+		"watermill.sqlite.nacks",
+		metric.WithDescription("Number of negatively acknowledged messages."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.ackDeadlineExpirations, err = meter.Int64Counter(
+		"watermill.sqlite.ack_deadline.expirations",
+		metric.WithDescription("Number of messages that were not acknowledged before AckDeadline."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.lag, err = meter.Int64Gauge(
+		"watermill.sqlite.consumer.lag",
+		metric.WithDescription("Number of offsets between the latest message and the acknowledged offset of a consumer group."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Subscription binds the metrics to a topic and a consumer group.
+func (m *subscriberMetrics) Subscription(topic, consumerGroup string) *subscriptionMetrics {
+	if m == nil {
+		return nil
+	}
+	set := attribute.NewSet(attributeTopic.String(topic), attributeConsumerGroup.String(consumerGroup))
+	return &subscriptionMetrics{
+		subscriberMetrics: m,
+		set:               set,
+		attributes:        metric.WithAttributeSet(set),
+	}
+}
+
+// subscriptionMetrics are nil, unless SubscriberOptions set a MeterProvider.
+// Methods of a nil value do nothing.
+type subscriptionMetrics struct {
+	*subscriberMetrics
+	set        attribute.Set
+	attributes metric.MeasurementOption
+}
+
+func (m *subscriptionMetrics) LockAcquisition(ctx context.Context, result string) {
+	if m != nil {
+		m.lockAcquisitions.Add(ctx, 1, metric.WithAttributeSet(attribute.NewSet(
+			append(m.set.ToSlice(), attributeLockResult.String(result))...,
+		)))
+	}
+}
+
+func (m *subscriptionMetrics) Batch(ctx context.Context, size int, lag int64) {
+	if m != nil {
+		m.batchSize.Record(ctx, int64(size), m.attributes)
+		m.lag.Record(ctx, lag, m.attributes)
+	}
+}
+
+func (m *subscriptionMetrics) LockExtended(ctx context.Context) {
+	if m != nil {
+		m.lockExtensions.Add(ctx, 1, m.attributes)
+	}
+}
+
+func (m *subscriptionMetrics) LockLost(ctx context.Context) {
+	if m != nil {
+		m.locksLost.Add(ctx, 1, m.attributes)
+	}
+}
+
+func (m *subscriptionMetrics) Acked(ctx context.Context) {
+	if m != nil {
+		m.acks.Add(ctx, 1, m.attributes)
+	}
+}
+
+func (m *subscriptionMetrics) Nacked(ctx context.Context) {
+	if m != nil {
+		m.nacks.Add(ctx, 1, m.attributes)
+	}
+}
+
+func (m *subscriptionMetrics) AckDeadlineExpired(ctx context.Context) {
+	if m != nil {
+		m.ackDeadlineExpirations.Add(ctx, 1, m.attributes)
+	}
+}
@@ -0,0 +1,281 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SchemaVersionsTableName is the name of the table that records schema versions
+// of topic, offsets, deliveries, and expiring key tables.
+const SchemaVersionsTableName = "watermill_schema_versions"
+
+const (
+	schemaKindTopic        = "topic"
+	schemaKindOffsets      = "offsets"
+	schemaKindDeliveries   = "deliveries"
+	schemaKindExpiringKeys = "expiring_keys"
+)
+
+// migration upgrades a table to a schema version by adding the missing columns.
+type migration struct {
+	Version int
+	Columns []string // column definitions for ALTER TABLE ADD COLUMN statements
+	Updates []string // statements that fill the added columns, with %s in place of the table name
+}
+
+// schemaMigrations list upgrades of each table kind in ascending version order.
+// Version 1 is the schema of the first release. Append a migration for any column change,
+// and update the matching CREATE TABLE statement, so that new tables start at the latest version.
+var schemaMigrations = map[string][]migration{
+	schemaKindTopic: {
+		{Version: 2, Columns: []string{"deliver_at INTEGER NOT NULL DEFAULT 0"}},
+	},
+	schemaKindOffsets: {
+		{
+			Version: 2,
+			Columns: []string{"locked_until_ms INTEGER NOT NULL DEFAULT 0"},
+			// locks taken by older versions are held until the end of their last second
+			Updates: []string{`UPDATE '%s' SET locked_until_ms=locked_until*1000+999 WHERE locked_until>0 AND locked_until_ms=0;`},
+		},
+	},
+	schemaKindDeliveries: {
+		{Version: 2, Columns: []string{"acked INTEGER NOT NULL DEFAULT 0"}},
+		{Version: 3, Columns: []string{
+			"leased_until INTEGER NOT NULL DEFAULT 0",
+			"lease_owner TEXT NOT NULL DEFAULT ''",
+		}},
+		{
+			Version: 4,
+			Columns: []string{"leased_until_ms INTEGER NOT NULL DEFAULT 0"},
+			Updates: []string{`UPDATE '%s' SET leased_until_ms=leased_until*1000+999 WHERE leased_until>0 AND leased_until_ms=0;`},
+		},
+	},
+	schemaKindExpiringKeys: nil,
+}
+
+// latestSchemaVersion returns the schema version of a table kind supported by this library.
+func latestSchemaVersion(kind string) int {
+	migrations := schemaMigrations[kind]
+	if len(migrations) == 0 {
+		return 1
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// schemaMigrator is satisfied by adapters, including the ones that embed them,
+// whose tables are upgraded in place by the migration runner.
+type schemaMigrator interface {
+	migratesSchema()
+}
+
+func (a DefaultSchemaAdapter) migratesSchema()  {}
+func (a DefaultOffsetsAdapter) migratesSchema() {}
+
+// MigrateOptions configure [Migrate].
+type MigrateOptions struct {
+	// TableNameGenerators locate topic, offsets, and deliveries tables.
+	// Default value is [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// ExpiringKeyTables lists tables of expiring key repositories.
+	// Tables that do not exist are skipped.
+	// Default value contains [DefaultExpiringKeyTableName].
+	ExpiringKeyTables []string
+}
+
+// Migrate upgrades tables of every topic and expiring key repository in place
+// and records their versions in [SchemaVersionsTableName] table. Publishers and subscribers
+// with InitializeSchema option migrate the tables they use automatically.
+//
+// Returns [ErrSchemaIsNewer] if any table was upgraded by a newer version of the library.
+func Migrate(ctx context.Context, db SQLiteConnection, options MigrateOptions) (err error) {
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return ErrSingleTableStorageIsNotSupported
+	}
+	if len(options.ExpiringKeyTables) == 0 {
+		options.ExpiringKeyTables = []string{DefaultExpiringKeyTableName}
+	}
+
+	topics, err := findTopics(ctx, db, tng)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err = migrateTable(ctx, db, schemaKindTopic, tng.Topic(topic)); err != nil {
+			return err
+		}
+		if err = migrateTable(ctx, db, schemaKindOffsets, tng.Offsets(topic)); err != nil {
+			return err
+		}
+		if err = migrateTableIfPresent(ctx, db, schemaKindDeliveries, tng.Deliveries(topic)); err != nil {
+			return err
+		}
+	}
+	for _, table := range options.ExpiringKeyTables {
+		if err = migrateTableIfPresent(ctx, db, schemaKindExpiringKeys, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateTableIfPresent(ctx context.Context, db SQLiteConnection, kind, table string) error {
+	var present bool
+	if err := db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type='table' AND name=?)`,
+		table,
+	).Scan(&present); err != nil {
+		return fmt.Errorf("unable to look up table %q: %w", table, err)
+	}
+	if !present {
+		return nil
+	}
+	return migrateTable(ctx, db, kind, table)
+}
+
+// migrateTable adds columns missing from a table and records its latest schema version.
+// A table without a recorded version was created either by the first release or with the latest schema,
+// so the columns are compared against every migration.
+func migrateTable(ctx context.Context, db SQLiteConnection, kind, table string) (err error) {
+	if _, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS '`+SchemaVersionsTableName+`' (
+		table_name TEXT NOT NULL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		migrated_at TEXT NOT NULL
+	);`); err != nil {
+		return fmt.Errorf("unable to create schema versions table: %w", err)
+	}
+
+	latest := latestSchemaVersion(kind)
+	version := 1
+	err = db.QueryRowContext(
+		ctx,
+		`SELECT version FROM '`+SchemaVersionsTableName+`' WHERE table_name=?`,
+		table,
+	).Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("unable to read table %q schema version: %w", table, err)
+	case version > latest:
+		return fmt.Errorf("table %q schema version %d is newer than supported version %d: %w", table, version, latest, ErrSchemaIsNewer)
+	case version == latest:
+		return nil
+	}
+
+	columns, err := tableColumns(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	for _, m := range schemaMigrations[kind] {
+		if m.Version <= version {
+			continue
+		}
+		for _, definition := range m.Columns {
+			if _, ok := columns[strings.Fields(definition)[0]]; ok {
+				continue
+			}
+			if _, err = db.ExecContext(ctx, `ALTER TABLE '`+table+`' ADD COLUMN `+definition+`;`); err != nil {
+				if strings.Contains(err.Error(), "duplicate column name") {
+					continue // added by a concurrent migration
+				}
+				return fmt.Errorf("unable to migrate table %q to schema version %d: %w", table, m.Version, err)
+			}
+		}
+		for _, update := range m.Updates {
+			if _, err = db.ExecContext(ctx, fmt.Sprintf(update, table)); err != nil {
+				return fmt.Errorf("unable to migrate table %q to schema version %d: %w", table, m.Version, err)
+			}
+		}
+	}
+
+	if _, err = db.ExecContext(ctx, `
+		INSERT INTO '`+SchemaVersionsTableName+`' (table_name, kind, version, migrated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(table_name) DO UPDATE SET version=excluded.version, migrated_at=excluded.migrated_at;
+	`, table, kind, latest, time.Now().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to record table %q schema version: %w", table, err)
+	}
+	return nil
+}
+
+func tableColumns(ctx context.Context, db SQLiteConnection, table string) (columns map[string]struct{}, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read table %q columns: %w", table, err)
+	}
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+
+	columns = make(map[string]struct{})
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = struct{}{}
+	}
+	return columns, rows.Err()
+}
+
+// checkSchemaIsMigrated returns [ErrSchemaIsOlder] if a table lacks columns
+// added by the migrations of its kind. A missing table is left to the caller.
+func checkSchemaIsMigrated(ctx context.Context, db SQLiteConnection, kind, table string) error {
+	columns, err := tableColumns(ctx, db, table)
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	for _, m := range schemaMigrations[kind] {
+		for _, definition := range m.Columns {
+			if name := strings.Fields(definition)[0]; !hasColumn(columns, name) {
+				return fmt.Errorf("table %q lacks column %q of schema version %d: %w", table, name, m.Version, ErrSchemaIsOlder)
+			}
+		}
+	}
+	return nil
+}
+
+func hasColumn(columns map[string]struct{}, name string) bool {
+	_, ok := columns[name]
+	return ok
+}
+
+// checkSchemaVersions returns [ErrSchemaIsNewer] if any of the tables,
+// mapped to their kinds, was upgraded by a newer version of the library.
+func checkSchemaVersions(ctx context.Context, db SQLiteConnection, tables map[string]string) (err error) {
+	var present bool
+	if err = db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type='table' AND name='`+SchemaVersionsTableName+`')`,
+	).Scan(&present); err != nil {
+		return fmt.Errorf("unable to look up schema versions table: %w", err)
+	}
+	if !present {
+		return nil
+	}
+
+	for table, kind := range tables {
+		var version int
+		err = db.QueryRowContext(
+			ctx,
+			`SELECT version FROM '`+SchemaVersionsTableName+`' WHERE table_name=?`,
+			table,
+		).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read table %q schema version: %w", table, err)
+		}
+		if latest := latestSchemaVersion(kind); version > latest {
+			return fmt.Errorf("table %q schema version %d is newer than supported version %d: %w", table, version, latest, ErrSchemaIsNewer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package wmsqlitemodernc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	topic := "TestMigrate"
+	for _, query := range []string{
+		// schema of the first release
+		`CREATE TABLE 'watermill_` + topic + `' (
+			'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uuid TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			metadata JSON NOT NULL
+		);`,
+		`CREATE TABLE 'watermill_offsets_` + topic + `' (
+			consumer_group TEXT NOT NULL,
+			offset_acked INTEGER NOT NULL,
+			locked_until INTEGER NOT NULL,
+			PRIMARY KEY(consumer_group)
+		);`,
+		`CREATE TABLE 'watermill_deliveries_` + topic + `' (
+			consumer_group TEXT NOT NULL,
+			'offset' INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY(consumer_group, 'offset')
+		) WITHOUT ROWID;`,
+		`INSERT INTO 'watermill_` + topic + `' (uuid, created_at, payload, metadata) VALUES ('1', '', '1', '{}');`,
+		`INSERT INTO 'watermill_offsets_` + topic + `' (consumer_group, offset_acked, locked_until) VALUES ('held', 0, unixepoch()+60);`,
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for table, column := range map[string]string{
+		"watermill_" + topic:            "deliver_at",
+		"watermill_offsets_" + topic:    "locked_until_ms",
+		"watermill_deliveries_" + topic: "leased_until_ms",
+	} {
+		var present bool
+		if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name=?)`, table, column).Scan(&present); err != nil {
+			t.Fatal(err)
+		}
+		if !present {
+			t.Fatalf("column %q was not added to table %q", column, table)
+		}
+	}
+
+	var held bool
+	if err := db.QueryRowContext(ctx, `SELECT locked_until_ms>=unixepoch()*1000 FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='held'`).Scan(&held); err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Fatal("consumer group lock taken before the migration was lost")
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT version FROM '`+SchemaVersionsTableName+`' WHERE table_name=?`, "watermill_deliveries_"+topic).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != latestSchemaVersion(schemaKindDeliveries) {
+		t.Fatalf("expected deliveries table schema version %d, got %d", latestSchemaVersion(schemaKindDeliveries), version)
+	}
+	if err := Migrate(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal("repeated migration must be a no-op:", err)
+	}
+}
+
+func TestSchemaIsNewer(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	sub := newTestSubscriber(t, db, SubscriberOptions{})
+
+	topic := "TestSchemaIsNewer"
+	if _, err := sub.Subscribe(ctx, topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE '`+SchemaVersionsTableName+`' SET version=version+1 WHERE table_name=?`, "watermill_"+topic); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db, MigrateOptions{}); !errors.Is(err, ErrSchemaIsNewer) {
+		t.Fatalf("expected migration error %q, got %v", ErrSchemaIsNewer, err)
+	}
+
+	older, err := NewSubscriber(db, SubscriberOptions{
+		PollInterval: time.Millisecond * 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := older.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if _, err = older.Subscribe(ctx, topic); !errors.Is(err, ErrSchemaIsNewer) {
+		t.Fatalf("expected subscription error %q, got %v", ErrSchemaIsNewer, err)
+	}
+
+	for _, initializeSchema := range []bool{true, false} {
+		pub, err := NewPublisher(db, PublisherOptions{
+			InitializeSchema: initializeSchema,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = pub.Publish(topic, message.NewMessage("1", []byte("1"))); !errors.Is(err, ErrSchemaIsNewer) {
+			t.Fatalf("expected publishing error %q with schema initialization %t, got %v", ErrSchemaIsNewer, initializeSchema, err)
+		}
+	}
+}
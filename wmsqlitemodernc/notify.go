@@ -0,0 +1,124 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// published wakes up subscriptions whenever a publisher
+// within the same process inserts messages into a topic table.
+var published = &notifier{}
+
+// notifier wakes up subscriptions waiting for new messages without
+// waiting for the next poll interval tick. Listeners are keyed by topic table name.
+type notifier struct {
+	mu        sync.Mutex
+	listeners map[string]map[chan struct{}]struct{}
+}
+
+// Listen registers a wake channel. The channel must be buffered,
+// because notifications are dropped when the listener is busy.
+func (n *notifier) Listen(key string, wake chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners == nil {
+		n.listeners = make(map[string]map[chan struct{}]struct{})
+	}
+	if _, ok := n.listeners[key]; !ok {
+		n.listeners[key] = make(map[chan struct{}]struct{})
+	}
+	n.listeners[key][wake] = struct{}{}
+}
+
+// Forget removes a wake channel registered by [notifier.Listen].
+func (n *notifier) Forget(key string, wake chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.listeners[key], wake)
+	if len(n.listeners[key]) == 0 {
+		delete(n.listeners, key)
+	}
+}
+
+// Notify wakes up listeners of a given key.
+func (n *notifier) Notify(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for wake := range n.listeners[key] {
+		select {
+		case wake <- struct{}{}:
+		default: // already awake
+		}
+	}
+}
+
+// watchDataVersion wakes up listeners of the notifier whenever another connection,
+// possibly from another process, inserts messages into their topic tables.
+// PRAGMA data_version only reads the database header, so it is much cheaper than polling
+// every topic for messages. Once it changes, the AUTOINCREMENT sequences tell which
+// topic tables received new messages. Sequences ignore lock and offset updates,
+// which would otherwise wake up every subscription after each processed batch.
+func watchDataVersion(ctx context.Context, conn *sql.Conn, interval time.Duration, n *notifier, logger watermill.LoggerAdapter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		version, current int64
+		sequences        = make(map[string]int64)
+		err              error
+	)
+	for {
+		if err = conn.QueryRowContext(ctx, `PRAGMA data_version;`).Scan(&current); err != nil {
+			if ctx.Err() == nil {
+				logger.Error("unable to read SQLite data version", err, nil)
+			}
+		} else if current != version {
+			if err = notifyChangedSequences(ctx, conn, sequences, n, version != 0); err != nil && ctx.Err() == nil {
+				logger.Error("unable to read SQLite table sequences", err, nil)
+			}
+			version = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func notifyChangedSequences(ctx context.Context, conn *sql.Conn, sequences map[string]int64, n *notifier, notify bool) (err error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name, seq FROM sqlite_sequence;`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil // no topic tables were created yet
+		}
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+
+	var (
+		name     string
+		sequence int64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&name, &sequence); err != nil {
+			return err
+		}
+		if sequences[name] != sequence {
+			sequences[name] = sequence
+			if notify {
+				n.Notify(name)
+			}
+		}
+	}
+	return rows.Err()
+}
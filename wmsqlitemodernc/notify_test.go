@@ -0,0 +1,105 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+)
+
+func TestPublishWakesSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	_, pub, sub := newTestPubSub(t, SubscriberOptions{
+		PollInterval: time.Hour,
+	})
+
+	topic := "TestPublishWakesSubscription"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("subscription was not woken up by the publisher")
+	}
+}
+
+func TestDataVersionWakesSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := "file:" + filepath.Join(t.TempDir(), uuid.New().String()+".sqlite3") + "?journal_mode=WAL&busy_timeout=5000"
+	db, err := sql.Open("sqlite", DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		PollInterval:        time.Hour,
+		DataVersionInterval: time.Millisecond * 20,
+	})
+
+	topic := "TestDataVersionWakesSubscription"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100) // let the watcher observe the initial data version
+
+	// insert the message through another database handle
+	// like another process would, bypassing the publisher notifications
+	other := newTestConnection(t, DSN)
+	if _, err = other.ExecContext(
+		ctx,
+		`INSERT INTO 'watermill_`+topic+`' (uuid, created_at, payload, metadata) VALUES (?, ?, ?, ?);`,
+		"1",
+		time.Now().Format(time.RFC3339),
+		[]byte("1"),
+		"{}",
+	); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("subscription was not woken up by the data version change")
+	}
+}
+
+func TestDataVersionRequiresDedicatedConnection(t *testing.T) {
+	db := newTestConnection(t, newTestDSN())
+	if _, err := NewSubscriber(db, SubscriberOptions{
+		DataVersionInterval: time.Millisecond * 20,
+	}); err == nil {
+		t.Fatal("subscriber accepted a database handle limited to one open connection")
+	}
+
+	db.SetMaxOpenConns(2)
+	for i := 0; i < 2; i++ { // exhaust the pool
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	if _, err := NewSubscriber(db, SubscriberOptions{
+		LockTimeout:         time.Millisecond * 50,
+		DataVersionInterval: time.Millisecond * 20,
+	}); err == nil {
+		t.Fatal("subscriber started without a connection for watching data version")
+	}
+}
@@ -2,29 +2,90 @@ package wmsqlitemodernc
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PublisherOptions configure message publishing behavior.
 type PublisherOptions struct {
 	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
 	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	// [SingleTableNameGenerators] keep every topic in shared tables, which does not support
+	// [Seek], [NewInspector], [CleanUpTopics], [ReEncryptTopics], [Migrate], or topic patterns.
 	TableNameGenerators TableNameGenerators
 
+	// SchemaAdapter produces queries that create topic tables and insert messages.
+	// Subscribers must use a compatible adapter.
+	// Default value is [DefaultSchemaAdapter].
+	SchemaAdapter SchemaAdapter
+
+	// OffsetsAdapter produces queries that create offsets tables.
+	// Subscribers must use a compatible adapter.
+	// Default value is [DefaultOffsetsAdapter].
+	OffsetsAdapter OffsetsAdapter
+
 	// InitializeSchema enables initialization of schema database during publish.
 	// Schema is initialized once per topic per publisher instance.
 	// InitializeSchema is forbidden if using an ongoing transaction as database handle.
 	// It could result in an implicit commit of the transaction by a CREATE TABLE statement.
 	InitializeSchema bool
 
+	// IgnoreDuplicateUUIDs keeps a unique index on message UUIDs in topic tables,
+	// so that messages with UUIDs that were already published to the topic are silently skipped.
+	// Then, publishing retried after an ambiguous error does not store duplicates.
+	// The index is created by InitializeSchema, which also adds it to existing tables
+	// without duplicates. Publishing to a topic table without the index fails.
+	// The index slows down publishing, see the publishing benchmarks.
+	// Publisher metrics count skipped messages apart from inserted messages.
+	IgnoreDuplicateUUIDs bool
+
+	// MaxBatchSize limits the number of messages inserted by a single statement.
+	// Larger publishing is split into several statements within one transaction,
+	// so that each statement stays within SQLite bound parameter and query length limits.
+	// A statement must not bind more than 32766 parameters, the default SQLite limit,
+	// so [NewPublisher] rejects values above the limit divided by the number of parameters
+	// that the SchemaAdapter binds per message: 6553 for the five parameters of [DefaultSchemaAdapter]
+	// and 5461 for the six parameters of [SingleTableSchemaAdapter].
+	// Default value is 1000, or fewer messages if the adapter binds more than 32 parameters per message.
+	MaxBatchSize int
+
+	// PayloadCodec compresses payloads of at least PayloadCodecThreshold bytes.
+	// The codec name is stored in the [MetadataKeyPayloadCodec] metadata value,
+	// so that subscribers decode only compressed payloads.
+	// Nil value inserts payloads as they are.
+	PayloadCodec PayloadCodec
+
+	// PayloadCodecThreshold is the smallest payload size in bytes that is compressed.
+	// Smaller payloads gain little from compression. Default value is 1024.
+	PayloadCodecThreshold int
+
+	// KeyProvider enables envelope encryption of payloads and metadata
+	// of published messages with AES-GCM. Subscribers need a provider
+	// with the same keys. Nil value inserts messages as they are.
+	KeyProvider KeyProvider
+
+	// MeterProvider records the number, size, and latency of published messages.
+	// Nil value disables metrics.
+	MeterProvider metric.MeterProvider
+
+	// TracerProvider creates a producer span for each message as a child of the message context.
+	// The span context is stored in message metadata, so subscribers can continue the trace.
+	// Nil value disables tracing.
+	TracerProvider trace.TracerProvider
+
+	// Propagator injects the producer span context into message metadata.
+	// Default value is [propagation.TraceContext], which writes W3C Trace Context headers.
+	Propagator propagation.TextMapPropagator
+
 	// Logger reports message publishing errors and traces. Defaults value is [watermill.NopLogger].
 	Logger watermill.LoggerAdapter
 }
@@ -33,8 +94,17 @@ type publisher struct {
 	InitializeSchema          bool
 	TopicTableNameGenerator   TableNameGenerator
 	OffsetsTableNameGenerator TableNameGenerator
+	SchemaAdapter             SchemaAdapter
+	OffsetsAdapter            OffsetsAdapter
+	IgnoreDuplicateUUIDs      bool
+	MaxBatchSize              int
+	PayloadCodec              PayloadCodec
+	PayloadCodecThreshold     int
+	KeyProvider               KeyProvider
 	UUID                      string
 	DB                        SQLiteConnection
+	Metrics                   *publisherMetrics
+	Tracer                    *publisherTracer
 	Logger                    watermill.LoggerAdapter
 
 	mu          sync.Mutex
@@ -51,15 +121,45 @@ func NewPublisher(db SQLiteConnection, options PublisherOptions) (message.Publis
 	if options.InitializeSchema && isTx(db) {
 		return nil, ErrAttemptedTableInitializationWithinTransaction
 	}
+	if options.MaxBatchSize < 0 {
+		return nil, errors.New("MaxBatchSize must not be negative")
+	}
+	if options.PayloadCodecThreshold < 0 {
+		return nil, errors.New("PayloadCodecThreshold must not be negative")
+	}
 
-	ID := uuid.New().String()
 	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	schemaAdapter := cmpOrTODO[SchemaAdapter](options.SchemaAdapter, DefaultSchemaAdapter{})
+	offsetsAdapter := cmpOrTODO[OffsetsAdapter](options.OffsetsAdapter, DefaultOffsetsAdapter{})
+	if err := validateAdapters(tng, schemaAdapter, offsetsAdapter); err != nil {
+		return nil, err
+	}
+	maxBatchSize, err := validateMaxBatchSize(options.MaxBatchSize, tng, schemaAdapter)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := newPublisherMetrics(options.MeterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create publisher metrics: %w", err)
+	}
+
+	ID := uuid.New().String()
 	return &publisher{
 		InitializeSchema:          options.InitializeSchema,
 		UUID:                      ID,
 		DB:                        db,
 		TopicTableNameGenerator:   tng.Topic,
 		OffsetsTableNameGenerator: tng.Offsets,
+		SchemaAdapter:             schemaAdapter,
+		OffsetsAdapter:            offsetsAdapter,
+		IgnoreDuplicateUUIDs:      options.IgnoreDuplicateUUIDs,
+		MaxBatchSize:              maxBatchSize,
+		PayloadCodec:              options.PayloadCodec,
+		PayloadCodecThreshold:     cmpOrTODO(options.PayloadCodecThreshold, 1024),
+		KeyProvider:               options.KeyProvider,
+		Metrics:                   metrics,
+		Tracer:                    newPublisherTracer(options.TracerProvider, options.Propagator),
 		Logger: cmpOrTODO[watermill.LoggerAdapter](
 			options.Logger,
 			defaultLogger,
@@ -90,56 +190,154 @@ func (p *publisher) Publish(topic string, messages ...*message.Message) (err err
 	//
 	// ctx := messages[0].Context()
 	ctx := context.Background()
-	p.initializeSchema(ctx, topic, messagesTableName)
+	if err = p.initializeSchema(ctx, topic, messagesTableName); err != nil {
+		return err
+	}
+	return p.insert(ctx, p.DB, topic, messages)
+}
 
-	b := strings.Builder{}
-	_, _ = b.WriteString("INSERT INTO '")
-	_, _ = b.WriteString(messagesTableName)
-	_, _ = b.WriteString("' (uuid, created_at, payload, metadata) VALUES ")
+// insert writes messages into the topic table using the connection,
+// which could be the publisher database handle or a transaction.
+func (p *publisher) insert(ctx context.Context, db SQLiteConnection, topic string, messages message.Messages) (err error) {
+	messagesTableName := p.TopicTableNameGenerator(topic)
+	start := time.Now()
+	spans := p.Tracer.Start(topic, messages)
+	defer func() {
+		spans.End(err)
+	}()
+	if messages, err = encodePayloads(p.PayloadCodec, p.PayloadCodecThreshold, messages); err != nil {
+		return err
+	}
+	if messages, err = encryptMessages(p.KeyProvider, messages); err != nil {
+		return err
+	}
+	var inserted int64
+	if len(messages) <= p.MaxBatchSize || isTx(db) {
+		inserted, err = p.insertChunks(ctx, db, topic, messagesTableName, messages)
+	} else {
+		inserted, err = p.insertChunksInTransaction(ctx, db, topic, messagesTableName, messages)
+	}
+	if err != nil {
+		return err
+	}
+	p.Metrics.Published(ctx, topic, messages, inserted, start)
+	if !isTx(db) {
+		// messages inserted within a transaction are not visible until the commit
+		published.Notify(messagesTableName)
+	}
+	return nil
+}
 
-	values := make([]any, 0, len(messages)*4)
-	for _, msg := range messages {
-		metadata, err := json.Marshal(msg.Metadata)
+// insertChunksInTransaction keeps publishing atomic when messages
+// do not fit into a single statement.
+func (p *publisher) insertChunksInTransaction(
+	ctx context.Context,
+	db SQLiteConnection,
+	topic string,
+	messagesTableName string,
+	messages message.Messages,
+) (int64, error) {
+	handle, ok := db.(SQLiteDatabase)
+	if !ok {
+		return 0, fmt.Errorf("unable to publish %d messages atomically: database handle does not support transactions", len(messages))
+	}
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin publishing transaction: %w", err)
+	}
+	inserted, err := p.insertChunks(ctx, tx, topic, messagesTableName, messages)
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit publishing transaction: %w", err)
+	}
+	return inserted, nil
+}
+
+// insertChunks splits messages into statements of at most MaxBatchSize messages.
+// Returns the number of inserted messages, which excludes skipped duplicates.
+func (p *publisher) insertChunks(
+	ctx context.Context,
+	db SQLiteConnection,
+	topic string,
+	messagesTableName string,
+	messages message.Messages,
+) (inserted int64, err error) {
+	for len(messages) > 0 {
+		chunk := messages[:min(len(messages), p.MaxBatchSize)]
+		messages = messages[len(chunk):]
+
+		query, values, err := p.SchemaAdapter.InsertQuery(InsertQueryParams{
+			Topic:       topic,
+			TopicTable:  messagesTableName,
+			Messages:    chunk,
+			UniqueUUIDs: p.IgnoreDuplicateUUIDs,
+		})
+		if err != nil {
+			return 0, err
+		}
+		p.Logger.Trace("Inserting messages into SQLite table", watermill.LogFields{
+			"query":      query,
+			"query_args": values,
+		})
+		result, err := db.ExecContext(ctx, query, values...)
+		if err != nil {
+			return 0, err
+		}
+		if !p.IgnoreDuplicateUUIDs {
+			inserted += int64(len(chunk))
+			continue
+		}
+		affected, err := result.RowsAffected()
 		if err != nil {
-			return fmt.Errorf("unable to encode message %q metadata to JSON: %w", msg.UUID, err)
+			affected = int64(len(chunk)) // messages were inserted, but skipped duplicates are unknown
+		}
+		inserted += affected
+		if skipped := int64(len(chunk)) - affected; skipped > 0 {
+			p.Logger.Debug("Skipped messages with UUIDs that were already published", watermill.LogFields{
+				"topic":   topic,
+				"skipped": skipped,
+			})
 		}
-		values = append(values, msg.UUID, time.Now().Format(time.RFC3339), msg.Payload, metadata)
-		b.WriteString(`(?,?,?,?),`)
 	}
-
-	query := strings.TrimRight(b.String(), ",")
-	p.Logger.Trace("Inserting messages into SQLite table", watermill.LogFields{
-		"query":      query,
-		"query_args": values,
-	})
-	_, err = p.DB.ExecContext(ctx, query, values...)
-	return err
+	return inserted, nil
 }
 
+// initializeSchema creates topic tables once per topic per publisher instance.
+// Without InitializeSchema option, it checks that the topic table was not
+// upgraded by a newer version of the library instead.
 func (p *publisher) initializeSchema(
 	parent context.Context,
 	topic string,
 	messagesTableName string,
 ) (err error) {
-	if !p.InitializeSchema {
-		return nil
-	}
 	ctx, cancel := context.WithTimeout(parent, time.Second*60)
 	defer cancel()
 	p.mu.Lock()
-	if _, ok := p.knownTopics[topic]; !ok {
-		if err = createTopicAndOffsetsTablesIfAbsent(
-			ctx,
-			p.DB,
-			messagesTableName,
-			p.OffsetsTableNameGenerator(topic),
-		); err != nil {
-			p.mu.Unlock()
+	defer p.mu.Unlock()
+	if _, ok := p.knownTopics[topic]; ok {
+		return nil
+	}
+	if !p.InitializeSchema {
+		if err = checkSchemaVersions(ctx, p.DB, map[string]string{messagesTableName: schemaKindTopic}); err != nil {
 			return err
 		}
-		p.knownTopics[topic] = struct{}{}
+	} else if err = createTopicAndOffsetsTablesIfAbsent(
+		ctx,
+		p.DB,
+		p.SchemaAdapter,
+		p.OffsetsAdapter,
+		SchemaInitializingQueriesParams{
+			Topic:        topic,
+			TopicTable:   messagesTableName,
+			OffsetsTable: p.OffsetsTableNameGenerator(topic),
+			UniqueUUIDs:  p.IgnoreDuplicateUUIDs,
+		},
+	); err != nil {
+		return err
 	}
-	p.mu.Unlock()
+	p.knownTopics[topic] = struct{}{}
 	return nil
 }
 
@@ -167,3 +365,42 @@ func isTx(db SQLiteConnection) bool {
 	})
 	return dbIsTx
 }
+
+// maxBoundParameters is the default SQLite limit on the number of parameters bound to a statement.
+const maxBoundParameters = 32766
+
+// validateMaxBatchSize returns the default batch size if the given one is zero.
+// Returns an error if a statement inserting a batch binds more parameters than SQLite allows.
+func validateMaxBatchSize(maxBatchSize int, tng TableNameGenerators, adapter SchemaAdapter) (int, error) {
+	// parameters bound per message are counted by the difference between
+	// insert queries of two messages and one message
+	params := InsertQueryParams{
+		Topic:      "probe",
+		TopicTable: tng.Topic("probe"),
+		Messages: message.Messages{
+			message.NewMessage("probe", []byte{}),
+			message.NewMessage("probe", []byte{}),
+		},
+	}
+	_, two, err := adapter.InsertQuery(params)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count insert query parameters: %w", err)
+	}
+	params.Messages = params.Messages[:1]
+	_, one, err := adapter.InsertQuery(params)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count insert query parameters: %w", err)
+	}
+	perMessage := len(two) - len(one)
+	if perMessage <= 0 {
+		return cmpOrTODO(maxBatchSize, 1000), nil
+	}
+	limit := (maxBoundParameters - (len(one) - perMessage)) / perMessage
+	if maxBatchSize == 0 {
+		return min(1000, limit), nil
+	}
+	if maxBatchSize > limit {
+		return 0, fmt.Errorf("MaxBatchSize must not exceed %d, because the schema adapter binds %d parameters per message", limit, perMessage)
+	}
+	return maxBatchSize, nil
+}
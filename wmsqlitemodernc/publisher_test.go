@@ -0,0 +1,154 @@
+package wmsqlitemodernc
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPublishInChunks(t *testing.T) {
+	ctx := newTestContext(t)
+
+	countMessages := func(t *testing.T, db SQLiteConnection, topic string) (count int) {
+		t.Helper()
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM 'watermill_`+topic+`';`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	t.Run("hundreds of thousands of messages", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("publishing hundreds of thousands of messages takes several seconds")
+		}
+		db := newTestConnection(t, newTestDSN())
+		pub := newTestPublisher(t, db, PublisherOptions{})
+
+		const total = 200_000
+		messages := make(message.Messages, total)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		topic := "TestPublishInChunks"
+		if err := pub.Publish(topic, messages...); err != nil {
+			t.Fatal(err)
+		}
+		if count := countMessages(t, db, topic); count != total {
+			t.Fatalf("expected %d published messages, got %d", total, count)
+		}
+	})
+
+	t.Run("failed chunk rolls back publishing", func(t *testing.T) {
+		db := newTestConnection(t, newTestDSN())
+		pub := newTestPublisher(t, db, PublisherOptions{
+			MaxBatchSize: 10,
+		})
+
+		messages := make(message.Messages, 25)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		messages[24].Metadata.Set(MetadataKeyDeliverAt, "tomorrow")
+		topic := "TestPublishInChunksRollback"
+		if err := pub.Publish(topic, messages...); err == nil {
+			t.Fatal("publishing must fail on the invalid message in the last chunk")
+		}
+		if count := countMessages(t, db, topic); count != 0 {
+			t.Fatalf("expected chunks inserted before the failure to be rolled back, got %d messages", count)
+		}
+	})
+
+	t.Run("batch size within the bound parameter limit", func(t *testing.T) {
+		db := newTestConnection(t, newTestDSN())
+		singleTable := PublisherOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+		}
+		for _, tc := range []struct {
+			options PublisherOptions
+			limit   int
+		}{
+			{options: PublisherOptions{}, limit: 6553},
+			{options: singleTable, limit: 5461},
+		} {
+			tc.options.MaxBatchSize = tc.limit + 1
+			if _, err := NewPublisher(db, tc.options); err == nil {
+				t.Fatalf("MaxBatchSize of %d messages must be rejected", tc.options.MaxBatchSize)
+			}
+		}
+
+		singleTable.MaxBatchSize = 5461
+		pub := newTestPublisher(t, db, singleTable)
+		messages := make(message.Messages, singleTable.MaxBatchSize)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		if err := pub.Publish("TestPublishInChunksLimit", messages...); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPublishIgnoringDuplicateUUIDs(t *testing.T) {
+	ctx := newTestContext(t)
+
+	newMessages := func(UUIDs ...string) (messages message.Messages) {
+		for _, UUID := range UUIDs {
+			messages = append(messages, message.NewMessage(UUID, []byte(UUID)))
+		}
+		return messages
+	}
+
+	for name, options := range map[string]PublisherOptions{
+		"table per topic": {},
+		"single table": {
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestConnection(t, newTestDSN())
+			options.InitializeSchema = true
+			options.IgnoreDuplicateUUIDs = true
+			options.MaxBatchSize = 2
+			pub, err := NewPublisher(db, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+			countMessages := func(t *testing.T, topic string) (count int) {
+				t.Helper()
+				query := `SELECT COUNT(*) FROM '` + tng.Topic(topic) + `'`
+				if tng.sharesTables() {
+					query += ` WHERE topic='` + topic + `'`
+				}
+				if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+					t.Fatal(err)
+				}
+				return count
+			}
+
+			topic := "TestPublishIgnoringDuplicateUUIDs"
+			if err = pub.Publish(topic, newMessages("1", "2", "3")...); err != nil {
+				t.Fatal(err)
+			}
+			// retried publishing overlaps with the previous one and repeats a message
+			if err = pub.Publish(topic, newMessages("2", "3", "4", "4")...); err != nil {
+				t.Fatal(err)
+			}
+			if count := countMessages(t, topic); count != 4 {
+				t.Fatalf("expected four unique messages, got %d", count)
+			}
+
+			if err = pub.Publish(topic+"Other", newMessages("1")...); err != nil {
+				t.Fatal(err)
+			}
+			if count := countMessages(t, topic+"Other"); count != 1 {
+				t.Fatalf("UUIDs must be unique within a topic only, got %d messages", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type positionKind uint8
+
+const (
+	positionEarliest positionKind = iota
+	positionLatest
+	positionOffset
+	positionTime
+)
+
+// Position identifies the first message that a consumer group receives
+// after [Seek] or after the consumer group is created by a [Subscriber].
+// Zero value is [PositionEarliest].
+type Position struct {
+	kind   positionKind
+	offset int64
+	time   time.Time
+}
+
+// PositionEarliest replays every message retained in the topic table.
+func PositionEarliest() Position {
+	return Position{kind: positionEarliest}
+}
+
+// PositionLatest skips every message already published to the topic table.
+func PositionLatest() Position {
+	return Position{kind: positionLatest}
+}
+
+// PositionAtOffset starts from the message with the given offset.
+// Use [Offset] to find out the offset of a delivered message.
+func PositionAtOffset(offset int64) Position {
+	return Position{kind: positionOffset, offset: offset}
+}
+
+// PositionAtTime starts from the first message published at or after the given time
+// with millisecond precision. Skips every message already published, if there is no such message.
+func PositionAtTime(t time.Time) Position {
+	return Position{kind: positionTime, time: t}
+}
+
+// OffsetAckedExpression returns an SQL expression that evaluates to the acknowledged
+// offset immediately preceding the position in the topic table. Use it to implement
+// ConsumerGroupInitializingQuery of an [OffsetsAdapter].
+func (p Position) OffsetAckedExpression(topicTable string) string {
+	switch p.kind {
+	case positionLatest:
+		return `COALESCE((SELECT MAX("offset") FROM '` + topicTable + `'), 0)`
+	case positionOffset:
+		return strconv.FormatInt(max(p.offset-1, 0), 10)
+	case positionTime:
+		return `COALESCE(
+			(SELECT MIN("offset")-1 FROM '` + topicTable + `' WHERE unixepoch(created_at, 'subsec')>=` +
+			strconv.FormatFloat(float64(p.time.UnixMilli())/1000, 'f', 3, 64) + `),
+			(SELECT MAX("offset") FROM '` + topicTable + `'),
+			0
+		)`
+	default:
+		return "0"
+	}
+}
+
+func (p Position) String() string {
+	switch p.kind {
+	case positionLatest:
+		return "latest"
+	case positionOffset:
+		return "offset " + strconv.FormatInt(p.offset, 10)
+	case positionTime:
+		return "time " + p.time.Format(time.RFC3339Nano)
+	default:
+		return "earliest"
+	}
+}
+
+// SeekOptions configure [Seek].
+type SeekOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// Topic of the consumer group.
+	Topic string
+
+	// ConsumerGroup to move. The consumer group is created, if it is absent.
+	// Default value is [DefaultConsumerGroupName].
+	ConsumerGroup string
+
+	// Position is the first message the consumer group receives after seeking.
+	Position Position
+
+	// RetryInterval is the time between attempts to acquire the consumer group lock
+	// held by an active subscription. Defaults to one hundred milliseconds.
+	RetryInterval time.Duration
+}
+
+func (o SeekOptions) validate() error {
+	if o.RetryInterval < 0 {
+		return errors.New("RetryInterval must not be negative")
+	}
+	if o.Position.kind == positionOffset && o.Position.offset < 0 {
+		return errors.New("Position offset must not be negative")
+	}
+	return validateTopicName(o.Topic)
+}
+
+// Seek moves the consumer group to a position in the topic, so that its subscriptions
+// replay or skip messages. Returns the acknowledged offset immediately preceding the position.
+//
+// Seek follows the consumer group lock protocol: it waits until active subscriptions
+// release the lock, which happens between message batches, or until the lock expires.
+// Delivery attempts and acknowledgements of the consumer group are forgotten, so
+// replayed messages are delivered again. Subscriptions with MessageLeases never lock
+// the consumer group, so the messages they are processing may also be delivered again.
+//
+// Returns [ErrSchemaIsOlder] if the offsets table of the topic was not migrated, see [Migrate].
+func Seek(ctx context.Context, db SQLiteDatabase, options SeekOptions) (offsetAcked int64, err error) {
+	if db == nil {
+		return 0, ErrDatabaseConnectionIsNil
+	}
+	if err = options.validate(); err != nil {
+		return 0, err
+	}
+	options.ConsumerGroup = cmpOrTODO(options.ConsumerGroup, DefaultConsumerGroupName)
+	options.RetryInterval = cmpOrTODO(options.RetryInterval, time.Millisecond*100)
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return 0, ErrSingleTableStorageIsNotSupported
+	}
+
+	ticker := time.NewTicker(options.RetryInterval)
+	defer ticker.Stop()
+	for {
+		offsetAcked, err = seek(ctx, db, tng, options)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return offsetAcked, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("unable to acquire consumer group %q lock: %w", options.ConsumerGroup, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// seek returns [sql.ErrNoRows] if the consumer group is locked.
+func seek(ctx context.Context, db SQLiteDatabase, tng TableNameGenerators, options SeekOptions) (offsetAcked int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			err = errors.Join(err, tx.Rollback())
+		}
+	}()
+
+	offsetsTable := tng.Offsets(options.Topic)
+	if err = checkSchemaIsMigrated(ctx, tx, schemaKindOffsets, offsetsTable); err != nil {
+		return 0, err
+	}
+	offset := options.Position.OffsetAckedExpression(tng.Topic(options.Topic))
+	if _, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO '`+offsetsTable+`' (consumer_group, offset_acked, locked_until) VALUES (?, 0, 0) ON CONFLICT(consumer_group) DO NOTHING;`,
+		options.ConsumerGroup,
+	); err != nil {
+		return 0, fmt.Errorf("unable to initialize consumer group %q: %w", options.ConsumerGroup, err)
+	}
+	if err = tx.QueryRowContext(
+		ctx,
+		`UPDATE '`+offsetsTable+`' SET offset_acked=`+offset+` WHERE consumer_group=? AND `+lockedUntil("locked_until")+`<CAST(unixepoch('subsec')*1000 AS INTEGER) RETURNING offset_acked;`,
+		options.ConsumerGroup,
+	).Scan(&offsetAcked); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("unable to move consumer group %q to %s: %w", options.ConsumerGroup, options.Position, err)
+	}
+
+	deliveriesTable := tng.Deliveries(options.Topic)
+	var present bool
+	if err = tx.QueryRowContext(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type='table' AND name=?)`,
+		deliveriesTable,
+	).Scan(&present); err != nil {
+		return 0, fmt.Errorf("unable to look up table %q: %w", deliveriesTable, err)
+	}
+	if present {
+		if _, err = tx.ExecContext(
+			ctx,
+			`DELETE FROM '`+deliveriesTable+`' WHERE consumer_group=?;`,
+			options.ConsumerGroup,
+		); err != nil {
+			return 0, fmt.Errorf("unable to forget consumer group %q deliveries: %w", options.ConsumerGroup, err)
+		}
+	}
+	return offsetAcked, nil
+}
@@ -0,0 +1,296 @@
+package wmsqlitemodernc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/dkotik/watermillsqlite/wmsqlitemodernc/tests"
+	"github.com/google/uuid"
+)
+
+func newSingleTableFixture(connectionDSN string) tests.PubSubFixture {
+	return func(t *testing.T, consumerGroup string) (message.Publisher, message.Subscriber) {
+		pub, err := NewPublisher(newTestConnection(t, connectionDSN), PublisherOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+			InitializeSchema:    true,
+		})
+		if err != nil {
+			t.Fatal("unable to initialize publisher:", err)
+		}
+		t.Cleanup(func() {
+			if err := pub.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		sub, err := NewSubscriber(newTestConnection(t, connectionDSN), SubscriberOptions{
+			PollInterval:         time.Millisecond * 20,
+			ConsumerGroupMatcher: NewStaticConsumerGroupMatcher(consumerGroup),
+			TableNameGenerators:  SingleTableNameGenerators(),
+			SchemaAdapter:        SingleTableSchemaAdapter{},
+			OffsetsAdapter:       SingleTableOffsetsAdapter{},
+			InitializeSchema:     true,
+		})
+		if err != nil {
+			t.Fatal("unable to initialize subscriber:", err)
+		}
+		t.Cleanup(func() {
+			if err := sub.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		return pub, sub
+	}
+}
+
+func TestSingleTableStorage(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	db := newTestConnection(t, DSN)
+	if err := db.PingContext(ctx); err != nil { // keeps the in-memory database open between fixtures
+		t.Fatal(err)
+	}
+	inMemory := newSingleTableFixture(DSN)
+	t.Run("basic functionality", tests.TestBasicSendRecieve(inMemory))
+	t.Run("one publisher three subscribers", tests.TestOnePublisherThreeSubscribers(inMemory, 1000))
+
+	t.Run("acceptance", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("acceptance tests take several minutes to complete")
+		}
+		tests.OfficialImplementationAcceptance(inMemory)(t)
+	})
+
+	for name, options := range map[string]SubscriberOptions{
+		"message leases":   {MessageLeases: true},
+		"delayed delivery": {DelayedDelivery: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pub, err := NewPublisher(db, PublisherOptions{
+				TableNameGenerators: SingleTableNameGenerators(),
+				SchemaAdapter:       SingleTableSchemaAdapter{},
+				OffsetsAdapter:      SingleTableOffsetsAdapter{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			options.PollInterval = time.Millisecond * 20
+			options.ConsumerGroupMatcher = NewStaticConsumerGroupMatcher("x")
+			options.TableNameGenerators = SingleTableNameGenerators()
+			options.SchemaAdapter = SingleTableSchemaAdapter{}
+			options.OffsetsAdapter = SingleTableOffsetsAdapter{}
+			options.InitializeSchema = true
+			sub, err := NewSubscriber(db, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := sub.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			topic := "TestSingleTableStorage" + strings.ReplaceAll(name, " ", "")
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = pub.Publish(topic, message.NewMessage("1", []byte{}), message.NewMessage("2", []byte{})); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"1", "2"} {
+				select {
+				case msg := <-messages:
+					if msg.UUID != id {
+						t.Fatalf("expected message %q, got %q", id, msg.UUID)
+					}
+					msg.Ack()
+				case <-time.After(time.Second * 3):
+					t.Fatalf("message %q was not delivered", id)
+				}
+			}
+			deadline := time.Now().Add(time.Second * 3)
+			for {
+				var lag int64
+				if err = db.QueryRowContext(ctx, `
+					SELECT (SELECT MAX("offset") FROM '`+SingleTableMessagesTableName+`' WHERE topic=?1)-offset_acked
+					FROM '`+SingleTableOffsetsTableName+`' WHERE topic=?1 AND consumer_group='x';
+				`, topic).Scan(&lag); err != nil {
+					t.Fatal(err)
+				}
+				if lag == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("consumer group offset did not advance, lag is %d", lag)
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+		})
+	}
+
+	t.Run("tables are shared by topics", func(t *testing.T) {
+		rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_schema WHERE type='table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' ORDER BY name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var tables []string
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			tables = append(tables, name)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(tables) != 3 ||
+			tables[0] != SingleTableDeliveriesTableName ||
+			tables[1] != SingleTableMessagesTableName ||
+			tables[2] != SingleTableOffsetsTableName {
+			t.Fatalf("expected only shared tables, got %v", tables)
+		}
+	})
+
+	t.Run("default adapters are rejected", func(t *testing.T) {
+		if _, err := NewPublisher(db, PublisherOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+		}); err == nil {
+			t.Fatal("publisher with default adapters must not use shared tables")
+		}
+		if _, err := NewSubscriber(db, SubscriberOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+		}); err == nil {
+			t.Fatal("subscriber with default offsets adapter must not use shared tables")
+		}
+		if _, err := NewInspector(db, InspectorOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+		}); !errors.Is(err, ErrSingleTableStorageIsNotSupported) {
+			t.Fatalf("expected %v, got %v", ErrSingleTableStorageIsNotSupported, err)
+		}
+	})
+
+	t.Run("operations that address topic tables are rejected", func(t *testing.T) {
+		tng := SingleTableNameGenerators()
+		sub := newTestSubscriber(t, db, SubscriberOptions{
+			TableNameGenerators: tng,
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+		})
+		if _, err := sub.Subscribe(ctx, "topic*"); !errors.Is(err, ErrSingleTableStorageIsNotSupported) {
+			t.Fatalf("topic pattern: expected %v, got %v", ErrSingleTableStorageIsNotSupported, err)
+		}
+		if _, err := Seek(ctx, db, SeekOptions{
+			Topic:               "topic",
+			TableNameGenerators: tng,
+		}); !errors.Is(err, ErrSingleTableStorageIsNotSupported) {
+			t.Fatalf("seek: expected %v, got %v", ErrSingleTableStorageIsNotSupported, err)
+		}
+		if _, err := CleanUpTopics(ctx, db, CleanUpOptions{
+			TableNameGenerators: tng,
+		}); !errors.Is(err, ErrSingleTableStorageIsNotSupported) {
+			t.Fatalf("clean up: expected %v, got %v", ErrSingleTableStorageIsNotSupported, err)
+		}
+		if err := Migrate(ctx, db, MigrateOptions{
+			TableNameGenerators: tng,
+		}); !errors.Is(err, ErrSingleTableStorageIsNotSupported) {
+			t.Fatalf("migrate: expected %v, got %v", ErrSingleTableStorageIsNotSupported, err)
+		}
+	})
+}
+
+func TestMigrateToSingleTable(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	published := map[string]message.Messages{}
+	for _, topic := range []string{"TestMigrateToSingleTableA", "TestMigrateToSingleTableB"} {
+		for i := 0; i < 3; i++ {
+			published[topic] = append(published[topic], message.NewMessage(uuid.New().String(), []byte(topic)))
+		}
+		if err := pub.Publish(topic, published[topic]...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Seek(ctx, db, SeekOptions{
+			Topic:         topic,
+			ConsumerGroup: "x",
+			Position:      PositionAtOffset(3), // second message was acknowledged
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range (DefaultOffsetsAdapter{}).SchemaInitializingQueries(SchemaInitializingQueriesParams{
+		DeliveriesTable: "watermill_deliveries_TestMigrateToSingleTableB",
+	})[1:] {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO 'watermill_deliveries_TestMigrateToSingleTableB' (consumer_group, "offset", attempts) VALUES ('x', 3, 2);`); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := MigrateToSingleTable(ctx, db, MigrateToSingleTableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 6 {
+		t.Fatalf("expected six moved messages, got %d", moved)
+	}
+	var remaining int
+	if err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_schema WHERE type='table' AND name LIKE 'watermill\_%' ESCAPE '\' AND name<>?`, SchemaVersionsTableName).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Fatalf("expected table-per-topic tables to be dropped, %d remain", remaining)
+	}
+	var attempts int
+	if err = db.QueryRowContext(ctx, `SELECT attempts FROM '`+SingleTableDeliveriesTableName+`' WHERE topic='TestMigrateToSingleTableB' AND consumer_group='x' AND "offset"=6;`).Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected two delivery attempts to be moved, got %d", attempts)
+	}
+
+	sub, err := NewSubscriber(db, SubscriberOptions{
+		PollInterval:         time.Millisecond * 20,
+		ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("x"),
+		TableNameGenerators:  SingleTableNameGenerators(),
+		SchemaAdapter:        SingleTableSchemaAdapter{},
+		OffsetsAdapter:       SingleTableOffsetsAdapter{},
+		MaxDeliveryAttempts:  5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := sub.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for topic, messages := range published {
+		received, err := sub.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg.UUID != messages[2].UUID {
+				t.Fatalf("expected the last message %q of topic %q, got %q", messages[2].UUID, topic, msg.UUID)
+			}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("message of topic %q was not delivered", topic)
+		}
+	}
+}
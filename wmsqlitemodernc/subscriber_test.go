@@ -0,0 +1,149 @@
+package wmsqlitemodernc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestSubSecondLockTimeout(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	if _, err := NewSubscriber(db, SubscriberOptions{LockTimeout: time.Microsecond}); err == nil {
+		t.Fatal("lock timeout shorter than one millisecond must be rejected")
+	}
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestSubSecondLockTimeout"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	// consumer group lock left behind by a crashed subscription
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO 'watermill_offsets_`+topic+`' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, (CAST(unixepoch('subsec')*1000 AS INTEGER)+1199)/1000, CAST(unixepoch('subsec')*1000 AS INTEGER)+200);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		LockTimeout: time.Millisecond * 200,
+	})
+	start := time.Now()
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-time.After(time.Second * 3):
+		t.Fatal("message was not delivered after the lock expired")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("consumer group lock was taken over after %s", elapsed)
+	}
+
+	// the lock is extended for as long as the message is processed
+	time.Sleep(time.Millisecond * 500)
+	var locked, roundedUp bool
+	if err = db.QueryRowContext(
+		ctx,
+		`SELECT locked_until_ms>=CAST(unixepoch('subsec')*1000 AS INTEGER), locked_until*1000>=locked_until_ms FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='default'`,
+	).Scan(&locked, &roundedUp); err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("consumer group lock was not extended")
+	}
+	if !roundedUp {
+		t.Fatal("lock expiry in seconds must not precede the expiry in milliseconds")
+	}
+	msg.Ack()
+}
+
+func TestLockHeldByAnotherSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestLockHeldByAnotherSubscription"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	var lockedUntil int64
+	if err := db.QueryRowContext(ctx, `
+		INSERT INTO 'watermill_offsets_`+topic+`' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, unixepoch()+60, CAST(unixepoch('subsec')*1000 AS INTEGER)+60000) RETURNING locked_until_ms;
+	`).Scan(&lockedUntil); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, db, SubscriberOptions{})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %q was delivered while another subscription held the lock", msg.UUID)
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	var stillLockedUntil int64
+	if err = db.QueryRowContext(
+		ctx,
+		`SELECT locked_until_ms FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='default'`,
+	).Scan(&stillLockedUntil); err != nil {
+		t.Fatal(err)
+	}
+	if stillLockedUntil != lockedUntil {
+		t.Fatal("subscription that could not acquire the consumer group lock released it")
+	}
+}
+
+func TestLockTakenByOlderVersion(t *testing.T) {
+	ctx := newTestContext(t)
+
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{})
+	topic := "TestLockTakenByOlderVersion"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	// lock in seconds extended by a version that predates the milliseconds column
+	// over an expired lock in milliseconds
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO 'watermill_offsets_`+topic+`' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, unixepoch()+1, CAST(unixepoch('subsec')*1000 AS INTEGER)-2000);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	var lockedUntil int64
+	if err := db.QueryRowContext(
+		ctx,
+		`SELECT locked_until FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='default'`,
+	).Scan(&lockedUntil); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		LockTimeout: time.Millisecond * 200,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		if now := time.Now(); now.Before(time.Unix(lockedUntil+1, 0)) {
+			t.Fatalf("consumer group lock held until the end of second %d was taken over at %s", lockedUntil, now)
+		}
+		msg.Ack()
+	case <-time.After(time.Second * 4):
+		t.Fatal("message was not delivered after the lock expired")
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type subscription struct {
@@ -23,21 +25,56 @@ type subscription struct {
 	sqlExtendLock          string
 	sqlNextMessageBatch    string
 	sqlAcknowledgeMessages string
+	sqlMaxOffset           string
 
+	maxDeliveryAttempts     int64
+	sqlCountDeliveryAttempt string
+	sqlForgetDeliveries     string
+	schemaAdapter           SchemaAdapter
+	deadLetterTopic         string
+	deadLetterTable         string
+
+	acknowledgesDeliveries bool
+	sqlAcknowledgeDelivery string
+
+	messageLeases    bool
+	sqlLeaseMessage  string
+	sqlReleaseLeases string
+
+	consumesInTransaction bool
+	filtersMetadata       bool
+	batchSize             int
+	payloadCodec          PayloadCodec
+	keyProvider           KeyProvider
+
+	topic           string
+	consumerGroup   string
 	lockedOffset    int64
 	lastAckedOffset int64
+	scannedOffset   int64
 	destination     chan *message.Message
+	wake            chan struct{}
+	metrics         *subscriptionMetrics
+	tracer          *subscriptionTracer
 	logger          watermill.LoggerAdapter
 }
 
 type rawMessage struct {
-	Offset   int64
-	UUID     string
-	Payload  []byte
-	Metadata message.Metadata
+	Offset    int64
+	UUID      string
+	CreatedAt string
+	Payload   []byte
+	Metadata  message.Metadata
+	Attempts  int64
+
+	// Unreadable is the reason why the stored payload or metadata could not be restored.
+	// Such a message is kept as it is stored and never delivered.
+	Unreadable error
 }
 
+// NextBatch returns [sql.ErrNoRows] if the consumer group is locked by another subscription.
 func (s *subscription) NextBatch(ctx context.Context) (batch []rawMessage, err error) {
+	s.scannedOffset = 0
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
@@ -61,21 +98,63 @@ func (s *subscription) NextBatch(ctx context.Context) (batch []rawMessage, err e
 	// Transaction execution and query operations must be context-less. Otherwise, a message occasionally will get lost, because the transaction will not be committed because one of the operations will not run with a cancelled context. Strange behavior, but it is proven by TestContinueAfterSubscribeClose with run with -count=5 or more.
 	lock := tx.QueryRow(s.sqlLockConsumerGroup)
 	if err = lock.Err(); err != nil {
+		s.metrics.LockAcquisition(ctx, lockFailed)
 		return nil, fmt.Errorf("unable to acquire row lock: %w", err)
 	}
 	if err = lock.Scan(&s.lockedOffset); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, tx.Commit() // unable  to acquire row lock
+			s.metrics.LockAcquisition(ctx, lockBusy)
+			return nil, err // the lock belongs to another subscription, which must not be released
 		}
+		s.metrics.LockAcquisition(ctx, lockFailed)
 		return nil, fmt.Errorf("unable to scan offset_acked value: %w", err)
 	}
+	s.metrics.LockAcquisition(ctx, lockAcquired)
 	s.lastAckedOffset = s.lockedOffset
 
 	rows, err := tx.Query(s.sqlNextMessageBatch, s.lockedOffset) // contextless
 	if err != nil {
 		return nil, fmt.Errorf("unable to query next message batch: %w", err)
 	}
-	return buildBatch(rows)
+	if batch, err = buildBatch(rows); err != nil {
+		return nil, err
+	}
+	for i := range batch {
+		s.restore(&batch[i])
+	}
+	if s.messageLeases {
+		for _, next := range batch {
+			if _, err = tx.Exec(s.sqlLeaseMessage, next.Offset); err != nil { // contextless
+				return nil, fmt.Errorf("unable to lease message: %w", err)
+			}
+		}
+	}
+	if s.sqlMaxOffset != "" {
+		var maxOffset int64
+		if err = tx.QueryRow(s.sqlMaxOffset).Scan(&maxOffset); err != nil { // contextless
+			return nil, fmt.Errorf("unable to query topic max offset: %w", err)
+		}
+		s.metrics.Batch(ctx, len(batch), maxOffset-s.lockedOffset)
+		if s.filtersMetadata && len(batch) < s.batchSize {
+			// a short batch means that every other message up to the last one did not match the filter
+			s.scannedOffset = maxOffset
+		}
+	}
+	return batch, nil
+}
+
+// restore decrypts and decodes a stored message. A message that cannot be restored
+// fails on its own in [subscription.Send] instead of failing the whole batch.
+func (s *subscription) restore(next *rawMessage) {
+	stored := *next
+	err := decryptMessage(s.keyProvider, next)
+	if err == nil {
+		err = decodePayload(s.payloadCodec, next)
+	}
+	if err != nil {
+		*next = stored
+		next.Unreadable = err
+	}
 }
 
 func buildBatch(rows *sql.Rows) (batch []rawMessage, err error) {
@@ -85,7 +164,7 @@ func buildBatch(rows *sql.Rows) (batch []rawMessage, err error) {
 	rawMetadata := []byte{} // TODO: use buffer pool
 	for rows.Next() {
 		next := rawMessage{}
-		if err = rows.Scan(&next.Offset, &next.UUID, &next.Payload, &rawMetadata); err != nil {
+		if err = rows.Scan(&next.Offset, &next.UUID, &next.CreatedAt, &next.Payload, &rawMetadata, &next.Attempts); err != nil {
 			return nil, err
 		}
 		if err = json.Unmarshal(rawMetadata, &next.Metadata); err != nil {
@@ -100,9 +179,23 @@ func buildBatch(rows *sql.Rows) (batch []rawMessage, err error) {
 }
 
 func (s *subscription) ExtendLock(ctx context.Context) error {
-	row := s.DB.QueryRowContext(ctx, s.sqlExtendLock, s.lastAckedOffset, s.lockedOffset)
-	if err := row.Err(); err != nil {
-		return fmt.Errorf("unable to extend lock: %w", err)
+	if s.messageLeases {
+		if _, err := s.DB.ExecContext(ctx, s.sqlExtendLock); err != nil {
+			return fmt.Errorf("unable to extend message leases: %w", err)
+		}
+		s.metrics.LockExtended(ctx)
+		s.lockTicker.Reset(s.lockDuration)
+		return nil
+	}
+	var lockedUntil int64
+	if err := s.DB.QueryRowContext(ctx, s.sqlExtendLock, s.lastAckedOffset, s.lockedOffset).Scan(&lockedUntil); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("unable to extend lock: %w", err)
+		}
+		// lock expired and another subscription took over the consumer group
+		s.metrics.LockLost(ctx)
+	} else {
+		s.metrics.LockExtended(ctx)
 	}
 	s.lockTicker.Reset(s.lockDuration)
 	s.lockedOffset = s.lastAckedOffset
@@ -110,29 +203,181 @@ func (s *subscription) ExtendLock(ctx context.Context) error {
 }
 
 func (s *subscription) ReleaseLock(ctx context.Context) (err error) {
-	_, err = s.DB.ExecContext(
+	if s.messageLeases {
+		if _, err = s.DB.ExecContext(ctx, s.sqlReleaseLeases); err != nil {
+			return fmt.Errorf("unable to release message leases: %w", err)
+		}
+		if _, err = s.DB.ExecContext(ctx, s.sqlAcknowledgeMessages); err != nil {
+			return fmt.Errorf("unable to advance consumer group offset: %w", err)
+		}
+	} else if _, err = s.DB.ExecContext(
 		ctx,
 		s.sqlAcknowledgeMessages,
 		s.lastAckedOffset,
 		s.lockedOffset,
-	)
-	return err
+	); err != nil {
+		return err
+	}
+	if s.sqlForgetDeliveries != "" {
+		if _, err = s.DB.ExecContext(ctx, s.sqlForgetDeliveries); err != nil {
+			return fmt.Errorf("unable to remove deliveries of acknowledged messages: %w", err)
+		}
+	}
+	return nil
+}
+
+// Acknowledge records the acknowledgement of a message. Offset of a delayed delivery
+// or message lease consumer group advances when the lock is released,
+// because acknowledgements may arrive out of order.
+func (s *subscription) Acknowledge(ctx context.Context, offset int64) (err error) {
+	if !s.acknowledgesDeliveries {
+		s.lastAckedOffset = offset
+		return nil
+	}
+	if _, err = s.DB.ExecContext(ctx, s.sqlAcknowledgeDelivery, offset); err != nil {
+		return fmt.Errorf("unable to acknowledge delivery: %w", err)
+	}
+	return nil
+}
+
+// CountDeliveryAttempt increments the persisted number of delivery attempts of the message at the given offset.
+func (s *subscription) CountDeliveryAttempt(ctx context.Context, offset int64) (attempts int64, err error) {
+	if err = s.DB.QueryRowContext(ctx, s.sqlCountDeliveryAttempt, offset).Scan(&attempts); err != nil {
+		return 0, fmt.Errorf("unable to count delivery attempt: %w", err)
+	}
+	return attempts, nil
+}
+
+// DeadLetter moves the message into the dead-letter topic and advances
+// the consumer group offset past it within the same transaction.
+func (s *subscription) DeadLetter(ctx context.Context, next rawMessage, reason string) (err error) {
+	msg := message.NewMessage(next.UUID, next.Payload)
+	msg.Metadata = deadLetterMetadata(next.Metadata, s.topic, s.consumerGroup, next.Attempts, reason)
+	messages := message.Messages{msg}
+	if next.Unreadable == nil { // unreadable messages are moved as they are stored
+		if messages, err = encryptMessages(s.keyProvider, messages); err != nil {
+			return fmt.Errorf("unable to encrypt dead-letter message %q: %w", next.UUID, err)
+		}
+	}
+	query, args, err := s.schemaAdapter.InsertQuery(InsertQueryParams{
+		Topic:      s.deadLetterTopic,
+		TopicTable: s.deadLetterTable,
+		Messages:   messages,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to build dead-letter message %q insert query: %w", next.UUID, err)
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return errors.Join(fmt.Errorf("unable to insert message into dead-letter topic: %w", err), tx.Rollback())
+	}
+	if s.acknowledgesDeliveries {
+		_, err = tx.ExecContext(ctx, s.sqlAcknowledgeDelivery, next.Offset)
+	} else {
+		var lockedUntil int64
+		err = tx.QueryRowContext(ctx, s.sqlExtendLock, next.Offset, s.lockedOffset).Scan(&lockedUntil)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to acknowledge dead-lettered message: %w", err), tx.Rollback())
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	published.Notify(s.deadLetterTable)
+	s.logger.Info("message moved to dead-letter topic", watermill.LogFields{
+		"uuid":     next.UUID,
+		"offset":   next.Offset,
+		"attempts": next.Attempts,
+		"reason":   reason,
+	})
+	s.lockTicker.Reset(s.lockDuration)
+	if !s.acknowledgesDeliveries {
+		s.lastAckedOffset = next.Offset
+		s.lockedOffset = next.Offset
+	}
+	return nil
+}
+
+// SkipUnreadable counts a failed delivery attempt of a message that could not be restored
+// and moves it into the dead-letter topic once delivery attempts are exhausted.
+// Until then, or without dead-lettering, the returned error stops the batch and
+// the message is retried on the next poll, for example, after a missing key is provided.
+func (s *subscription) SkipUnreadable(ctx context.Context, next rawMessage) (err error) {
+	if s.maxDeliveryAttempts > 0 {
+		if next.Attempts < s.maxDeliveryAttempts {
+			if next.Attempts, err = s.CountDeliveryAttempt(ctx, next.Offset); err != nil {
+				return err
+			}
+		}
+		if next.Attempts >= s.maxDeliveryAttempts {
+			return s.DeadLetter(ctx, next, deadLetterReasonUnreadable)
+		}
+	}
+	return fmt.Errorf("unable to restore message at offset %d: %w", next.Offset, next.Unreadable)
 }
 
-func (s *subscription) Send(parent context.Context, next rawMessage) error {
+func (s *subscription) Send(parent context.Context, next rawMessage) (err error) {
 	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
 	s.lockTicker.Reset(s.lockDuration)
-	for {
+	if next.Unreadable != nil {
+		return s.SkipUnreadable(ctx, next)
+	}
+	if s.maxDeliveryAttempts > 0 && next.Attempts >= s.maxDeliveryAttempts {
+		// previous deliveries were interrupted, for example, by a crashed consumer
+		return s.DeadLetter(ctx, next, deadLetterReasonExhausted)
+	}
+	var (
+		reason string
+		span   trace.Span
+		tx     *sql.Tx
+	)
+	defer func() {
+		if tx != nil {
+			err = errors.Join(err, s.RollbackDelivery(tx))
+		}
+		if span != nil {
+			span.End()
+		}
+	}()
+	for attempt := next.Attempts + 1; ; attempt++ {
+		var msgCtx context.Context
+		msgCtx, span = s.tracer.Start(ctx, next, attempt)
+		lockExtensions := s.lockTicker.C
+		if s.maxDeliveryAttempts > 0 {
+			// counted before emission and outside of the delivery transaction,
+			// so that the attempt is recorded even if the consumer crashes or the handler fails
+			if next.Attempts, err = s.CountDeliveryAttempt(ctx, next.Offset); err != nil {
+				return err
+			}
+		}
+		if s.consumesInTransaction {
+			if tx, err = s.BeginDelivery(ctx, next.Offset); err != nil {
+				return err
+			}
+			msgCtx = context.WithValue(msgCtx, txContextKey{}, tx)
+			// lock cannot be taken over while the transaction holds the write lock
+			lockExtensions = nil
+		}
 		msg := message.NewMessage(next.UUID, next.Payload)
 		msg.Metadata = next.Metadata
-		msg.SetContext(ctx) // required for passing official PubSub test tests.TestMessageCtx
+		setDeliveryMetadata(msg, next)
+		msg.SetContext(msgCtx) // required for passing official PubSub test tests.TestMessageCtx
 
 		select { // wait for message emission
 		case <-ctx.Done():
 			return nil
 		case <-s.lockTicker.C:
+			if tx != nil {
+				if err = s.RollbackDelivery(tx); err != nil {
+					return err
+				}
+				tx = nil
+			}
 			return s.ReleaseLock(ctx)
 		case s.destination <- msg:
 		}
@@ -142,21 +387,44 @@ func (s *subscription) Send(parent context.Context, next rawMessage) error {
 		case <-ctx.Done():
 			msg.Nack()
 			return nil
-		case <-s.lockTicker.C:
-			if err := s.ExtendLock(ctx); err != nil {
+		case <-lockExtensions:
+			if err = s.ExtendLock(ctx); err != nil {
 				return err
 			}
 			goto waitForMessageAcknowledgement
 		case <-msg.Acked():
-			s.lastAckedOffset = next.Offset
-			return nil
+			s.metrics.Acked(ctx)
+			if tx != nil {
+				err = s.CommitDelivery(ctx, tx, next.Offset)
+				tx = nil
+				return err
+			}
+			return s.Acknowledge(ctx, next.Offset)
 		case <-s.nackChannel():
 			s.logger.Debug("message took too long to be acknowledged", nil)
+			s.metrics.AckDeadlineExpired(ctx)
 			msg.Nack()
-			if err := s.ExtendLock(ctx); err != nil {
+			reason = deadLetterReasonDeadlineExceeded
+		case <-msg.Nacked():
+			s.metrics.Nacked(ctx)
+			reason = deadLetterReasonNacked
+		}
+		if tx != nil {
+			if err = s.RollbackDelivery(tx); err != nil {
 				return err
 			}
-		case <-msg.Nacked():
+			tx = nil
+		}
+		if reason == deadLetterReasonDeadlineExceeded {
+			if err = s.ExtendLock(ctx); err != nil {
+				return err
+			}
+		}
+		span.SetStatus(codes.Error, reason)
+		span.End()
+
+		if s.maxDeliveryAttempts > 0 && next.Attempts >= s.maxDeliveryAttempts {
+			return s.DeadLetter(ctx, next, reason)
 		}
 	}
 }
@@ -172,11 +440,12 @@ func (s *subscription) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-s.pollTicker.C:
+		case <-s.wake:
 		}
 
 		batch, err = s.NextBatch(ctx)
 		if err != nil {
-			if !errors.Is(err, context.Canceled) {
+			if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, context.Canceled) {
 				s.logger.Error("next message batch query failed", err, nil)
 			}
 			continue
@@ -187,9 +456,14 @@ func (s *subscription) Run(ctx context.Context) {
 				if !errors.Is(err, context.Canceled) {
 					s.logger.Error("failed to process queued message", err, nil)
 				}
-				continue
+				break // messages after a failed one must not be acknowledged
 			}
 		}
+		if err == nil && s.scannedOffset > s.lastAckedOffset &&
+			(len(batch) == 0 || s.lastAckedOffset == batch[len(batch)-1].Offset) {
+			// skip messages that did not match the metadata filter once the whole batch is acknowledged
+			s.lastAckedOffset = s.scannedOffset
+		}
 
 		if err = s.ReleaseLock(ctx); err != nil {
 			if !errors.Is(err, context.Canceled) {
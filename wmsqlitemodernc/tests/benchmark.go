@@ -27,6 +27,28 @@ func NewPublishingBenchmark(p message.Publisher) func(*testing.B) {
 	}
 }
 
+// NewConcurrentPublishingBenchmark publishes single messages from parallel goroutines,
+// which is the worst case for publishers that commit each publishing call separately.
+func NewConcurrentPublishingBenchmark(p message.Publisher) func(*testing.B) {
+	return func(b *testing.B) {
+		if p == nil {
+			b.Fatal("publisher is nil")
+		}
+
+		b.SetParallelism(64)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				msg := message.NewMessage(uuid.New().String(), []byte("test"))
+				if err := p.Publish(benchmarkTopic, msg); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+}
+
 func NewSubscriptionBenchmark(s message.Subscriber) func(*testing.B) {
 	return func(b *testing.B) {
 		if s == nil {
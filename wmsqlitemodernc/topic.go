@@ -2,8 +2,11 @@ package wmsqlitemodernc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 )
 
 var disallowedTopicCharacters = regexp.MustCompile(`[^A-Za-z0-9\-\$\:\.\_]`)
@@ -20,29 +23,86 @@ func validateTopicName(topic string) error {
 	return nil
 }
 
-func createTopicAndOffsetsTablesIfAbsent(ctx context.Context, db SQLiteConnection, messagesTableName, offsetsTableName string) (err error) {
-	if err = validateTopicName(messagesTableName); err != nil {
+func createTopicAndOffsetsTablesIfAbsent(
+	ctx context.Context,
+	db SQLiteConnection,
+	schemaAdapter SchemaAdapter,
+	offsetsAdapter OffsetsAdapter,
+	params SchemaInitializingQueriesParams,
+) (err error) {
+	if err = validateTopicName(params.TopicTable); err != nil {
 		return err
 	}
-	// adding UNIQUE(uuid) constraint slows the driver down without benefit
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS '`+messagesTableName+`' (
-		'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		uuid TEXT NOT NULL,
-		created_at TEXT NOT NULL,
-		payload BLOB NOT NULL,
-		metadata JSON NOT NULL
-	);`)
-	if err != nil {
-		return err
+	for _, query := range append(
+		schemaAdapter.SchemaInitializingQueries(params),
+		offsetsAdapter.SchemaInitializingQueries(params)...,
+	) {
+		if _, err = db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := schemaAdapter.(schemaMigrator); ok {
+		if err = migrateTable(ctx, db, schemaKindTopic, params.TopicTable); err != nil {
+			return err
+		}
 	}
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS '`+offsetsTableName+`' (
-		consumer_group TEXT NOT NULL,
-		offset_acked INTEGER NOT NULL,
-		locked_until INTEGER NOT NULL,
-		PRIMARY KEY(consumer_group)
-	);`)
+	if _, ok := offsetsAdapter.(schemaMigrator); ok {
+		if err = migrateTable(ctx, db, schemaKindOffsets, params.OffsetsTable); err != nil {
+			return err
+		}
+		if params.DeliveriesTable != "" {
+			if err = migrateTable(ctx, db, schemaKindDeliveries, params.DeliveriesTable); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findTopics discovers topics by matching SQLite table names against
+// table name generators. A topic is discovered only if both of its
+// topic and offsets tables are present.
+func findTopics(ctx context.Context, db SQLiteConnection, tng TableNameGenerators) (topics []string, err error) {
+	const probe = "topic"
+	sample := tng.Topic(probe)
+	i := strings.LastIndex(sample, probe)
+	if i < 0 {
+		return nil, errors.New("unable to discover topics: topic table name generator does not contain the topic name")
+	}
+	prefix, suffix := sample[:i], sample[i+len(probe):]
+
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_schema WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to list SQLite tables: %w", err)
+	}
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+	tables := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for name := range tables {
+		if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		topic := name[len(prefix) : len(name)-len(suffix)]
+		if validateTopicName(topic) != nil || tng.Topic(topic) != name {
+			continue
+		}
+		if _, ok := tables[tng.Offsets(topic)]; ok {
+			topics = append(topics, topic)
+		}
 	}
-	return err
+	slices.Sort(topics)
+	return topics, nil
 }
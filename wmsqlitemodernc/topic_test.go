@@ -25,8 +25,12 @@ func TestTopicTableCreation(t *testing.T) {
 	err = createTopicAndOffsetsTablesIfAbsent(
 		ctx,
 		db,
-		"messagesTableName",
-		"offsetsTableName",
+		DefaultSchemaAdapter{},
+		DefaultOffsetsAdapter{},
+		SchemaInitializingQueriesParams{
+			TopicTable:   "messagesTableName",
+			OffsetsTable: "offsetsTableName",
+		},
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -59,7 +63,7 @@ func TestTopicTableCreation(t *testing.T) {
 	}
 
 	// t.Fatal(tables)
-	if len(tables) != 2 {
-		t.Fatal("Expected 2 tables, got", len(tables))
+	if len(tables) != 3 { // topic, offsets, and schema versions
+		t.Fatal("Expected 3 tables, got", len(tables))
 	}
 }
@@ -0,0 +1,140 @@
+package wmsqlitemodernc
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of publisher and subscriber spans.
+const tracerName = meterName
+
+var (
+	attributeMessagingSystem = attribute.String("messaging.system", "sqlite")
+	attributeMessageID       = attribute.Key("messaging.message.id")
+	attributeMessageOffset   = attribute.Key("messaging.sqlite.message.offset")
+	attributeDeliveryAttempt = attribute.Key("messaging.sqlite.message.delivery_attempt")
+)
+
+// metadataCarrier adapts message metadata to [propagation.TextMapCarrier].
+type metadataCarrier message.Metadata
+
+func (c metadataCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// publisherTracer is nil, unless PublisherOptions set a TracerProvider.
+type publisherTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newPublisherTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) *publisherTracer {
+	if provider == nil {
+		return nil
+	}
+	return &publisherTracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: cmpOrTODO[propagation.TextMapPropagator](propagator, propagation.TraceContext{}),
+	}
+}
+
+// publishSpans end together, because messages are inserted in a single statement.
+type publishSpans []trace.Span
+
+// Start creates a producer span for each message as a child of the message context
+// and injects the span context into message metadata before it is stored.
+func (t *publisherTracer) Start(topic string, messages message.Messages) publishSpans {
+	if t == nil {
+		return nil
+	}
+	spans := make(publishSpans, len(messages))
+	for i, msg := range messages {
+		ctx, span := t.tracer.Start(
+			msg.Context(),
+			"publish "+topic,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attributeMessagingSystem,
+				attributeTopic.String(topic),
+				attributeMessageID.String(msg.UUID),
+			),
+		)
+		if msg.Metadata == nil {
+			msg.Metadata = make(message.Metadata)
+		}
+		t.propagator.Inject(ctx, metadataCarrier(msg.Metadata))
+		spans[i] = span
+	}
+	return spans
+}
+
+func (spans publishSpans) End(err error) {
+	for _, span := range spans {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "unable to insert messages")
+		}
+		span.End()
+	}
+}
+
+// subscriptionTracer is nil, unless SubscriberOptions set a TracerProvider.
+type subscriptionTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	attributes []attribute.KeyValue
+	name       string
+}
+
+func newSubscriptionTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator, topic, consumerGroup string) *subscriptionTracer {
+	if provider == nil {
+		return nil
+	}
+	return &subscriptionTracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: cmpOrTODO[propagation.TextMapPropagator](propagator, propagation.TraceContext{}),
+		attributes: []attribute.KeyValue{
+			attributeMessagingSystem,
+			attributeTopic.String(topic),
+			attributeConsumerGroup.String(consumerGroup),
+		},
+		name: "process " + topic,
+	}
+}
+
+// Start extracts the publisher span context from message metadata
+// and creates a consumer span for a delivery attempt.
+func (t *subscriptionTracer) Start(ctx context.Context, next rawMessage, attempt int64) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(
+		t.propagator.Extract(ctx, metadataCarrier(next.Metadata)),
+		t.name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(t.attributes...),
+		trace.WithAttributes(
+			attributeMessageID.String(next.UUID),
+			attributeMessageOffset.Int64(next.Offset),
+			attributeDeliveryAttempt.Int64(attempt),
+		),
+	)
+}
@@ -0,0 +1,104 @@
+package wmsqlitemodernc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracePropagation(t *testing.T) {
+	ctx := newTestContext(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	db := newTestConnection(t, newTestDSN())
+	pub := newTestPublisher(t, db, PublisherOptions{
+		TracerProvider: provider,
+	})
+	sub := newTestSubscriber(t, db, SubscriberOptions{
+		TracerProvider: provider,
+	})
+
+	topic := "TestTracePropagation"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCtx, parent := provider.Tracer("test").Start(ctx, "parent")
+	msg := message.NewMessage("1", []byte("traced"))
+	msg.SetContext(parentCtx)
+	if err = pub.Publish(topic, msg); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	if msg.Metadata.Get("traceparent") == "" {
+		t.Fatal("trace context was not injected into message metadata")
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		select {
+		case received := <-messages:
+			if traceID := trace.SpanContextFromContext(received.Context()).TraceID(); traceID != parent.SpanContext().TraceID() {
+				t.Fatalf("expected trace %s, got %s", parent.SpanContext().TraceID(), traceID)
+			}
+			if attempt == 1 {
+				received.Nack()
+			} else {
+				received.Ack()
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("message was not delivered")
+		}
+	}
+
+	var publish sdktrace.ReadOnlySpan
+	consumed := make([]sdktrace.ReadOnlySpan, 0, 2)
+	deadline := time.Now().Add(time.Second * 3)
+	for len(consumed) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected two consumer spans, got %d", len(consumed))
+		}
+		time.Sleep(time.Millisecond * 20)
+		consumed = consumed[:0]
+		for _, span := range recorder.Ended() {
+			switch span.SpanKind() {
+			case trace.SpanKindProducer:
+				publish = span
+			case trace.SpanKindConsumer:
+				consumed = append(consumed, span)
+			}
+		}
+	}
+	if publish == nil || publish.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("publish span must be a child of the message context span")
+	}
+
+	for i, span := range consumed {
+		if span.Parent().SpanID() != publish.SpanContext().SpanID() {
+			t.Fatal("consumer span must be a child of the publish span")
+		}
+		attributes := attribute.NewSet(span.Attributes()...)
+		for key, expected := range map[attribute.Key]attribute.Value{
+			attributeTopic:           attribute.StringValue(topic),
+			attributeConsumerGroup:   attribute.StringValue(DefaultConsumerGroupName),
+			attributeMessageOffset:   attribute.Int64Value(1),
+			attributeDeliveryAttempt: attribute.Int64Value(int64(i + 1)),
+		} {
+			if value, ok := attributes.Value(key); !ok || value != expected {
+				t.Fatalf("expected consumer span attribute %q to be %q, got %q", key, expected.Emit(), value.Emit())
+			}
+		}
+	}
+	if consumed[0].Status().Code != codes.Error {
+		t.Fatal("consumer span of a nacked message must have an error status")
+	}
+	if consumed[1].Status().Code == codes.Error {
+		t.Fatal("consumer span of an acknowledged message must not have an error status")
+	}
+}
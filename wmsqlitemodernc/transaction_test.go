@@ -20,8 +20,13 @@ func TestPublishingInTransaction(t *testing.T) {
 	if err := createTopicAndOffsetsTablesIfAbsent(
 		ctx,
 		db,
-		tg.Topic(topic),
-		tg.Offsets(topic),
+		DefaultSchemaAdapter{},
+		DefaultOffsetsAdapter{},
+		SchemaInitializingQueriesParams{
+			Topic:        topic,
+			TopicTable:   tg.Topic(topic),
+			OffsetsTable: tg.Offsets(topic),
+		},
 	); err != nil {
 		t.Fatal("unable to manually initialize tables:", err)
 	}
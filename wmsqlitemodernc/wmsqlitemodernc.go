@@ -40,15 +40,19 @@ type SQLiteConnection interface {
 // a topic table or for offsets table.
 type TableNameGenerator func(topic string) string
 
-// TableNameGenerators is a struct that holds two functions for generating topic and offsets table names.
+// TableNameGenerators is a struct that holds functions for generating topic, offsets, and deliveries table names.
 // A [Publisher] and a [Subscriber] must use identical generators for topic and offsets tables in order
 // to communicate with each other.
+//
+// Deliveries table tracks the state of individual messages per consumer group,
+// such as the number of delivery attempts. It is only created when a subscription requires it.
 type TableNameGenerators struct {
-	Topic   TableNameGenerator
-	Offsets TableNameGenerator
+	Topic      TableNameGenerator
+	Offsets    TableNameGenerator
+	Deliveries TableNameGenerator
 }
 
-// WithDefaultGeneratorsInsteadOfNils returns a TableNameGenerators with default generators for topic and offsets tables
+// WithDefaultGeneratorsInsteadOfNils returns a TableNameGenerators with default generators for topic, offsets, and deliveries tables
 // if they were left nil.
 func (t TableNameGenerators) WithDefaultGeneratorsInsteadOfNils() TableNameGenerators {
 	if t.Topic == nil {
@@ -61,5 +65,10 @@ func (t TableNameGenerators) WithDefaultGeneratorsInsteadOfNils() TableNameGener
 			return "watermill_offsets_" + topic
 		}
 	}
+	if t.Deliveries == nil {
+		t.Deliveries = func(topic string) string {
+			return "watermill_deliveries_" + topic
+		}
+	}
 	return t
 }
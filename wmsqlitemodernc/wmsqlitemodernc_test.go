@@ -1,6 +1,7 @@
 package wmsqlitemodernc
 
 import (
+	"context"
 	"database/sql"
 	"os"
 	"path/filepath"
@@ -28,6 +29,58 @@ func newTestConnection(t *testing.T, connectionDSN string) *sql.DB {
 	return db
 }
 
+// newTestContext returns a context that is canceled when the test ends.
+func newTestContext(t *testing.T) context.Context {
+	// TODO: replace with t.Context() after Watermill bumps to Golang 1.24
+	ctx, cancel := context.WithCancel(context.TODO())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newTestDSN returns the connection string of a new shared in-memory database.
+func newTestDSN() string {
+	return "file:" + uuid.New().String() + "?mode=memory&journal_mode=WAL&busy_timeout=1000&secure_delete=true&foreign_keys=true&cache=shared"
+}
+
+// newTestPublisher returns a publisher that initializes the schema.
+func newTestPublisher(t *testing.T, db SQLiteConnection, options PublisherOptions) message.Publisher {
+	t.Helper()
+	options.InitializeSchema = true
+	pub, err := NewPublisher(db, options)
+	if err != nil {
+		t.Fatal("unable to initialize publisher:", err)
+	}
+	return pub
+}
+
+// newTestSubscriber returns a subscriber that initializes the schema
+// and is closed when the test ends. Polls every 20 milliseconds by default.
+func newTestSubscriber(t *testing.T, db SQLiteDatabase, options SubscriberOptions) message.Subscriber {
+	t.Helper()
+	options.InitializeSchema = true
+	if options.PollInterval == 0 {
+		options.PollInterval = time.Millisecond * 20
+	}
+	sub, err := NewSubscriber(db, options)
+	if err != nil {
+		t.Fatal("unable to initialize subscriber:", err)
+	}
+	t.Cleanup(func() {
+		if err := sub.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return sub
+}
+
+// newTestPubSub returns a connection to a new in-memory database
+// with a publisher and a subscriber made by [newTestPublisher] and [newTestSubscriber].
+func newTestPubSub(t *testing.T, options SubscriberOptions) (*sql.DB, message.Publisher, message.Subscriber) {
+	t.Helper()
+	db := newTestConnection(t, newTestDSN())
+	return db, newTestPublisher(t, db, PublisherOptions{}), newTestSubscriber(t, db, options)
+}
+
 func NewPubSubFixture(connectionDSN string) tests.PubSubFixture {
 	return func(t *testing.T, consumerGroup string) (message.Publisher, message.Subscriber) {
 		publisherDB := newTestConnection(t, connectionDSN)
@@ -135,6 +188,18 @@ func BenchmarkAll(b *testing.B) {
 	if err != nil {
 		b.Fatal("unable to create test publisher", err)
 	}
+	unique, err := NewPublisher(db, PublisherOptions{
+		TableNameGenerators: TableNameGenerators{
+			Topic: func(topic string) string {
+				return "watermill_unique_" + topic
+			},
+		},
+		InitializeSchema:     true,
+		IgnoreDuplicateUUIDs: true,
+	})
+	if err != nil {
+		b.Fatal("unable to create test publisher", err)
+	}
 	sub, err := NewSubscriber(db, SubscriberOptions{
 		BatchSize:    700,
 		PollInterval: time.Millisecond * 10,
@@ -143,5 +208,41 @@ func BenchmarkAll(b *testing.B) {
 		b.Fatal("unable to create test subscriber", err)
 	}
 	b.Run("SQLite publishing to memory", tests.NewPublishingBenchmark(pub))
+	b.Run("SQLite publishing to memory with unique UUIDs", tests.NewPublishingBenchmark(unique))
 	b.Run("SQLite subscription from memory", tests.NewSubscriptionBenchmark(sub))
 }
+
+func BenchmarkBatchingPublisher(b *testing.B) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(b.TempDir(), uuid.New().String()+".sqlite3")+"?journal_mode=WAL&busy_timeout=5000&secure_delete=true&foreign_keys=true&cache=shared")
+	if err != nil {
+		b.Fatal("unable to create test SQLite connetion", err)
+	}
+	db.SetMaxOpenConns(1)
+	b.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			b.Fatal("unable to close test SQLite connetion", err)
+		}
+	})
+
+	pub, err := NewPublisher(db, PublisherOptions{
+		InitializeSchema: true,
+	})
+	if err != nil {
+		b.Fatal("unable to create test publisher", err)
+	}
+	batched, err := NewBatchingPublisher(db, BatchingPublisherOptions{
+		PublisherOptions: PublisherOptions{
+			InitializeSchema: true,
+		},
+	})
+	if err != nil {
+		b.Fatal("unable to create test batching publisher", err)
+	}
+	b.Cleanup(func() {
+		if err := batched.Close(); err != nil {
+			b.Fatal("unable to close test batching publisher", err)
+		}
+	})
+	b.Run("SQLite concurrent publishing to file", tests.NewConcurrentPublishingBenchmark(pub))
+	b.Run("SQLite concurrent batched publishing to file", tests.NewConcurrentPublishingBenchmark(batched))
+}
@@ -0,0 +1,63 @@
+package wmsqlitezombiezen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type strictSchemaAdapter struct {
+	DefaultSchemaAdapter
+}
+
+func (a strictSchemaAdapter) SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string {
+	return []string{`CREATE TABLE IF NOT EXISTS '` + params.TopicTable + `' (
+		'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		metadata BLOB NOT NULL,
+		deliver_at INTEGER NOT NULL DEFAULT 0
+	) STRICT;`}
+}
+
+func TestSchemaAdapter(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{
+		SchemaAdapter: strictSchemaAdapter{},
+	})
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		SchemaAdapter: strictSchemaAdapter{},
+	})
+
+	topic := "TestSchemaAdapter"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+		if msg.UUID != "1" {
+			t.Fatalf("expected message %q, got %q", "1", msg.UUID)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("message was not delivered")
+	}
+
+	strict, err := sqlitex.ResultBool(conn.Prep(`SELECT strict FROM pragma_table_list WHERE name='watermill_` + topic + `';`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strict {
+		t.Fatal("topic table was not created by the schema adapter")
+	}
+}
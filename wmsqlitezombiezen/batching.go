@@ -0,0 +1,199 @@
+package wmsqlitezombiezen
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BatchingPublisherOptions configure the publisher that coalesces concurrent publishing into group commits.
+type BatchingPublisherOptions struct {
+	PublisherOptions
+
+	// Window is the time the publisher waits for more concurrent publishing
+	// after the first message of a batch arrives. Longer windows commit larger batches
+	// at the cost of publishing latency. Default value is one millisecond.
+	Window time.Duration
+
+	// MaxMessages commits the batch without waiting for the window to close
+	// once it holds this many messages. Default value is 256.
+	MaxMessages int
+}
+
+type publishRequest struct {
+	topic    string
+	messages message.Messages
+	result   chan error
+}
+
+// BatchingPublisher collects messages from concurrent publishing calls and writes them
+// in one transaction with a multi-row insert per topic. Each transaction commit
+// costs a file synchronization, which dominates publishing time when many goroutines
+// publish single messages. Each call returns once the transaction with its messages is committed.
+type BatchingPublisher struct {
+	publisher   *publisher
+	window      time.Duration
+	maxMessages int
+
+	requests  chan publishRequest
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBatchingPublisher creates a [message.Publisher] that coalesces concurrent publishing into group commits.
+// The publisher owns the connection until it is closed, because the connection cannot be used concurrently.
+func NewBatchingPublisher(conn *sqlite.Conn, options BatchingPublisherOptions) (*BatchingPublisher, error) {
+	if conn == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	if options.Window < 0 {
+		return nil, errors.New("Window must not be negative")
+	}
+	if options.MaxMessages < 0 {
+		return nil, errors.New("MaxMessages must not be negative")
+	}
+	pub, err := newPublisher(options.PublisherOptions)
+	if err != nil {
+		return nil, err
+	}
+	pub.connection = conn
+	p := &BatchingPublisher{
+		publisher:   pub,
+		window:      cmpOrTODO(options.Window, time.Millisecond),
+		maxMessages: cmpOrTODO(options.MaxMessages, 256),
+		requests:    make(chan publishRequest),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go p.loop()
+	return p, nil
+}
+
+// Publish pushes messages into a topic with the next group commit.
+// Returns [ErrPublisherIsClosed] if the publisher is closed.
+func (p *BatchingPublisher) Publish(topic string, messages ...*message.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	request := publishRequest{
+		topic:    topic,
+		messages: messages,
+		result:   make(chan error, 1),
+	}
+	select {
+	case <-p.closed:
+		return ErrPublisherIsClosed
+	case p.requests <- request:
+		return <-request.result
+	}
+}
+
+func (p *BatchingPublisher) loop() {
+	defer close(p.done)
+	timer := time.NewTimer(p.window)
+	timer.Stop()
+
+	for {
+		var batch []publishRequest
+		select {
+		case <-p.closed:
+			return
+		case request := <-p.requests:
+			batch = append(batch, request)
+		}
+
+		size := len(batch[0].messages)
+		timer.Reset(p.window)
+	collect:
+		for size < p.maxMessages {
+			select {
+			case <-p.closed:
+				break collect
+			case <-timer.C:
+				break collect
+			case request := <-p.requests:
+				batch = append(batch, request)
+				size += len(request.messages)
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		p.commit(batch)
+	}
+}
+
+// commit writes the batch in one transaction. If the transaction fails,
+// each request is published separately, so that one bad request
+// does not fail the publishing calls that were batched together with it.
+func (p *BatchingPublisher) commit(batch []publishRequest) {
+	err := p.commitTogether(batch)
+	if err == nil || len(batch) == 1 {
+		for _, request := range batch {
+			request.result <- err
+		}
+		return
+	}
+	p.publisher.Logger.Error("Unable to commit batched messages, publishing them separately", err, watermill.LogFields{
+		"requests": len(batch),
+	})
+	for _, request := range batch {
+		request.result <- p.publisher.Publish(request.topic, request.messages...)
+	}
+}
+
+func (p *BatchingPublisher) commitTogether(batch []publishRequest) (err error) {
+	conn := p.publisher.connection
+	topics := make([]string, 0, 1)
+	messages := make(map[string]message.Messages)
+	for _, request := range batch {
+		if _, ok := messages[request.topic]; !ok {
+			topics = append(topics, request.topic)
+			if err = p.publisher.initializeSchema(conn, request.topic, p.publisher.TopicTableNameGenerator(request.topic)); err != nil {
+				return err
+			}
+		}
+		messages[request.topic] = append(messages[request.topic], request.messages...)
+	}
+
+	if err = p.insertTogether(conn, topics, messages); err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		published.Notify(p.publisher.TopicTableNameGenerator(topic))
+	}
+	return nil
+}
+
+func (p *BatchingPublisher) insertTogether(conn *sqlite.Conn, topics []string, messages map[string]message.Messages) (err error) {
+	defer sqlitex.Transaction(conn)(&err)
+	for _, topic := range topics {
+		if err = p.publisher.insert(conn, topic, messages[topic]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops batching after committing the messages that are already collected.
+// The connection remains open, because it belongs to the caller.
+func (p *BatchingPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		<-p.done
+	})
+	return p.publisher.Close()
+}
+
+func (p *BatchingPublisher) String() string {
+	return "sqlite3-zombiezen-batching-publisher-" + p.publisher.UUID
+}
@@ -0,0 +1,213 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// CleanUpOptions configure [CleanUpTopics] and [StartCleanUpRoutine].
+//
+// Messages that were acknowledged by every consumer group of a topic
+// are always removed. MaxAge and MaxRows add a retention policy which
+// removes messages even if some consumer groups did not acknowledge them yet.
+type CleanUpOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// Topics limits the clean up to the listed topics. If empty,
+	// topics are discovered by matching SQLite table names against TableNameGenerators.
+	// Discovery only works for generators that prefix or suffix the topic name.
+	Topics []string
+
+	// MaxAge removes messages published earlier than the given duration ago.
+	// Zero value disables the age limit.
+	MaxAge time.Duration
+
+	// MaxRows keeps at most the given number of latest messages in each topic table.
+	// Zero value disables the row count limit.
+	MaxRows int64
+
+	// Interval is the time between clean ups performed by [StartCleanUpRoutine].
+	// Defaults to one minute.
+	Interval time.Duration
+
+	// Logger tracks any problems that might emerge when cleaning up topics
+	// in the background. Defaults to [watermill.NopLogger].
+	Logger watermill.LoggerAdapter
+}
+
+func (o CleanUpOptions) validate() error {
+	if o.MaxAge < 0 {
+		return errors.New("MaxAge must not be negative")
+	}
+	if o.MaxRows < 0 {
+		return errors.New("MaxRows must not be negative")
+	}
+	if o.Interval < 0 {
+		return errors.New("Interval must not be negative")
+	}
+	if o.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils().sharesTables() {
+		return ErrSingleTableStorageIsNotSupported
+	}
+	for _, topic := range o.Topics {
+		if err := validateTopicName(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanUpTopics removes messages from topic tables once every consumer group
+// in the matching offsets table acknowledged them. Applies the retention
+// policy set by MaxAge and MaxRows [CleanUpOptions]. Deliveries of removed messages
+// are deleted in the same transaction. Returns the number of removed messages.
+func CleanUpTopics(conn *sqlite.Conn, options CleanUpOptions) (removed int64, err error) {
+	if conn == nil {
+		return 0, ErrDatabaseConnectionIsNil
+	}
+	if err = options.validate(); err != nil {
+		return 0, err
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	topics := options.Topics
+	if len(topics) == 0 {
+		if topics, err = findTopics(conn, tng); err != nil {
+			return 0, err
+		}
+	}
+
+	var cutOff int64
+	if options.MaxAge > 0 {
+		cutOff = time.Now().Add(-options.MaxAge).Unix()
+	}
+	for _, topic := range topics {
+		affected, err := cleanUpTopic(conn, tng, topic, cutOff, options.MaxRows)
+		if err != nil {
+			return removed, err
+		}
+		removed += affected
+	}
+	return removed, nil
+}
+
+// cleanUpTopic removes messages from a topic table together with their deliveries in one savepoint.
+func cleanUpTopic(
+	conn *sqlite.Conn,
+	tng TableNameGenerators,
+	topic string,
+	cutOff int64,
+	maxRows int64,
+) (removed int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	topicTable := tng.Topic(topic)
+	query, args := cleanUpQuery(topicTable, tng.Offsets(topic), cutOff, maxRows)
+	if err = sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+	}); err != nil {
+		return 0, fmt.Errorf("unable to clean up topic %q: %w", topic, err)
+	}
+	removed = int64(conn.Changes())
+
+	deliveriesTable := tng.Deliveries(topic)
+	present, err := tableExists(conn, deliveriesTable)
+	if err != nil {
+		return 0, err
+	}
+	if present {
+		if err = sqlitex.ExecuteTransient(conn, forgetRemovedDeliveriesQuery(topicTable, deliveriesTable), nil); err != nil {
+			return 0, fmt.Errorf("unable to clean up deliveries of topic %q: %w", topic, err)
+		}
+	}
+	return removed, nil
+}
+
+// StartCleanUpRoutine runs [CleanUpTopics] periodically in a context-bound background routine.
+// The routine opens its own connection, which is closed when the context is done.
+// Returns an error if the options are invalid or the connection cannot be opened.
+func StartCleanUpRoutine(ctx context.Context, connectionDSN string, options CleanUpOptions) error {
+	if ctx == nil {
+		return errors.New("context is nil")
+	}
+	if connectionDSN == "" {
+		return errors.New("database connection DSN is empty")
+	}
+	if strings.Contains(connectionDSN, ":memory:") {
+		return errors.New(`sqlite: ":memory:" does not work with multiple connections, use "file::memory:?mode=memory&cache=shared`)
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if options.Interval == 0 {
+		options.Interval = time.Minute
+	}
+	if options.Logger == nil {
+		options.Logger = defaultLogger
+	}
+
+	conn, err := sqlite.OpenConn(connectionDSN)
+	if err != nil {
+		return err
+	}
+	conn.SetInterrupt(ctx.Done())
+
+	go func(ctx context.Context, ticker *time.Ticker, logger watermill.LoggerAdapter) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := conn.Close(); err != nil {
+					logger.Error("failed to close SQLite clean up connection", err, nil)
+				}
+				return
+			case <-ticker.C:
+				removed, err := CleanUpTopics(conn, options)
+				if err != nil {
+					if !isInterrupt(err) {
+						logger.Error("failed to clean up SQLite topic tables", err, nil)
+					}
+				} else {
+					logger.Debug("cleaned up SQLite topic tables", watermill.LogFields{
+						"removed": removed,
+					})
+				}
+			}
+		}
+	}(ctx, time.NewTicker(options.Interval), options.Logger)
+	return nil
+}
+
+func cleanUpQuery(messagesTableName, offsetsTableName string, cutOff int64, maxRows int64) (query string, args []any) {
+	b := strings.Builder{}
+	_, _ = b.WriteString(`DELETE FROM '`)
+	_, _ = b.WriteString(messagesTableName)
+	_, _ = b.WriteString(`' WHERE "offset"<=(SELECT MIN(offset_acked) FROM '`)
+	_, _ = b.WriteString(offsetsTableName)
+	_, _ = b.WriteString(`')`)
+	if cutOff > 0 {
+		_, _ = b.WriteString(` OR unixepoch(created_at)<?`)
+		args = append(args, cutOff)
+	}
+	if maxRows > 0 {
+		_, _ = b.WriteString(` OR "offset"<=(SELECT "offset" FROM '`)
+		_, _ = b.WriteString(messagesTableName)
+		_, _ = b.WriteString(`' ORDER BY "offset" DESC LIMIT 1 OFFSET ?)`)
+		args = append(args, maxRows)
+	}
+	_, _ = b.WriteString(`;`)
+	return b.String(), args
+}
+
+// forgetRemovedDeliveriesQuery deletes deliveries of messages that are no longer in the topic table.
+func forgetRemovedDeliveriesQuery(messagesTableName, deliveriesTableName string) string {
+	return `DELETE FROM '` + deliveriesTableName + `' WHERE "offset" NOT IN (SELECT "offset" FROM '` + messagesTableName + `');`
+}
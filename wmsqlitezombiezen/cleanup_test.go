@@ -0,0 +1,122 @@
+package wmsqlitezombiezen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestCleanUpTopics(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+
+	topic := "TestCleanUpTopics"
+	for i := 0; i < 10; i++ {
+		if err := pub.Publish(topic, message.NewMessage(uuid.New().String(), []byte("payload"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tng := TableNameGenerators{}.WithDefaultGeneratorsInsteadOfNils()
+	if err := sqlitex.ExecuteTransient(conn, `INSERT INTO '`+tng.Offsets(topic)+`' (consumer_group, offset_acked, locked_until) VALUES ('first', 4, 0), ('second', 7, 0);`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range (DefaultOffsetsAdapter{}).SchemaInitializingQueries(SchemaInitializingQueriesParams{
+		Topic:           topic,
+		TopicTable:      tng.Topic(topic),
+		OffsetsTable:    tng.Offsets(topic),
+		DeliveriesTable: tng.Deliveries(topic),
+	}) {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sqlitex.ExecuteTransient(conn, `INSERT INTO '`+tng.Deliveries(topic)+`' (consumer_group, "offset", attempts) SELECT 'first', "offset", 1 FROM '`+tng.Topic(topic)+`';`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(t *testing.T, table string) int {
+		t.Helper()
+		count, err := sqlitex.ResultInt(conn.Prep(`SELECT COUNT(*) FROM '` + table + `';`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	countMessages := func(t *testing.T, expected int) {
+		t.Helper()
+		if count := count(t, tng.Topic(topic)); count != expected {
+			t.Fatalf("expected %d messages to remain, got %d", expected, count)
+		}
+		if count := count(t, tng.Deliveries(topic)); count != expected {
+			t.Fatalf("expected %d deliveries to remain, got %d", expected, count)
+		}
+	}
+
+	t.Run("remove messages acknowledged by every consumer group", func(t *testing.T) {
+		removed, err := CleanUpTopics(conn, CleanUpOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 4 {
+			t.Fatalf("expected 4 removed messages, got %d", removed)
+		}
+		countMessages(t, 6)
+	})
+
+	t.Run("keep latest messages", func(t *testing.T) {
+		removed, err := CleanUpTopics(conn, CleanUpOptions{
+			Topics:  []string{topic},
+			MaxRows: 4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 2 {
+			t.Fatalf("expected 2 removed messages, got %d", removed)
+		}
+		countMessages(t, 4)
+	})
+
+	t.Run("remove expired messages", func(t *testing.T) {
+		if err := sqlitex.Execute(conn, `UPDATE '`+tng.Topic(topic)+`' SET created_at=? WHERE "offset"=7;`, &sqlitex.ExecOptions{
+			Args: []any{time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		removed, err := CleanUpTopics(conn, CleanUpOptions{
+			MaxAge: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 1 {
+			t.Fatalf("expected 1 removed message, got %d", removed)
+		}
+		countMessages(t, 3)
+	})
+
+	t.Run("background routine", func(t *testing.T) {
+		if err := StartCleanUpRoutine(ctx, DSN, CleanUpOptions{
+			Interval: time.Millisecond * 10,
+			MaxRows:  1,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for count(t, tng.Topic(topic)) > 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("background routine did not clean up the topic in time")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		countMessages(t, 1)
+	})
+}
@@ -0,0 +1,179 @@
+package wmsqlitezombiezen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetadataKeyPayloadCodec is the reserved metadata key that names the [PayloadCodec]
+// of a compressed payload. Publishers set it when they compress a payload.
+// Subscribers remove it after decoding the payload.
+const MetadataKeyPayloadCodec = "sqlite_payload_codec"
+
+// PayloadCodec compresses message payloads before they are inserted into topic tables.
+type PayloadCodec interface {
+	// Name identifies the codec in the [MetadataKeyPayloadCodec] metadata value.
+	Name() string
+	Encode(payload []byte) ([]byte, error)
+	Decode(payload []byte) ([]byte, error)
+}
+
+// GzipPayloadCodec compresses payloads using the gzip format.
+type GzipPayloadCodec struct {
+	// Level is a compression level from [gzip.BestSpeed] to [gzip.BestCompression].
+	// Default value is [gzip.DefaultCompression].
+	Level int
+}
+
+// Name satisfies the [PayloadCodec] interface.
+func (c GzipPayloadCodec) Name() string {
+	return "gzip"
+}
+
+// Encode satisfies the [PayloadCodec] interface.
+func (c GzipPayloadCodec) Encode(payload []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(b, cmpOrTODO(c.Level, gzip.DefaultCompression))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decode satisfies the [PayloadCodec] interface.
+func (c GzipPayloadCodec) Decode(payload []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// ZstdPayloadCodec compresses payloads using the Zstandard format.
+// It is faster than [GzipPayloadCodec] at a similar compression ratio.
+type ZstdPayloadCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdPayloadCodec creates a [PayloadCodec] with a reusable Zstandard encoder and decoder.
+// Options tune the encoder, such as [zstd.WithEncoderLevel].
+func NewZstdPayloadCodec(options ...zstd.EOption) (*ZstdPayloadCodec, error) {
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create zstd encoder: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create zstd decoder: %w", err)
+	}
+	return &ZstdPayloadCodec{
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+// Name satisfies the [PayloadCodec] interface.
+func (c *ZstdPayloadCodec) Name() string {
+	return "zstd"
+}
+
+// Encode satisfies the [PayloadCodec] interface.
+func (c *ZstdPayloadCodec) Encode(payload []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(payload, nil), nil
+}
+
+// Decode satisfies the [PayloadCodec] interface.
+func (c *ZstdPayloadCodec) Decode(payload []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(payload, nil)
+}
+
+var defaultZstdPayloadCodec = sync.OnceValues(func() (*ZstdPayloadCodec, error) {
+	return NewZstdPayloadCodec()
+})
+
+// PayloadCodecByName returns the built-in [GzipPayloadCodec] or [ZstdPayloadCodec]
+// that matches the [MetadataKeyPayloadCodec] metadata value.
+func PayloadCodecByName(name string) (PayloadCodec, error) {
+	switch name {
+	case "gzip":
+		return GzipPayloadCodec{}, nil
+	case "zstd":
+		codec, err := defaultZstdPayloadCodec()
+		if err != nil {
+			return nil, err
+		}
+		return codec, nil
+	default:
+		return nil, fmt.Errorf("unknown payload codec %q", name)
+	}
+}
+
+// encodePayloads compresses payloads of at least threshold bytes.
+// Compressed messages are copies, so that the caller's messages
+// are not changed. Payloads that do not shrink are left as they are.
+func encodePayloads(codec PayloadCodec, threshold int, messages message.Messages) (message.Messages, error) {
+	if codec == nil {
+		return messages, nil
+	}
+	var encoded message.Messages
+	for i, msg := range messages {
+		if len(msg.Payload) < threshold || msg.Metadata.Get(MetadataKeyPayloadCodec) != "" {
+			continue
+		}
+		payload, err := codec.Encode(msg.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode message %q payload: %w", msg.UUID, err)
+		}
+		if len(payload) >= len(msg.Payload) {
+			continue
+		}
+		if encoded == nil {
+			encoded = append(make(message.Messages, 0, len(messages)), messages...)
+		}
+		compressed := message.NewMessage(msg.UUID, payload)
+		for key, value := range msg.Metadata {
+			compressed.Metadata.Set(key, value)
+		}
+		compressed.Metadata.Set(MetadataKeyPayloadCodec, codec.Name())
+		encoded[i] = compressed
+	}
+	if encoded == nil {
+		return messages, nil
+	}
+	return encoded, nil
+}
+
+// decodePayload decompresses the payload of a message that names its codec in metadata.
+// Payloads of messages without the codec name are left as they are.
+func decodePayload(codec PayloadCodec, next *rawMessage) error {
+	name := next.Metadata.Get(MetadataKeyPayloadCodec)
+	if name == "" {
+		return nil
+	}
+	if codec == nil || codec.Name() != name {
+		var err error
+		if codec, err = PayloadCodecByName(name); err != nil {
+			return fmt.Errorf("unable to decode message %q payload: %w", next.UUID, err)
+		}
+	}
+	payload, err := codec.Decode(next.Payload)
+	if err != nil {
+		return fmt.Errorf("unable to decode message %q payload: %w", next.UUID, err)
+	}
+	next.Payload = payload
+	delete(next.Metadata, MetadataKeyPayloadCodec)
+	return nil
+}
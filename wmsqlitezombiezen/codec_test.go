@@ -0,0 +1,130 @@
+package wmsqlitezombiezen
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestPayloadCodec(t *testing.T) {
+	zstdCodec, err := NewZstdPayloadCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte(`{"key":"value"},`), 1000)
+
+	for _, codec := range []PayloadCodec{GzipPayloadCodec{}, zstdCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			ctx := newTestContext(t)
+
+			DSN := newTestDSN()
+			conn := newTestConnection(t, DSN)
+			legacy := newTestPublisher(t, conn, PublisherOptions{})
+			pub := newTestPublisher(t, conn, PublisherOptions{
+				PayloadCodec: codec,
+			})
+			sub := newTestSubscriber(t, DSN, SubscriberOptions{})
+
+			topic := "TestPayloadCodec"
+			if err = legacy.Publish(topic, message.NewMessage("legacy", large)); err != nil {
+				t.Fatal(err)
+			}
+			compressed := message.NewMessage("compressed", large)
+			if err = pub.Publish(topic, compressed, message.NewMessage("small", []byte("small"))); err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Metadata.Get(MetadataKeyPayloadCodec) != "" {
+				t.Fatal("publisher must not change metadata of the published message")
+			}
+
+			stored := make(map[string]int)
+			if err = sqlitex.ExecuteTransient(conn, `SELECT uuid, LENGTH(payload) FROM 'watermill_`+topic+`';`, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					stored[stmt.ColumnText(0)] = stmt.ColumnInt(1)
+					return nil
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if stored["compressed"] >= len(large) {
+				t.Fatalf("expected compressed payload to be smaller than %d bytes, got %d", len(large), stored["compressed"])
+			}
+			if stored["legacy"] != len(large) || stored["small"] != len("small") {
+				t.Fatalf("payloads below threshold and legacy payloads must be stored as they are: %v", stored)
+			}
+
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range []*message.Message{
+				message.NewMessage("legacy", large),
+				message.NewMessage("compressed", large),
+				message.NewMessage("small", []byte("small")),
+			} {
+				select {
+				case msg := <-messages:
+					if msg.UUID != expected.UUID {
+						t.Fatalf("expected message %q, got %q", expected.UUID, msg.UUID)
+					}
+					if !bytes.Equal(msg.Payload, expected.Payload) {
+						t.Fatalf("message %q payload was not decoded", msg.UUID)
+					}
+					if msg.Metadata.Get(MetadataKeyPayloadCodec) != "" {
+						t.Fatalf("message %q metadata must not name the codec after decoding", msg.UUID)
+					}
+					msg.Ack()
+				case <-time.After(time.Second * 3):
+					t.Fatalf("message %q was not delivered", expected.UUID)
+				}
+			}
+		})
+	}
+}
+
+func TestUndecodablePayload(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	topic := "TestUndecodablePayload"
+	unknown := message.NewMessage("unknown", []byte("unknown"))
+	unknown.Metadata.Set(MetadataKeyPayloadCodec, "unknown")
+	corrupt := message.NewMessage("corrupt", []byte("corrupt"))
+	corrupt.Metadata.Set(MetadataKeyPayloadCodec, GzipPayloadCodec{}.Name())
+	if err := pub.Publish(topic, unknown, corrupt, message.NewMessage("readable", []byte("readable"))); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		MaxDeliveryAttempts: 2,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.UUID != "readable" {
+			t.Fatalf("expected message %q, got %q", "readable", msg.UUID)
+		}
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("undecodable payloads held back the consumer group")
+	}
+
+	stmt := conn.Prep(`SELECT COUNT(*) FROM 'watermill_` + DefaultDeadLetterTopic(topic) + `' WHERE json_extract(metadata, '$.` + MetadataKeyDeadLetterReason + `')=?;`)
+	stmt.BindText(1, deadLetterReasonUnreadable)
+	count, err := sqlitex.ResultInt(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected two dead-lettered messages, got %d", count)
+	}
+}
@@ -0,0 +1,75 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type connContextKey struct{}
+
+// ConnFromContext returns the subscription connection of a message delivered
+// by a subscriber with [SubscriberOptions.ConsumeInTransaction] enabled.
+// The connection has an open savepoint, so handler writes made through it
+// are committed together with the message acknowledgement. The handler may
+// nest its own savepoints, but must not commit or roll back the outer one,
+// and must acknowledge or reject the message once it stops using the connection.
+func ConnFromContext(ctx context.Context) (conn *sqlite.Conn, ok bool) {
+	conn, ok = ctx.Value(connContextKey{}).(*sqlite.Conn)
+	return conn, ok
+}
+
+var errDeliveryRolledBack = errors.New("message was not acknowledged")
+
+// BeginDelivery opens the savepoint passed to the message handler.
+// The message is acknowledged first, so the savepoint holds
+// the database write lock until it is released or rolled back.
+func (s *subscription) BeginDelivery(offset int64) (release func(*error), err error) {
+	release = sqlitex.Save(s.Connection)
+	if s.acknowledgesDeliveries {
+		err = s.Acknowledge(offset)
+	} else {
+		err = s.extendLock(offset, s.lockedOffset)
+	}
+	if err != nil {
+		release(&err)
+		return nil, fmt.Errorf("unable to acknowledge message within savepoint: %w", err)
+	}
+	return release, nil
+}
+
+// CommitDelivery refreshes the consumer group lock, which could have expired
+// while the handler was running, and releases the savepoint along with the acknowledgement.
+func (s *subscription) CommitDelivery(release func(*error), offset int64) (err error) {
+	if !s.messageLeases {
+		lastAckedOffset, lockedOffset := s.lastAckedOffset, s.lockedOffset
+		if !s.acknowledgesDeliveries {
+			lastAckedOffset, lockedOffset = offset, offset
+		}
+		// the offset is still valid if the lock was lost, because no one could write while the savepoint was open
+		if err = s.extendLock(lastAckedOffset, lockedOffset); err != nil && !errors.Is(err, errLockLost) {
+			release(&err)
+			return fmt.Errorf("unable to extend lock: %w", err)
+		}
+		err = nil
+	}
+	release(&err)
+	if err != nil {
+		return fmt.Errorf("unable to release message savepoint: %w", err)
+	}
+	s.resetLockTicker()
+	if !s.acknowledgesDeliveries {
+		s.lastAckedOffset = offset
+		s.lockedOffset = offset
+	}
+	return nil
+}
+
+// RollbackDelivery discards handler writes along with the acknowledgement.
+func (s *subscription) RollbackDelivery(release func(*error)) {
+	err := errDeliveryRolledBack
+	release(&err)
+}
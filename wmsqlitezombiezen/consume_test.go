@@ -0,0 +1,179 @@
+package wmsqlitezombiezen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestConsumeInTransaction(t *testing.T) {
+	for name, options := range map[string]SubscriberOptions{
+		"consumer group lock": {},
+		"message leases":      {MessageLeases: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := newTestContext(t)
+
+			DSN := newTestDSN()
+			conn := newTestConnection(t, DSN)
+			if err := sqlitex.ExecuteTransient(conn, `CREATE TABLE processed (uuid TEXT NOT NULL);`, nil); err != nil {
+				t.Fatal(err)
+			}
+			pub := newTestPublisher(t, conn, PublisherOptions{})
+			options.PollInterval = time.Millisecond * 20
+			options.InitializeSchema = true
+			options.ConsumeInTransaction = true
+			sub, err := NewSubscriber(DSN, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := sub.Close(); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			topic := "TestConsumeInTransaction"
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = pub.Publish(topic, message.NewMessage("1", []byte{}), message.NewMessage("2", []byte{})); err != nil {
+				t.Fatal(err)
+			}
+
+			nacked := false
+			for acked := 0; acked < 2; {
+				select {
+				case msg := <-messages:
+					handlerConn, ok := ConnFromContext(msg.Context())
+					if !ok {
+						t.Fatal("message context does not carry a connection")
+					}
+					if err = sqlitex.Execute(handlerConn, `INSERT INTO processed (uuid) VALUES (?);`, &sqlitex.ExecOptions{
+						Args: []any{msg.UUID},
+					}); err != nil {
+						t.Fatal(err)
+					}
+					if !nacked {
+						nacked = msg.Nack() // rolls back the insert
+						continue
+					}
+					msg.Ack()
+					acked++
+				case <-time.After(time.Second * 3):
+					t.Fatal("message was not delivered")
+				}
+			}
+
+			inspector, err := NewInspector(conn, InspectorOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(time.Second * 3)
+			for {
+				state, err := inspector.Inspect(topic)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(state.ConsumerGroups) == 1 && state.ConsumerGroups[0].OffsetAcked == 2 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("consumer group offset did not advance: %+v", state.ConsumerGroups)
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+
+			processed, err := sqlitex.ResultInt64(conn.Prep(`SELECT COUNT(*) FROM processed;`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if processed != 2 {
+				t.Fatalf("expected each message to be processed once, got %d processed rows", processed)
+			}
+		})
+	}
+}
+
+func TestConsumeInTransactionPastDeadline(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	if err := sqlitex.ExecuteTransient(conn, `CREATE TABLE processed (uuid TEXT NOT NULL);`, nil); err != nil {
+		t.Fatal(err)
+	}
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	deadline := time.Millisecond * 100
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		AckDeadline:          &deadline,
+		LockTimeout:          time.Millisecond * 300,
+		ConsumeInTransaction: true,
+	})
+
+	topic := "TestConsumeInTransactionPastDeadline"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("1", []byte{})); err != nil {
+		t.Fatal(err)
+	}
+
+	process := func(t *testing.T, duration time.Duration) {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			handlerConn, ok := ConnFromContext(msg.Context())
+			if !ok {
+				t.Fatal("message context does not carry a connection")
+			}
+			// the subscription must leave the connection alone
+			// past the deadline and the lock timeout
+			for started := time.Now(); ; time.Sleep(time.Millisecond * 50) {
+				if err := sqlitex.Execute(handlerConn, `INSERT INTO processed (uuid) VALUES (?);`, &sqlitex.ExecOptions{
+					Args: []any{msg.UUID},
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if time.Since(started) >= duration {
+					break
+				}
+			}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatal("message was not delivered")
+		}
+	}
+	process(t, deadline*6) // rolled back, because the deadline passed
+	process(t, 0)
+
+	inspector, err := NewInspector(conn, InspectorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := time.Now().Add(time.Second * 3)
+	for {
+		state, err := inspector.Inspect(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.ConsumerGroups) == 1 && state.ConsumerGroups[0].OffsetAcked == 1 {
+			break
+		}
+		if time.Now().After(wait) {
+			t.Fatalf("consumer group offset did not advance: %+v", state.ConsumerGroups)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	processed, err := sqlitex.ResultInt64(conn.Prep(`SELECT COUNT(*) FROM processed;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != 1 {
+		t.Fatalf("expected writes of the late handler to be rolled back, got %d processed rows", processed)
+	}
+}
@@ -0,0 +1,50 @@
+package wmsqlitezombiezen
+
+import (
+	"strconv"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// MetadataKeyDeadLetterReason is the metadata key of a dead-lettered message
+	// that holds the last reason its delivery failed.
+	MetadataKeyDeadLetterReason = "dead_letter_reason"
+
+	// MetadataKeyDeadLetterTopic is the metadata key of a dead-lettered message
+	// that holds the topic it was originally published to.
+	MetadataKeyDeadLetterTopic = "dead_letter_topic"
+
+	// MetadataKeyDeadLetterConsumerGroup is the metadata key of a dead-lettered message
+	// that holds the consumer group which failed to process it.
+	MetadataKeyDeadLetterConsumerGroup = "dead_letter_consumer_group"
+
+	// MetadataKeyDeadLetterAttempts is the metadata key of a dead-lettered message
+	// that holds the number of its delivery attempts.
+	MetadataKeyDeadLetterAttempts = "dead_letter_attempts"
+)
+
+const (
+	deadLetterReasonNacked           = "message was nacked"
+	deadLetterReasonDeadlineExceeded = "message acknowledgement deadline exceeded"
+	deadLetterReasonExhausted        = "delivery attempts exhausted without acknowledgement"
+	deadLetterReasonUnreadable       = "message could not be decrypted or decoded"
+)
+
+// DefaultDeadLetterTopic names the dead-letter topic by adding
+// ".dead_letter" suffix to the original topic name.
+func DefaultDeadLetterTopic(topic string) string {
+	return topic + ".dead_letter"
+}
+
+func deadLetterMetadata(original message.Metadata, topic, consumerGroup string, attempts int64, reason string) message.Metadata {
+	metadata := make(message.Metadata, len(original)+4)
+	for key, value := range original {
+		metadata[key] = value
+	}
+	metadata[MetadataKeyDeadLetterReason] = reason
+	metadata[MetadataKeyDeadLetterTopic] = topic
+	metadata[MetadataKeyDeadLetterConsumerGroup] = consumerGroup
+	metadata[MetadataKeyDeadLetterAttempts] = strconv.FormatInt(attempts, 10)
+	return metadata
+}
@@ -0,0 +1,200 @@
+package wmsqlitezombiezen
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// MetadataKeyEncryptionKeyID is the reserved metadata key that holds the ID of the key
+	// that encrypted the data key of a message. The payload and the rest of the metadata
+	// are encrypted with the data key. Subscribers replace the encrypted metadata
+	// with the decrypted one, so handlers never see the value.
+	MetadataKeyEncryptionKeyID = "sqlite_key_id"
+
+	metadataKeyDataKey           = "sqlite_data_key"
+	metadataKeyEncryptedMetadata = "sqlite_metadata"
+)
+
+// KeyProvider supplies AES keys of 16, 24, or 32 bytes for envelope encryption.
+// Each message is encrypted with its own random data key,
+// which is encrypted by the key identified in [MetadataKeyEncryptionKeyID] metadata.
+type KeyProvider interface {
+	// CurrentKey returns the key that encrypts data keys of newly published messages.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key that encrypted data keys of stored messages.
+	// Keep providing rotated keys until [ReEncryptTopics] rewrites every row that uses them.
+	Key(id string) (key []byte, err error)
+}
+
+// KeyRing is a [KeyProvider] that holds keys in memory.
+type KeyRing struct {
+	// CurrentKeyID identifies the key that encrypts newly published messages.
+	CurrentKeyID string
+
+	// Keys are indexed by their IDs. Must contain the current key.
+	Keys map[string][]byte
+}
+
+// CurrentKey satisfies the [KeyProvider] interface.
+func (r KeyRing) CurrentKey() (id string, key []byte, err error) {
+	key, err = r.Key(r.CurrentKeyID)
+	return r.CurrentKeyID, key, err
+}
+
+// Key satisfies the [KeyProvider] interface.
+func (r KeyRing) Key(id string) (key []byte, err error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not in the key ring", id)
+	}
+	return key, nil
+}
+
+// encryptMessages encrypts copies of messages, so that the caller's messages are not changed.
+// The delivery time stays readable, because subscribers select messages by it.
+func encryptMessages(keys KeyProvider, messages message.Messages) (message.Messages, error) {
+	if keys == nil {
+		return messages, nil
+	}
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current encryption key: %w", err)
+	}
+	encrypted := make(message.Messages, len(messages))
+	for i, msg := range messages {
+		if encrypted[i], err = encryptMessage(keyID, key, msg); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+func encryptMessage(keyID string, key []byte, msg *message.Message) (*message.Message, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode message %q metadata to JSON: %w", msg.UUID, err)
+	}
+	if metadata, err = seal(dataKey, metadata, []byte(msg.UUID)); err != nil {
+		return nil, fmt.Errorf("unable to encrypt message %q metadata: %w", msg.UUID, err)
+	}
+	payload, err := seal(dataKey, msg.Payload, []byte(msg.UUID))
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt message %q payload: %w", msg.UUID, err)
+	}
+
+	encrypted := message.NewMessage(msg.UUID, payload)
+	if err = wrapDataKey(encrypted.Metadata, keyID, key, dataKey); err != nil {
+		return nil, err
+	}
+	encrypted.Metadata.Set(metadataKeyEncryptedMetadata, base64.StdEncoding.EncodeToString(metadata))
+	if deliverAt := msg.Metadata.Get(MetadataKeyDeliverAt); deliverAt != "" {
+		encrypted.Metadata.Set(MetadataKeyDeliverAt, deliverAt)
+	}
+	return encrypted, nil
+}
+
+// decryptMessage restores the payload and metadata of a message that names its key in metadata.
+// Messages without the key ID are left as they are.
+func decryptMessage(keys KeyProvider, next *rawMessage) error {
+	keyID := next.Metadata.Get(MetadataKeyEncryptionKeyID)
+	if keyID == "" {
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("unable to decrypt message %q: key provider is not set", next.UUID)
+	}
+	dataKey, err := unwrapDataKey(keys, next.Metadata)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt message %q data key: %w", next.UUID, err)
+	}
+	payload, err := open(dataKey, next.Payload, []byte(next.UUID))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt message %q payload: %w", next.UUID, err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(next.Metadata.Get(metadataKeyEncryptedMetadata))
+	if err != nil {
+		return fmt.Errorf("unable to decode message %q encrypted metadata: %w", next.UUID, err)
+	}
+	decrypted, err := open(dataKey, sealed, []byte(next.UUID))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt message %q metadata: %w", next.UUID, err)
+	}
+	metadata := message.Metadata{}
+	if err = json.Unmarshal(decrypted, &metadata); err != nil {
+		return fmt.Errorf("unable to parse message %q metadata JSON: %w", next.UUID, err)
+	}
+	next.Payload = payload
+	next.Metadata = metadata
+	return nil
+}
+
+// wrapDataKey encrypts the data key and records it in metadata along with the key ID.
+func wrapDataKey(metadata message.Metadata, keyID string, key, dataKey []byte) error {
+	wrapped, err := seal(key, dataKey, []byte(keyID))
+	if err != nil {
+		return fmt.Errorf("unable to encrypt data key with key %q: %w", keyID, err)
+	}
+	metadata.Set(MetadataKeyEncryptionKeyID, keyID)
+	metadata.Set(metadataKeyDataKey, base64.StdEncoding.EncodeToString(wrapped))
+	return nil
+}
+
+// unwrapDataKey decrypts the data key recorded in metadata with the key it names.
+func unwrapDataKey(keys KeyProvider, metadata message.Metadata) ([]byte, error) {
+	keyID := metadata.Get(MetadataKeyEncryptionKeyID)
+	key, err := keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata.Get(metadataKeyDataKey))
+	if err != nil {
+		return nil, err
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+// seal encrypts plain text with AES-GCM and prepends the random nonce.
+func seal(key, plainText, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plainText)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plainText, additionalData), nil
+}
+
+// open decrypts the output of seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,191 @@
+package wmsqlitezombiezen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestEncryption(t *testing.T) {
+	ctx := newTestContext(t)
+
+	first := bytes.Repeat([]byte{1}, 32)
+	second := bytes.Repeat([]byte{2}, 16)
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	legacy := newTestPublisher(t, conn, PublisherOptions{})
+	pub := newTestPublisher(t, conn, PublisherOptions{
+		PayloadCodec: GzipPayloadCodec{},
+		KeyProvider: KeyRing{
+			CurrentKeyID: "first",
+			Keys:         map[string][]byte{"first": first},
+		},
+	})
+
+	topic := "TestEncryption"
+	secret := strings.Repeat("personal data ", 100)
+	if err := legacy.Publish(topic, message.NewMessage("legacy", []byte(secret))); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := message.NewMessage("encrypted", []byte(secret))
+	encrypted.Metadata.Set("email", "person@example.com")
+	if err := pub.Publish(topic, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredKeys := func(t *testing.T, expected map[string]string) {
+		t.Helper()
+		if err := sqlitex.ExecuteTransient(conn, `SELECT uuid, payload, metadata, COALESCE(json_extract(metadata, '$.`+MetadataKeyEncryptionKeyID+`'), '') FROM 'watermill_`+topic+`';`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				id, payload, metadata, keyID := stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnText(2), stmt.ColumnText(3)
+				if keyID != expected[id] {
+					t.Fatalf("expected message %q to be encrypted with key %q, got %q", id, expected[id], keyID)
+				}
+				if keyID != "" && (strings.Contains(payload, "personal") || strings.Contains(metadata, "person@example.com")) {
+					t.Fatalf("message %q is stored in plain text", id)
+				}
+				return nil
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertStoredKeys(t, map[string]string{"legacy": "", "encrypted": "first"})
+
+	receive := func(t *testing.T, consumerGroup string, keys KeyProvider) {
+		t.Helper()
+		sub, err := NewSubscriber(DSN, SubscriberOptions{
+			PollInterval:         time.Millisecond * 20,
+			InitializeSchema:     true,
+			ConsumerGroupMatcher: NewStaticConsumerGroupMatcher(consumerGroup),
+			KeyProvider:          keys,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := sub.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		messages, err := sub.Subscribe(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"legacy", "encrypted"} {
+			select {
+			case msg := <-messages:
+				if msg.UUID != id {
+					t.Fatalf("expected message %q, got %q", id, msg.UUID)
+				}
+				if string(msg.Payload) != secret {
+					t.Fatalf("message %q payload was not decrypted", id)
+				}
+				if id == "encrypted" && msg.Metadata.Get("email") != "person@example.com" {
+					t.Fatalf("message %q metadata was not decrypted: %v", id, msg.Metadata)
+				}
+				for _, key := range []string{MetadataKeyEncryptionKeyID, metadataKeyDataKey, metadataKeyEncryptedMetadata, MetadataKeyPayloadCodec} {
+					if msg.Metadata.Get(key) != "" {
+						t.Fatalf("message %q metadata must not contain %q after decryption", id, key)
+					}
+				}
+				msg.Ack()
+			case <-time.After(time.Second * 3):
+				t.Fatalf("message %q was not delivered", id)
+			}
+		}
+	}
+	receive(t, "before-rotation", KeyRing{
+		CurrentKeyID: "first",
+		Keys:         map[string][]byte{"first": first},
+	})
+
+	rewritten, err := ReEncryptTopics(conn, ReEncryptOptions{
+		Topics: []string{topic},
+		KeyProvider: KeyRing{
+			CurrentKeyID: "second",
+			Keys:         map[string][]byte{"first": first, "second": second},
+		},
+		EncryptPlaintext: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != 2 {
+		t.Fatalf("expected two rewritten rows, got %d", rewritten)
+	}
+	assertStoredKeys(t, map[string]string{"legacy": "second", "encrypted": "second"})
+
+	receive(t, "after-rotation", KeyRing{
+		CurrentKeyID: "second",
+		Keys:         map[string][]byte{"second": second},
+	})
+}
+
+func TestUndecryptableMessage(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	retired := newTestPublisher(t, conn, PublisherOptions{
+		KeyProvider: KeyRing{
+			CurrentKeyID: "retired",
+			Keys:         map[string][]byte{"retired": bytes.Repeat([]byte{1}, 32)},
+		},
+	})
+	keys := KeyRing{
+		CurrentKeyID: "current",
+		Keys:         map[string][]byte{"current": bytes.Repeat([]byte{2}, 32)},
+	}
+	pub := newTestPublisher(t, conn, PublisherOptions{
+		KeyProvider: keys,
+	})
+	topic := "TestUndecryptableMessage"
+	if err := retired.Publish(topic, message.NewMessage("retired", []byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish(topic, message.NewMessage("current", []byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		MaxDeliveryAttempts: 2,
+		KeyProvider:         keys,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.UUID != "current" {
+			t.Fatalf("expected message %q, got %q", "current", msg.UUID)
+		}
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("message encrypted with a retired key held back the consumer group")
+	}
+
+	var keyID, reason string
+	if err = sqlitex.Execute(
+		conn,
+		`SELECT json_extract(metadata, '$.`+MetadataKeyEncryptionKeyID+`'), json_extract(metadata, '$.`+MetadataKeyDeadLetterReason+`') FROM 'watermill_`+DefaultDeadLetterTopic(topic)+`' WHERE uuid='retired';`,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				keyID = stmt.ColumnText(0)
+				reason = stmt.ColumnText(1)
+				return nil
+			},
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "retired" || reason != deadLetterReasonUnreadable {
+		t.Fatalf("message must be dead-lettered as it is stored, got key %q and reason %q", keyID, reason)
+	}
+}
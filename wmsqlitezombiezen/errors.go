@@ -37,6 +37,20 @@ const (
 	// This can only happen if there is a mistake in the SQLite query. Can occur if more than one row is returned
 	// when one was expected or none were expected. You should never see this error.
 	ErrMoreRowStepsThanExpected
+
+	// ErrSchemaIsNewer indicates that a table schema was upgraded by a newer version of the library.
+	// Older versions refuse to use such tables, because they do not know about the changes.
+	// Upgrade the library before connecting to the database.
+	ErrSchemaIsNewer
+
+	// ErrSingleTableStorageIsNotSupported indicates that an operation addresses topics by their tables,
+	// while [SingleTableNameGenerators] store every topic in one table.
+	ErrSingleTableStorageIsNotSupported
+
+	// ErrSchemaIsOlder indicates that a table was created by an older version of the library
+	// and lacks columns that an operation needs. Run [Migrate] or use a publisher or
+	// a subscriber with the InitializeSchema option to upgrade the table.
+	ErrSchemaIsOlder
 )
 
 func (e Error) Error() string {
@@ -55,6 +69,12 @@ func (e Error) Error() string {
 		return "consumer group is already locked by another consumer"
 	case ErrMoreRowStepsThanExpected:
 		return "more rows returned than expected"
+	case ErrSchemaIsNewer:
+		return "database schema is newer than supported by this library version; upgrade the library"
+	case ErrSingleTableStorageIsNotSupported:
+		return "operation does not support table name generators that store every topic in one table"
+	case ErrSchemaIsOlder:
+		return "database schema is older than required by this library version; migrate the database"
 	default:
 		return "unknown error"
 	}
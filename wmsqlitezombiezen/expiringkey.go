@@ -20,6 +20,10 @@ type expiringKeyRepository struct {
 	NextCleanUp     time.Time
 }
 
+// DefaultExpiringKeyTableName is the name of the expiring key repository table
+// used when [ExpiringKeyRepositoryConfiguration] does not set one.
+const DefaultExpiringKeyTableName = "watermill_expiring_keys"
+
 // ExpiringKeyRepositoryConfiguration intializes the expiring key repository in [NewExpiringKeyRepository] constructor.
 type ExpiringKeyRepositoryConfiguration struct {
 	// Connection is SQLite3 database handle. This connection must not be shared.
@@ -48,7 +52,7 @@ func NewExpiringKeyRepository(config ExpiringKeyRepositoryConfiguration) (_ midd
 		return nil, nil, ErrDatabaseConnectionIsNil
 	}
 	if config.TableName == "" {
-		config.TableName = "watermill_expiring_keys"
+		config.TableName = DefaultExpiringKeyTableName
 	} else if err = validateTopicName(config.TableName); err != nil {
 		return nil, nil, fmt.Errorf("table name does not match topic name rules: %w", err)
 	}
@@ -68,6 +72,9 @@ func NewExpiringKeyRepository(config ExpiringKeyRepositoryConfiguration) (_ midd
 		nil); err != nil {
 		return nil, nil, fmt.Errorf("untable to create %q SQLite table: %w", config.TableName, err)
 	}
+	if err = migrateTable(config.Connection, schemaKindExpiringKeys, config.TableName); err != nil {
+		return nil, nil, err
+	}
 
 	r := &expiringKeyRepository{
 		Connection:      config.Connection,
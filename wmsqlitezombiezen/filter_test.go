@@ -0,0 +1,101 @@
+package wmsqlitezombiezen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+
+	t.Run("invalid filters are rejected", func(t *testing.T) {
+		for name, options := range map[string]SubscriberOptions{
+			"injected key": {
+				MetadataFilter: MetadataFilter{`region"') OR 1=1 --`: "eu"},
+			},
+			"empty key": {
+				MetadataFilter: MetadataFilter{"": "eu"},
+			},
+			"NUL value": {
+				MetadataFilter: MetadataFilter{"region": "eu\x00"},
+			},
+			"delayed delivery": {
+				MetadataFilter:  MetadataFilter{"region": "eu"},
+				DelayedDelivery: true,
+			},
+			"key provider": {
+				MetadataFilter: MetadataFilter{"region": "eu"},
+				KeyProvider: KeyRing{
+					CurrentKeyID: "first",
+					Keys:         map[string][]byte{"first": make([]byte, 32)},
+				},
+			},
+		} {
+			if _, err := NewSubscriber(DSN, options); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+
+	topic := "TestMetadataFilter"
+	messages := message.Messages{}
+	for i, owner := range []string{"o'hara", "smith", "o'hara", "smith", "smith"} {
+		msg := message.NewMessage(uuid.New().String(), []byte{byte(i)})
+		msg.Metadata.Set("owner", owner)
+		messages = append(messages, msg)
+	}
+	if err := pub.Publish(topic, messages...); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("x"),
+		MetadataFilter:       MetadataFilter{"owner": "o'hara"},
+	})
+	received, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []*message.Message{messages[0], messages[2]} {
+		select {
+		case msg := <-received:
+			if msg.UUID != expected.UUID {
+				t.Fatalf("expected message %q, got %q", expected.UUID, msg.UUID)
+			}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("message %q was not delivered", expected.UUID)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("message %q with metadata %v must not be delivered", msg.UUID, msg.Metadata)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	inspector, err := NewInspector(conn, InspectorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		state, err := inspector.Inspect(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.ConsumerGroups) == 1 && state.ConsumerGroups[0].OffsetAcked == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("skipped messages must be acknowledged: %+v", state.ConsumerGroups)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
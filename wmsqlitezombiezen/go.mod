@@ -6,6 +6,12 @@ require (
 	github.com/ThreeDotsLabs/watermill v1.4.6
 	github.com/dkotik/watermillsqlite/wmsqlitemodernc v0.0.4
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.9
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/metric v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/sdk/metric v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
 	zombiezen.com/go/sqlite v1.4.0
 )
 
@@ -13,6 +19,8 @@ require (
 	github.com/cenkalti/backoff/v3 v3.2.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/lithammer/shortuuid/v3 v3.0.7 // indirect
@@ -0,0 +1,137 @@
+package wmsqlitezombiezen
+
+import (
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// InspectorOptions configure [NewInspector].
+type InspectorOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+}
+
+// TopicState is a snapshot of a topic and its consumer groups.
+type TopicState struct {
+	Topic string
+
+	// MaxOffset is the offset of the latest message retained in the topic table.
+	// Zero if the topic table is empty.
+	MaxOffset int64
+
+	// ConsumerGroups are ordered by name.
+	ConsumerGroups []ConsumerGroupState
+}
+
+// ConsumerGroupState is a snapshot of a consumer group row in the offsets table.
+type ConsumerGroupState struct {
+	Name        string
+	OffsetAcked int64
+
+	// LockedUntil is the expiration time of the consumer group lock.
+	// Zero time if the lock was released.
+	LockedUntil time.Time
+
+	// Locked is true while a subscription is holding the lock.
+	Locked bool
+
+	// Lag is the number of offsets between the acknowledged offset
+	// and the latest message in the topic table.
+	Lag int64
+}
+
+// Inspector reads the state of topics and consumer groups for health dashboards
+// and alerting. It never modifies the database.
+type Inspector struct {
+	conn *sqlite.Conn
+	tng  TableNameGenerators
+}
+
+// NewInspector creates an [Inspector]. The connection must not be used
+// concurrently with the inspector.
+func NewInspector(conn *sqlite.Conn, options InspectorOptions) (*Inspector, error) {
+	if conn == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return nil, ErrSingleTableStorageIsNotSupported
+	}
+	return &Inspector{
+		conn: conn,
+		tng:  tng,
+	}, nil
+}
+
+// Topics lists topics discovered by matching SQLite table names against table name generators.
+// Discovery only works for generators that prefix or suffix the topic name.
+func (i *Inspector) Topics() ([]string, error) {
+	return findTopics(i.conn, i.tng)
+}
+
+// Inspect takes a snapshot of a topic and its consumer groups.
+func (i *Inspector) Inspect(topic string) (state TopicState, err error) {
+	if err = validateTopicName(topic); err != nil {
+		return state, err
+	}
+	state.Topic = topic
+	if state.MaxOffset, err = sqlitex.ResultInt64(i.conn.Prep(
+		`SELECT COALESCE(MAX("offset"), 0) FROM '` + i.tng.Topic(topic) + `';`,
+	)); err != nil {
+		return state, fmt.Errorf("unable to read topic %q offset: %w", topic, err)
+	}
+
+	offsetsTable := i.tng.Offsets(topic)
+	columns, err := tableColumns(i.conn, offsetsTable)
+	if err != nil {
+		return state, err
+	}
+	expiry := `IIF(locked_until>0, locked_until*1000+999, 0)` // table was not migrated yet
+	if _, ok := columns["locked_until_ms"]; ok {
+		expiry = lockedUntil("locked_until")
+	}
+	if err = sqlitex.Execute(
+		i.conn,
+		`SELECT consumer_group, offset_acked, `+expiry+`, `+expiry+`>=CAST(unixepoch('subsec')*1000 AS INTEGER) FROM '`+offsetsTable+`' ORDER BY consumer_group;`,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				group := ConsumerGroupState{
+					Name:        stmt.ColumnText(0),
+					OffsetAcked: stmt.ColumnInt64(1),
+					Locked:      stmt.ColumnBool(3),
+				}
+				if expiresAt := stmt.ColumnInt64(2); expiresAt > 0 {
+					group.LockedUntil = time.UnixMilli(expiresAt)
+				}
+				group.Lag = max(state.MaxOffset-group.OffsetAcked, 0)
+				state.ConsumerGroups = append(state.ConsumerGroups, group)
+				return nil
+			},
+		},
+	); err != nil {
+		return state, fmt.Errorf("unable to read topic %q consumer groups: %w", topic, err)
+	}
+	return state, nil
+}
+
+// InspectAll takes a snapshot of every topic listed by [Inspector.Topics].
+func (i *Inspector) InspectAll() (states []TopicState, err error) {
+	topics, err := i.Topics()
+	if err != nil {
+		return nil, err
+	}
+	states = make([]TopicState, 0, len(topics))
+	for _, topic := range topics {
+		state, err := i.Inspect(topic)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
@@ -0,0 +1,52 @@
+package wmsqlitezombiezen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestDeliveryMetadata(t *testing.T) {
+	ctx := newTestContext(t)
+
+	_, pub, sub := newTestPubSub(t, SubscriberOptions{})
+
+	topic := "TestDeliveryMetadata"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if err = pub.Publish(topic, message.NewMessage("1", []byte("1")), message.NewMessage("2", []byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	for expected := int64(1); expected <= 2; expected++ {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+			offset, ok := Offset(msg)
+			if !ok {
+				t.Fatal("message offset is missing")
+			}
+			if offset != expected {
+				t.Fatalf("expected offset %d, got %d", expected, offset)
+			}
+			publishedAt, ok := PublishedAt(msg)
+			if !ok {
+				t.Fatal("message publish time is missing")
+			}
+			if publishedAt.Before(before) || publishedAt.After(after) {
+				t.Fatalf("publish time %s is not between %s and %s", publishedAt, before, after)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("message was not delivered")
+		}
+	}
+
+	if _, ok := Offset(message.NewMessage("3", nil)); ok {
+		t.Fatal("undelivered message must not have an offset")
+	}
+}
@@ -0,0 +1,147 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectInt64 sums data points of an integer counter or returns the last value of an integer gauge.
+func collectInt64(t *testing.T, reader sdkmetric.Reader, name string) (value int64, ok bool) {
+	t.Helper()
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, point := range data.DataPoints {
+					value += point.Value
+				}
+				return value, true
+			case metricdata.Gauge[int64]:
+				for _, point := range data.DataPoints {
+					value = point.Value
+				}
+				return value, len(data.DataPoints) > 0
+			case metricdata.Histogram[int64]:
+				for _, point := range data.DataPoints {
+					value += int64(point.Count)
+				}
+				return value, true
+			case metricdata.Histogram[float64]:
+				for _, point := range data.DataPoints {
+					value += int64(point.Count)
+				}
+				return value, true
+			default:
+				t.Fatalf("metric %q has unexpected data type %T", name, m.Data)
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := newTestContext(t)
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{
+		MeterProvider: provider,
+	})
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		MeterProvider: provider,
+	})
+
+	topic := "TestMetrics"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("1", []byte("first")), message.NewMessage("2", []byte("second"))); err != nil {
+		t.Fatal(err)
+	}
+
+	nacked := false
+	for acked := 0; acked < 2; {
+		select {
+		case msg := <-messages:
+			if !nacked {
+				nacked = msg.Nack()
+				continue
+			}
+			msg.Ack()
+			acked++
+		case <-time.After(time.Second * 3):
+			t.Fatal("message was not delivered")
+		}
+	}
+
+	expected := map[string]int64{
+		"watermill.sqlite.published.messages": 2,
+		"watermill.sqlite.published.bytes":    int64(len("first") + len("second")),
+		"watermill.sqlite.publish.duration":   1,
+		"watermill.sqlite.acks":               2,
+		"watermill.sqlite.nacks":              1,
+		"watermill.sqlite.consumer.lag":       0, // next batch after the acknowledgements
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for name, value := range expected {
+		for {
+			// acknowledgements are recorded after the subscription receives them
+			actual, ok := collectInt64(t, reader, name)
+			if ok && actual == value {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected metric %q to be %d, got %d", name, value, actual)
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+	if value, _ := collectInt64(t, reader, "watermill.sqlite.lock.acquisitions"); value < 1 {
+		t.Fatal("consumer group lock acquisition was not recorded")
+	}
+	if value, _ := collectInt64(t, reader, "watermill.sqlite.batch.size"); value < 1 {
+		t.Fatal("message batch size was not recorded")
+	}
+}
+
+func TestMetricsSkippedDuplicates(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	pub := newTestPublisher(t, newTestConnection(t, newTestDSN()), PublisherOptions{
+		MeterProvider:        sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		IgnoreDuplicateUUIDs: true,
+		MaxBatchSize:         2,
+	})
+
+	topic := "TestMetricsSkippedDuplicates"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte{}), message.NewMessage("2", []byte{})); err != nil {
+		t.Fatal(err)
+	}
+	// the first chunk holds only duplicates, the second chunk holds a new message
+	if err := pub.Publish(topic, message.NewMessage("1", []byte{}), message.NewMessage("2", []byte{}), message.NewMessage("3", []byte{})); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]int64{
+		"watermill.sqlite.published.messages":   3,
+		"watermill.sqlite.published.duplicates": 2,
+	} {
+		if actual, _ := collectInt64(t, reader, name); actual != value {
+			t.Fatalf("expected metric %q to be %d, got %d", name, value, actual)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package wmsqlitezombiezen
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// SchemaVersionsTableName is the name of the table that records schema versions
+// of topic, offsets, deliveries, and expiring key tables.
+const SchemaVersionsTableName = "watermill_schema_versions"
+
+const (
+	schemaKindTopic        = "topic"
+	schemaKindOffsets      = "offsets"
+	schemaKindDeliveries   = "deliveries"
+	schemaKindExpiringKeys = "expiring_keys"
+)
+
+// migration upgrades a table to a schema version by adding the missing columns.
+type migration struct {
+	Version int
+	Columns []string // column definitions for ALTER TABLE ADD COLUMN statements
+	Updates []string // statements that fill the added columns, with %s in place of the table name
+}
+
+// schemaMigrations list upgrades of each table kind in ascending version order.
+// Version 1 is the schema of the first release. Append a migration for any column change,
+// and update the matching CREATE TABLE statement, so that new tables start at the latest version.
+var schemaMigrations = map[string][]migration{
+	schemaKindTopic: {
+		{Version: 2, Columns: []string{"deliver_at INTEGER NOT NULL DEFAULT 0"}},
+	},
+	schemaKindOffsets: {
+		{
+			Version: 2,
+			Columns: []string{"locked_until_ms INTEGER NOT NULL DEFAULT 0"},
+			// locks taken by older versions are held until the end of their last second
+			Updates: []string{`UPDATE '%s' SET locked_until_ms=locked_until*1000+999 WHERE locked_until>0 AND locked_until_ms=0;`},
+		},
+	},
+	schemaKindDeliveries: {
+		{Version: 2, Columns: []string{"acked INTEGER NOT NULL DEFAULT 0"}},
+		{Version: 3, Columns: []string{
+			"leased_until INTEGER NOT NULL DEFAULT 0",
+			"lease_owner TEXT NOT NULL DEFAULT ''",
+		}},
+		{
+			Version: 4,
+			Columns: []string{"leased_until_ms INTEGER NOT NULL DEFAULT 0"},
+			Updates: []string{`UPDATE '%s' SET leased_until_ms=leased_until*1000+999 WHERE leased_until>0 AND leased_until_ms=0;`},
+		},
+	},
+	schemaKindExpiringKeys: nil,
+}
+
+// latestSchemaVersion returns the schema version of a table kind supported by this library.
+func latestSchemaVersion(kind string) int {
+	migrations := schemaMigrations[kind]
+	if len(migrations) == 0 {
+		return 1
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// schemaMigrator is satisfied by adapters, including the ones that embed them,
+// whose tables are upgraded in place by the migration runner.
+type schemaMigrator interface {
+	migratesSchema()
+}
+
+func (a DefaultSchemaAdapter) migratesSchema()  {}
+func (a DefaultOffsetsAdapter) migratesSchema() {}
+
+// MigrateOptions configure [Migrate].
+type MigrateOptions struct {
+	// TableNameGenerators locate topic, offsets, and deliveries tables.
+	// Default value is [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// ExpiringKeyTables lists tables of expiring key repositories.
+	// Tables that do not exist are skipped.
+	// Default value contains [DefaultExpiringKeyTableName].
+	ExpiringKeyTables []string
+}
+
+// Migrate upgrades tables of every topic and expiring key repository in place
+// and records their versions in [SchemaVersionsTableName] table. Publishers and subscribers
+// with InitializeSchema option migrate the tables they use automatically.
+//
+// Returns [ErrSchemaIsNewer] if any table was upgraded by a newer version of the library.
+func Migrate(conn *sqlite.Conn, options MigrateOptions) (err error) {
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return ErrSingleTableStorageIsNotSupported
+	}
+	if len(options.ExpiringKeyTables) == 0 {
+		options.ExpiringKeyTables = []string{DefaultExpiringKeyTableName}
+	}
+
+	topics, err := findTopics(conn, tng)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err = migrateTable(conn, schemaKindTopic, tng.Topic(topic)); err != nil {
+			return err
+		}
+		if err = migrateTable(conn, schemaKindOffsets, tng.Offsets(topic)); err != nil {
+			return err
+		}
+		if err = migrateTableIfPresent(conn, schemaKindDeliveries, tng.Deliveries(topic)); err != nil {
+			return err
+		}
+	}
+	for _, table := range options.ExpiringKeyTables {
+		if err = migrateTableIfPresent(conn, schemaKindExpiringKeys, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableExists(conn *sqlite.Conn, table string) (bool, error) {
+	stmt := conn.Prep(`SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type='table' AND name=?);`)
+	stmt.BindText(1, table)
+	present, err := sqlitex.ResultBool(stmt)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up table %q: %w", table, err)
+	}
+	return present, nil
+}
+
+func migrateTableIfPresent(conn *sqlite.Conn, kind, table string) error {
+	present, err := tableExists(conn, table)
+	if err != nil || !present {
+		return err
+	}
+	return migrateTable(conn, kind, table)
+}
+
+// schemaVersion returns the recorded version of a table, if any.
+func schemaVersion(conn *sqlite.Conn, table string) (version int, recorded bool, err error) {
+	if err = sqlitex.Execute(
+		conn,
+		`SELECT version FROM '`+SchemaVersionsTableName+`' WHERE table_name=?;`,
+		&sqlitex.ExecOptions{
+			Args: []any{table},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt(0)
+				recorded = true
+				return nil
+			},
+		},
+	); err != nil {
+		return 0, false, fmt.Errorf("unable to read table %q schema version: %w", table, err)
+	}
+	return version, recorded, nil
+}
+
+// migrateTable adds columns missing from a table and records its latest schema version.
+// A table without a recorded version was created either by the first release or with the latest schema,
+// so the columns are compared against every migration.
+func migrateTable(conn *sqlite.Conn, kind, table string) (err error) {
+	if err = sqlitex.ExecuteTransient(conn, `CREATE TABLE IF NOT EXISTS '`+SchemaVersionsTableName+`' (
+		table_name TEXT NOT NULL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		migrated_at TEXT NOT NULL
+	);`, nil); err != nil {
+		return fmt.Errorf("unable to create schema versions table: %w", err)
+	}
+
+	latest := latestSchemaVersion(kind)
+	version, recorded, err := schemaVersion(conn, table)
+	switch {
+	case err != nil:
+		return err
+	case !recorded:
+		version = 1
+	case version > latest:
+		return fmt.Errorf("table %q schema version %d is newer than supported version %d: %w", table, version, latest, ErrSchemaIsNewer)
+	case version == latest:
+		return nil
+	}
+
+	columns, err := tableColumns(conn, table)
+	if err != nil {
+		return err
+	}
+	for _, m := range schemaMigrations[kind] {
+		if m.Version <= version {
+			continue
+		}
+		for _, definition := range m.Columns {
+			if _, ok := columns[strings.Fields(definition)[0]]; ok {
+				continue
+			}
+			if err = sqlitex.ExecuteTransient(conn, `ALTER TABLE '`+table+`' ADD COLUMN `+definition+`;`, nil); err != nil {
+				if strings.Contains(err.Error(), "duplicate column name") {
+					continue // added by a concurrent migration
+				}
+				return fmt.Errorf("unable to migrate table %q to schema version %d: %w", table, m.Version, err)
+			}
+		}
+		for _, update := range m.Updates {
+			if err = sqlitex.ExecuteTransient(conn, fmt.Sprintf(update, table), nil); err != nil {
+				return fmt.Errorf("unable to migrate table %q to schema version %d: %w", table, m.Version, err)
+			}
+		}
+	}
+
+	if err = sqlitex.Execute(conn, `INSERT INTO '`+SchemaVersionsTableName+`' (table_name, kind, version, migrated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(table_name) DO UPDATE SET version=excluded.version, migrated_at=excluded.migrated_at;`,
+		&sqlitex.ExecOptions{
+			Args: []any{table, kind, latest, time.Now().Format(time.RFC3339)},
+		},
+	); err != nil {
+		return fmt.Errorf("unable to record table %q schema version: %w", table, err)
+	}
+	return nil
+}
+
+func tableColumns(conn *sqlite.Conn, table string) (map[string]struct{}, error) {
+	columns := make(map[string]struct{})
+	if err := sqlitex.Execute(conn, `SELECT name FROM pragma_table_info(?);`, &sqlitex.ExecOptions{
+		Args: []any{table},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			columns[stmt.ColumnText(0)] = struct{}{}
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read table %q columns: %w", table, err)
+	}
+	return columns, nil
+}
+
+// checkSchemaIsMigrated returns [ErrSchemaIsOlder] if a table lacks columns
+// added by the migrations of its kind. A missing table is left to the caller.
+func checkSchemaIsMigrated(conn *sqlite.Conn, kind, table string) error {
+	columns, err := tableColumns(conn, table)
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	for _, m := range schemaMigrations[kind] {
+		for _, definition := range m.Columns {
+			if name := strings.Fields(definition)[0]; !hasColumn(columns, name) {
+				return fmt.Errorf("table %q lacks column %q of schema version %d: %w", table, name, m.Version, ErrSchemaIsOlder)
+			}
+		}
+	}
+	return nil
+}
+
+func hasColumn(columns map[string]struct{}, name string) bool {
+	_, ok := columns[name]
+	return ok
+}
+
+// checkSchemaVersions returns [ErrSchemaIsNewer] if any of the tables,
+// mapped to their kinds, was upgraded by a newer version of the library.
+func checkSchemaVersions(conn *sqlite.Conn, tables map[string]string) error {
+	present, err := tableExists(conn, SchemaVersionsTableName)
+	if err != nil || !present {
+		return err
+	}
+
+	for table, kind := range tables {
+		version, recorded, err := schemaVersion(conn, table)
+		if err != nil {
+			return err
+		}
+		if latest := latestSchemaVersion(kind); recorded && version > latest {
+			return fmt.Errorf("table %q schema version %d is newer than supported version %d: %w", table, version, latest, ErrSchemaIsNewer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package wmsqlitezombiezen
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMigrate(t *testing.T) {
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	topic := "TestMigrate"
+	for _, query := range []string{
+		// schema of the first release
+		`CREATE TABLE 'watermill_` + topic + `' (
+			'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uuid TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			metadata JSON NOT NULL
+		);`,
+		`CREATE TABLE 'watermill_offsets_` + topic + `' (
+			consumer_group TEXT NOT NULL,
+			offset_acked INTEGER NOT NULL,
+			locked_until INTEGER NOT NULL,
+			PRIMARY KEY(consumer_group)
+		);`,
+		`CREATE TABLE 'watermill_deliveries_` + topic + `' (
+			consumer_group TEXT NOT NULL,
+			'offset' INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY(consumer_group, 'offset')
+		) WITHOUT ROWID;`,
+		`INSERT INTO 'watermill_` + topic + `' (uuid, created_at, payload, metadata) VALUES ('1', '', '1', '{}');`,
+		`INSERT INTO 'watermill_offsets_` + topic + `' (consumer_group, offset_acked, locked_until) VALUES ('held', 0, unixepoch()+60);`,
+	} {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(conn, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for table, column := range map[string]string{
+		"watermill_" + topic:            "deliver_at",
+		"watermill_offsets_" + topic:    "locked_until_ms",
+		"watermill_deliveries_" + topic: "leased_until_ms",
+	} {
+		stmt := conn.Prep(`SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name=?);`)
+		stmt.BindText(1, table)
+		stmt.BindText(2, column)
+		present, err := sqlitex.ResultBool(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !present {
+			t.Fatalf("column %q was not added to table %q", column, table)
+		}
+	}
+
+	held, err := sqlitex.ResultBool(conn.Prep(`SELECT locked_until_ms>=unixepoch()*1000 FROM 'watermill_offsets_` + topic + `' WHERE consumer_group='held';`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Fatal("consumer group lock taken before the migration was lost")
+	}
+
+	version, _, err := schemaVersion(conn, "watermill_deliveries_"+topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestSchemaVersion(schemaKindDeliveries) {
+		t.Fatalf("expected deliveries table schema version %d, got %d", latestSchemaVersion(schemaKindDeliveries), version)
+	}
+	if err = Migrate(conn, MigrateOptions{}); err != nil {
+		t.Fatal("repeated migration must be a no-op:", err)
+	}
+}
+
+func TestSchemaIsNewer(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{})
+
+	topic := "TestSchemaIsNewer"
+	if _, err := sub.Subscribe(ctx, topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Execute(
+		conn,
+		`UPDATE '`+SchemaVersionsTableName+`' SET version=version+1 WHERE table_name=?;`,
+		&sqlitex.ExecOptions{Args: []any{"watermill_" + topic}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(conn, MigrateOptions{}); !errors.Is(err, ErrSchemaIsNewer) {
+		t.Fatalf("expected migration error %q, got %v", ErrSchemaIsNewer, err)
+	}
+
+	older, err := NewSubscriber(DSN, SubscriberOptions{
+		PollInterval: time.Millisecond * 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := older.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if _, err = older.Subscribe(ctx, topic); !errors.Is(err, ErrSchemaIsNewer) {
+		t.Fatalf("expected subscription error %q, got %v", ErrSchemaIsNewer, err)
+	}
+
+	for _, initializeSchema := range []bool{true, false} {
+		pub, err := NewPublisher(conn, PublisherOptions{
+			InitializeSchema: initializeSchema,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = pub.Publish(topic, message.NewMessage("1", []byte("1"))); !errors.Is(err, ErrSchemaIsNewer) {
+			t.Fatalf("expected publishing error %q with schema initialization %t, got %v", ErrSchemaIsNewer, initializeSchema, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package wmsqlitezombiezen
+
+import "sync"
+
+// published wakes up subscriptions whenever a publisher
+// within the same process inserts messages into a topic table.
+var published = &notifier{}
+
+// notifier wakes up subscriptions waiting for new messages without
+// waiting for the next poll interval tick. Listeners are keyed by topic table name.
+type notifier struct {
+	mu        sync.Mutex
+	listeners map[string]map[chan struct{}]struct{}
+}
+
+// Listen registers a wake channel. The channel must be buffered,
+// because notifications are dropped when the listener is busy.
+func (n *notifier) Listen(key string, wake chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners == nil {
+		n.listeners = make(map[string]map[chan struct{}]struct{})
+	}
+	if _, ok := n.listeners[key]; !ok {
+		n.listeners[key] = make(map[chan struct{}]struct{})
+	}
+	n.listeners[key][wake] = struct{}{}
+}
+
+// Forget removes a wake channel registered by [notifier.Listen].
+func (n *notifier) Forget(key string, wake chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.listeners[key], wake)
+	if len(n.listeners[key]) == 0 {
+		delete(n.listeners, key)
+	}
+}
+
+// Notify wakes up listeners of a given key.
+func (n *notifier) Notify(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for wake := range n.listeners[key] {
+		select {
+		case wake <- struct{}{}:
+		default: // already awake
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package wmsqlitezombiezen
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestPublishWakesSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	_, pub, sub := newTestPubSub(t, SubscriberOptions{
+		PollInterval: time.Hour,
+	})
+
+	topic := "TestPublishWakesSubscription"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("subscription was not woken up by the publisher")
+	}
+}
+
+func TestDataVersionWakesSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := "file:" + filepath.Join(t.TempDir(), uuid.New().String()+".sqlite3") + "?journal_mode=WAL&busy_timeout=5000"
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		PollInterval:        time.Hour,
+		DataVersionInterval: time.Millisecond * 20,
+	})
+
+	topic := "TestDataVersionWakesSubscription"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100) // let the watcher observe the initial data version
+
+	// insert the message through another database handle
+	// like another process would, bypassing the publisher notifications
+	other := newTestConnection(t, DSN)
+	if err = sqlitex.Execute(
+		other,
+		`INSERT INTO 'watermill_`+topic+`' (uuid, created_at, payload, metadata) VALUES (?, ?, ?, ?);`,
+		&sqlitex.ExecOptions{
+			Args: []any{"1", time.Now().Format(time.RFC3339), []byte("1"), "{}"},
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-time.After(time.Second * 3):
+		t.Fatal("subscription was not woken up by the data version change")
+	}
+}
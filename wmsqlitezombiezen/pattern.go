@@ -0,0 +1,156 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+)
+
+// MetadataKeyTopic is the reserved metadata key that holds the source topic
+// of a message delivered by a topic pattern subscription.
+const MetadataKeyTopic = "sqlite_topic"
+
+var disallowedTopicPatternCharacters = regexp.MustCompile(`[^A-Za-z0-9\-\$\:\.\_\*\?\[\]\^]`)
+
+// isTopicPattern reports whether the topic contains wildcards of [path.Match],
+// which are not allowed in topic names.
+func isTopicPattern(topic string) bool {
+	return strings.ContainsAny(topic, "*?[")
+}
+
+// validateTopicPattern checks that the pattern contains only topic name characters and wildcards.
+func validateTopicPattern(pattern string) error {
+	if disallowedTopicPatternCharacters.MatchString(pattern) {
+		return fmt.Errorf("invalid topic pattern %q: %w", pattern, ErrInvalidTopicName)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// matchTopics selects topics that match the pattern. Dead-letter topics of
+// other matching topics are skipped, so that a pattern like "orders.*"
+// does not consume messages that were dead-lettered by its own subscriptions.
+func matchTopics(pattern string, topics []string, deadLetterTopic func(string) string) (matched []string) {
+	deadLetters := make(map[string]struct{})
+	for _, topic := range topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			matched = append(matched, topic)
+			deadLetters[deadLetterTopic(topic)] = struct{}{}
+		}
+	}
+	return slices.DeleteFunc(matched, func(topic string) bool {
+		_, ok := deadLetters[topic]
+		return ok
+	})
+}
+
+// subscribePattern merges subscriptions to every topic that matches the pattern.
+// Topics are discovered by their tables on every poll interval, so topics created
+// by publishers after the subscription started are picked up too.
+// Each topic is consumed with its own consumer group offset.
+func (s *subscriber) subscribePattern(ctx context.Context, pattern string) (c <-chan *message.Message, err error) {
+	if err = validateTopicPattern(pattern); err != nil {
+		return nil, err
+	}
+	tng := TableNameGenerators{
+		Topic:      s.TopicTableNameGenerator,
+		Offsets:    s.OffsetsTableNameGenerator,
+		Deliveries: s.DeliveriesTableNameGenerator,
+	}
+	if tng.sharesTables() {
+		return nil, ErrSingleTableStorageIsNotSupported
+	}
+
+	conn, err := sqlite.OpenConn(s.ConnectionDSN)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func(done <-chan struct{}) {
+		<-done
+		cancel()
+	}(s.Closed)
+	conn.SetInterrupt(ctx.Done())
+
+	destination := make(chan *message.Message)
+	forwarding := &sync.WaitGroup{}
+	subscribed := make(map[string]struct{})
+	discover := func() error {
+		topics, err := findTopics(conn, tng)
+		if err != nil {
+			return err
+		}
+		for _, topic := range matchTopics(pattern, topics, s.DeadLetterTopic) {
+			if _, ok := subscribed[topic]; ok {
+				continue
+			}
+			messages, err := s.Subscribe(ctx, topic)
+			if err != nil {
+				return fmt.Errorf("unable to subscribe to topic %q: %w", topic, err)
+			}
+			subscribed[topic] = struct{}{}
+			forwarding.Add(1)
+			go func(topic string) {
+				defer forwarding.Done()
+				forwardTopic(ctx, topic, messages, destination)
+			}(topic)
+		}
+		return nil
+	}
+	// Discovery is registered before it subscribes to any topic, so that Close
+	// waits for it, and topic subscriptions are never added after Close stopped waiting.
+	s.Subscriptions.Add(1)
+	if err = discover(); err != nil {
+		s.Subscriptions.Done()
+		cancel()
+		return nil, errors.Join(err, conn.Close())
+	}
+
+	logger := s.Logger.With(watermill.LogFields{"topic_pattern": pattern})
+	go func() {
+		defer s.Subscriptions.Done()
+		ticker := time.NewTicker(s.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := conn.Close(); err != nil {
+					logger.Error("failed to close topic discovery connection", err, nil)
+				}
+				forwarding.Wait()
+				close(destination)
+				return
+			case <-ticker.C:
+			}
+			if err := discover(); err != nil && ctx.Err() == nil && !s.IsClosed() {
+				logger.Error("topic discovery failed", err, nil)
+			}
+		}
+	}()
+	return destination, nil
+}
+
+// forwardTopic tags messages with their source topic and passes them to the merged destination.
+// Acknowledgements reach the topic subscription, because the same message is forwarded.
+func forwardTopic(ctx context.Context, topic string, messages <-chan *message.Message, destination chan<- *message.Message) {
+	for msg := range messages {
+		msg.Metadata.Set(MetadataKeyTopic, topic)
+		select {
+		case destination <- msg:
+		case <-ctx.Done():
+			msg.Nack()
+		}
+	}
+}
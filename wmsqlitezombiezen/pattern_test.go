@@ -0,0 +1,185 @@
+package wmsqlitezombiezen
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestTopicPatternSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	for _, topic := range []string{"orders.created", "orders.paid", "invoices.created"} {
+		if err := pub.Publish(topic, message.NewMessage(topic, []byte(topic))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("x"),
+		MaxDeliveryAttempts:  3,
+	})
+
+	if _, err := sub.Subscribe(ctx, "orders.[*"); err == nil {
+		t.Fatal("malformed topic pattern must be rejected")
+	}
+	if _, err := sub.Subscribe(ctx, "orders/*"); !errors.Is(err, ErrInvalidTopicName) {
+		t.Fatalf("expected %v, got %v", ErrInvalidTopicName, err)
+	}
+
+	messages, err := sub.Subscribe(ctx, "orders.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func(t *testing.T, count int) (topics []string) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			select {
+			case msg := <-messages:
+				topic := msg.Metadata.Get(MetadataKeyTopic)
+				if msg.UUID != topic {
+					t.Fatalf("message %q is tagged with topic %q", msg.UUID, topic)
+				}
+				topics = append(topics, topic)
+				msg.Ack()
+			case <-time.After(time.Second * 3):
+				t.Fatalf("received %d out of %d messages", i, count)
+			}
+		}
+		slices.Sort(topics)
+		return topics
+	}
+
+	if topics := receive(t, 2); !slices.Equal(topics, []string{"orders.created", "orders.paid"}) {
+		t.Fatalf("unexpected topics: %v", topics)
+	}
+
+	t.Run("new topics are discovered", func(t *testing.T) {
+		if err = pub.Publish("orders.shipped", message.NewMessage("orders.shipped", []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		if topics := receive(t, 1); topics[0] != "orders.shipped" {
+			t.Fatalf("unexpected topic: %v", topics[0])
+		}
+	})
+
+	t.Run("each topic keeps its own offset", func(t *testing.T) {
+		deadline := time.Now().Add(time.Second * 3)
+		for _, topic := range []string{"orders.created", "orders.paid", "orders.shipped"} {
+			for {
+				offset, err := sqlitex.ResultInt64(conn.Prep(`SELECT offset_acked FROM 'watermill_offsets_` + topic + `' WHERE consumer_group='x';`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if offset == 1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("topic %q consumer group offset did not advance, got %d", topic, offset)
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+		}
+		exists, err := sqlitex.ResultBool(conn.Prep(`SELECT EXISTS(SELECT 1 FROM 'watermill_offsets_invoices.created' WHERE consumer_group='x');`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("topic that does not match the pattern was subscribed to")
+		}
+	})
+
+	t.Run("dead-letter topics are skipped", func(t *testing.T) {
+		if got := matchTopics("orders.*", []string{
+			"orders.created",
+			"orders.created.dead_letter",
+			"orders.paid",
+		}, DefaultDeadLetterTopic); !slices.Equal(got, []string{"orders.created", "orders.paid"}) {
+			t.Fatalf("unexpected topics: %v", got)
+		}
+		if got := matchTopics("*.dead_letter", []string{
+			"orders.created",
+			"orders.created.dead_letter",
+		}, DefaultDeadLetterTopic); !slices.Equal(got, []string{"orders.created.dead_letter"}) {
+			t.Fatalf("unexpected topics: %v", got)
+		}
+	})
+
+	if err = sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("unexpected message after the subscriber was closed")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("merged channel was not closed with the subscriber")
+	}
+}
+
+func TestTopicPatternSubscriptionClosesWhileDiscovering(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	pub := newTestPublisher(t, newTestConnection(t, DSN), PublisherOptions{})
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		ConsumerGroupMatcher: NewStaticConsumerGroupMatcher("x"),
+		PollInterval:         time.Millisecond,
+	})
+	messages, err := sub.Subscribe(ctx, "orders.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 200 && err == nil; i++ {
+			topic := "orders." + strconv.Itoa(i)
+			err = pub.Publish(topic, message.NewMessage(topic, []byte{}))
+		}
+		published <- err
+	}()
+	received := make(chan struct{}, 1)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for msg := range messages {
+			msg.Ack()
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 3):
+		t.Fatal("no topic was discovered")
+	}
+	// topics keep appearing, so discovery subscribes while the subscriber closes
+	if err = sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second * 3):
+		t.Fatal("merged channel was not closed with the subscriber")
+	}
+	if _, err = sub.Subscribe(ctx, "orders.*"); !errors.Is(err, ErrSubscriberIsClosed) {
+		t.Fatalf("expected %v, got %v", ErrSubscriberIsClosed, err)
+	}
+	if err = <-published; err != nil {
+		t.Fatal(err)
+	}
+}
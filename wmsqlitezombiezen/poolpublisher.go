@@ -0,0 +1,84 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// PoolPublisher publishes messages using connections borrowed from a [sqlitex.Pool].
+// Unlike the publisher created by [NewPublisher], it does not serialize publishing
+// behind a single connection, so it can be shared by concurrent goroutines,
+// such as HTTP handlers. SQLite still permits only one writer at a time.
+type PoolPublisher struct {
+	pool      *sqlitex.Pool
+	publisher *publisher
+}
+
+// NewPoolPublisher creates a [message.Publisher] that takes a connection from the pool for each publish.
+// Schema is initialized once per topic per publisher instance, if InitializeSchema option is set.
+func NewPoolPublisher(pool *sqlitex.Pool, options PublisherOptions) (*PoolPublisher, error) {
+	if pool == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	p, err := newPublisher(options)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolPublisher{
+		pool:      pool,
+		publisher: p,
+	}, nil
+}
+
+// Publish pushes messages into a topic using a connection from the pool.
+// Returns [ErrPublisherIsClosed] if the publisher is closed.
+//
+// Message context is ignored for the same reason as it is ignored
+// by the publisher created with [NewPublisher].
+func (p *PoolPublisher) Publish(topic string, messages ...*message.Message) (err error) {
+	if p.publisher.IsClosed() {
+		return ErrPublisherIsClosed
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	conn, err := p.pool.Take(context.Background())
+	if err != nil {
+		return fmt.Errorf("unable to take a connection from the pool: %w", err)
+	}
+	defer p.pool.Put(conn)
+	return p.publisher.insert(conn, topic, messages)
+}
+
+// PublishInTransaction pushes messages into a topic using a connection provided by the caller,
+// usually within the caller's [sqlitex.Transaction] or [sqlitex.Save] savepoint.
+// Messages are committed or rolled back together with the caller's writes.
+// Returns [ErrPublisherIsClosed] if the publisher is closed.
+//
+// Subscriptions within the same process are not woken up when the caller commits.
+// They find the messages on their next poll or data version check.
+func (p *PoolPublisher) PublishInTransaction(conn *sqlite.Conn, topic string, messages ...*message.Message) (err error) {
+	if conn == nil {
+		return ErrDatabaseConnectionIsNil
+	}
+	if p.publisher.IsClosed() {
+		return ErrPublisherIsClosed
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return p.publisher.insert(conn, topic, messages)
+}
+
+// Close prevents further publishing. The pool remains open, because it belongs to the caller.
+func (p *PoolPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+func (p *PoolPublisher) String() string {
+	return "sqlite3-zombiezen-pool-publisher-" + p.publisher.UUID
+}
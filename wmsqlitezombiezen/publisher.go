@@ -1,15 +1,17 @@
 package wmsqlitezombiezen
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
@@ -18,14 +20,73 @@ import (
 type PublisherOptions struct {
 	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
 	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	// [SingleTableNameGenerators] keep every topic in shared tables, which does not support
+	// [Seek], [NewInspector], [CleanUpTopics], [ReEncryptTopics], [Migrate], or topic patterns.
 	TableNameGenerators TableNameGenerators
 
+	// SchemaAdapter produces queries that create topic tables and insert messages.
+	// Subscribers must use a compatible adapter.
+	// Default value is [DefaultSchemaAdapter].
+	SchemaAdapter SchemaAdapter
+
+	// OffsetsAdapter produces queries that create offsets tables.
+	// Subscribers must use a compatible adapter.
+	// Default value is [DefaultOffsetsAdapter].
+	OffsetsAdapter OffsetsAdapter
+
 	// InitializeSchema enables initialization of schema database during publish.
 	// Schema is initialized once per topic per publisher instance.
 	// InitializeSchema is forbidden if using an ongoing transaction as database handle.
 	// It could result in an implicit commit of the transaction by a CREATE TABLE statement.
 	InitializeSchema bool
 
+	// IgnoreDuplicateUUIDs keeps a unique index on message UUIDs in topic tables,
+	// so that messages with UUIDs that were already published to the topic are silently skipped.
+	// Then, publishing retried after an ambiguous error does not store duplicates.
+	// The index is created by InitializeSchema, which also adds it to existing tables
+	// without duplicates. Publishing to a topic table without the index fails.
+	// The index slows down publishing, see the publishing benchmarks.
+	// Publisher metrics count skipped messages apart from inserted messages.
+	IgnoreDuplicateUUIDs bool
+
+	// MaxBatchSize limits the number of messages inserted by a single statement.
+	// Larger publishing is split into several statements within one savepoint,
+	// so that each statement stays within SQLite bound parameter and query length limits.
+	// A statement must not bind more than 32766 parameters, the default SQLite limit,
+	// so [NewPublisher] rejects values above the limit divided by the number of parameters
+	// that the SchemaAdapter binds per message: 6553 for the five parameters of [DefaultSchemaAdapter]
+	// and 5461 for the six parameters of [SingleTableSchemaAdapter].
+	// Default value is 1000, or fewer messages if the adapter binds more than 32 parameters per message.
+	MaxBatchSize int
+
+	// PayloadCodec compresses payloads of at least PayloadCodecThreshold bytes.
+	// The codec name is stored in the [MetadataKeyPayloadCodec] metadata value,
+	// so that subscribers decode only compressed payloads.
+	// Nil value inserts payloads as they are.
+	PayloadCodec PayloadCodec
+
+	// PayloadCodecThreshold is the smallest payload size in bytes that is compressed.
+	// Smaller payloads gain little from compression. Default value is 1024.
+	PayloadCodecThreshold int
+
+	// KeyProvider enables envelope encryption of payloads and metadata
+	// of published messages with AES-GCM. Subscribers need a provider
+	// with the same keys. Nil value inserts messages as they are.
+	KeyProvider KeyProvider
+
+	// MeterProvider records the number, size, and latency of published messages.
+	// Nil value disables metrics.
+	MeterProvider metric.MeterProvider
+
+	// TracerProvider creates a producer span for each message as a child of the message context.
+	// The span context is stored in message metadata, so subscribers can continue the trace.
+	// Nil value disables tracing.
+	TracerProvider trace.TracerProvider
+
+	// Propagator injects the producer span context into message metadata.
+	// Default value is [propagation.TraceContext], which writes W3C Trace Context headers.
+	Propagator propagation.TextMapPropagator
+
 	// Logger reports message publishing errors and traces. Defaults value is [watermill.NopLogger].
 	Logger watermill.LoggerAdapter
 }
@@ -33,14 +94,25 @@ type PublisherOptions struct {
 type publisher struct {
 	TopicTableNameGenerator   TableNameGenerator
 	OffsetsTableNameGenerator TableNameGenerator
+	SchemaAdapter             SchemaAdapter
+	OffsetsAdapter            OffsetsAdapter
 	InitializeSchema          bool
+	IgnoreDuplicateUUIDs      bool
+	MaxBatchSize              int
+	PayloadCodec              PayloadCodec
+	PayloadCodecThreshold     int
+	KeyProvider               KeyProvider
 	UUID                      string
+	Metrics                   *publisherMetrics
+	Tracer                    *publisherTracer
 	Logger                    watermill.LoggerAdapter
 
-	mu          sync.Mutex
-	closed      bool
-	connection  *sqlite.Conn
-	knownTopics map[string]struct{}
+	mu         sync.Mutex
+	closed     bool
+	connection *sqlite.Conn
+
+	knownTopicsMu sync.Mutex
+	knownTopics   map[string]struct{}
 }
 
 // NewPublisher creates a [message.Publisher] instance from a [SQLiteDatabase] connection handler.
@@ -48,14 +120,52 @@ func NewPublisher(conn *sqlite.Conn, options PublisherOptions) (message.Publishe
 	if conn == nil {
 		return nil, ErrDatabaseConnectionIsNil
 	}
+	p, err := newPublisher(options)
+	if err != nil {
+		return nil, err
+	}
+	p.connection = conn
+	return p, nil
+}
 
-	ID := uuid.New().String()
+func newPublisher(options PublisherOptions) (*publisher, error) {
+	if options.MaxBatchSize < 0 {
+		return nil, errors.New("MaxBatchSize must not be negative")
+	}
+	if options.PayloadCodecThreshold < 0 {
+		return nil, errors.New("PayloadCodecThreshold must not be negative")
+	}
 	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	schemaAdapter := cmpOrTODO[SchemaAdapter](options.SchemaAdapter, DefaultSchemaAdapter{})
+	offsetsAdapter := cmpOrTODO[OffsetsAdapter](options.OffsetsAdapter, DefaultOffsetsAdapter{})
+	if err := validateAdapters(tng, schemaAdapter, offsetsAdapter); err != nil {
+		return nil, err
+	}
+	maxBatchSize, err := validateMaxBatchSize(options.MaxBatchSize, tng, schemaAdapter)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := newPublisherMetrics(options.MeterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create publisher metrics: %w", err)
+	}
+
+	ID := uuid.New().String()
 	return &publisher{
 		UUID:                      ID,
 		TopicTableNameGenerator:   tng.Topic,
 		OffsetsTableNameGenerator: tng.Offsets,
+		SchemaAdapter:             schemaAdapter,
+		OffsetsAdapter:            offsetsAdapter,
 		InitializeSchema:          options.InitializeSchema,
+		IgnoreDuplicateUUIDs:      options.IgnoreDuplicateUUIDs,
+		MaxBatchSize:              maxBatchSize,
+		PayloadCodec:              options.PayloadCodec,
+		PayloadCodecThreshold:     cmpOrTODO(options.PayloadCodecThreshold, 1024),
+		KeyProvider:               options.KeyProvider,
+		Metrics:                   metrics,
+		Tracer:                    newPublisherTracer(options.TracerProvider, options.Propagator),
 		Logger: cmpOrTODO[watermill.LoggerAdapter](
 			options.Logger,
 			defaultLogger,
@@ -63,7 +173,6 @@ func NewPublisher(conn *sqlite.Conn, options PublisherOptions) (message.Publishe
 			"publisher_id": ID,
 		}),
 		mu:          sync.Mutex{},
-		connection:  conn,
 		knownTopics: make(map[string]struct{}),
 	}, nil
 }
@@ -84,47 +193,124 @@ func (p *publisher) Publish(topic string, messages ...*message.Message) (err err
 	if len(messages) == 0 {
 		return nil
 	}
+	return p.insert(p.connection, topic, messages)
+}
+
+// insert initializes topic schema, if enabled, and inserts messages using the connection.
+func (p *publisher) insert(conn *sqlite.Conn, topic string, messages message.Messages) (err error) {
 	messagesTableName := p.TopicTableNameGenerator(topic)
+	start := time.Now()
+	if err = p.initializeSchema(conn, topic, messagesTableName); err != nil {
+		return err
+	}
 
-	if p.InitializeSchema {
-		if _, ok := p.knownTopics[topic]; !ok {
-			if err = createTopicAndOffsetsTablesIfAbsent(
-				p.connection,
-				messagesTableName,
-				p.OffsetsTableNameGenerator(topic),
-			); err != nil {
-				return err
-			}
-			p.knownTopics[topic] = struct{}{}
-		}
+	spans := p.Tracer.Start(topic, messages)
+	defer func() {
+		spans.End(err)
+	}()
+	if messages, err = encodePayloads(p.PayloadCodec, p.PayloadCodecThreshold, messages); err != nil {
+		return err
+	}
+	if messages, err = encryptMessages(p.KeyProvider, messages); err != nil {
+		return err
 	}
+	inserted, err := p.insertChunks(conn, topic, messagesTableName, messages)
+	if err != nil {
+		return err
+	}
+	p.Metrics.Published(topic, messages, inserted, start)
+	if conn.AutocommitEnabled() {
+		// messages inserted within a transaction are not visible until the commit
+		published.Notify(messagesTableName)
+	}
+	return nil
+}
 
-	b := strings.Builder{}
-	_, _ = b.WriteString("INSERT INTO '")
-	_, _ = b.WriteString(messagesTableName)
-	_, _ = b.WriteString("' (uuid, created_at, payload, metadata) VALUES ")
+// insertChunks splits messages into statements of at most MaxBatchSize messages.
+// Statements are wrapped into a savepoint to keep publishing atomic
+// when messages do not fit into a single statement.
+// Returns the number of inserted messages, which excludes skipped duplicates.
+func (p *publisher) insertChunks(conn *sqlite.Conn, topic, messagesTableName string, messages message.Messages) (inserted int64, err error) {
+	if len(messages) > p.MaxBatchSize {
+		defer sqlitex.Save(conn)(&err)
+	}
+	for len(messages) > 0 {
+		chunk := messages[:min(len(messages), p.MaxBatchSize)]
+		messages = messages[len(chunk):]
 
-	arguments := make([]any, 0, len(messages)*4)
-	for _, msg := range messages {
-		metadata, err := json.Marshal(msg.Metadata)
+		query, arguments, err := p.SchemaAdapter.InsertQuery(InsertQueryParams{
+			Topic:       topic,
+			TopicTable:  messagesTableName,
+			Messages:    chunk,
+			UniqueUUIDs: p.IgnoreDuplicateUUIDs,
+		})
 		if err != nil {
-			return fmt.Errorf("unable to encode message %q metadata to JSON: %w", msg.UUID, err)
+			return 0, err
 		}
-		arguments = append(arguments, msg.UUID, time.Now().Format(time.RFC3339), msg.Payload, metadata)
-		b.WriteString(`(?,?,?,?),`)
-	}
-
-	query := strings.TrimRight(b.String(), ",") + ";"
-	p.Logger.Trace("Inserting messages into SQLite table", watermill.LogFields{
-		"query":      query,
-		"query_args": arguments,
-	})
-	return sqlitex.ExecuteTransient(
-		p.connection,
-		query,
-		&sqlitex.ExecOptions{
-			Args: arguments,
+		p.Logger.Trace("Inserting messages into SQLite table", watermill.LogFields{
+			"query":      query,
+			"query_args": arguments,
 		})
+		if err = sqlitex.ExecuteTransient(
+			conn,
+			query,
+			&sqlitex.ExecOptions{
+				Args: arguments,
+			}); err != nil {
+			return 0, err
+		}
+		inserted += int64(conn.Changes())
+		if skipped := len(chunk) - conn.Changes(); p.IgnoreDuplicateUUIDs && skipped > 0 {
+			p.Logger.Debug("Skipped messages with UUIDs that were already published", watermill.LogFields{
+				"topic":   topic,
+				"skipped": skipped,
+			})
+		}
+	}
+	return inserted, nil
+}
+
+// initializeSchema creates topic tables once per topic per publisher instance.
+// Without InitializeSchema option, it checks that the topic table was not
+// upgraded by a newer version of the library instead.
+func (p *publisher) initializeSchema(conn *sqlite.Conn, topic, messagesTableName string) (err error) {
+	p.knownTopicsMu.Lock()
+	defer p.knownTopicsMu.Unlock()
+	if _, ok := p.knownTopics[topic]; ok {
+		return nil
+	}
+	if !p.InitializeSchema {
+		if err = checkSchemaVersions(conn, map[string]string{messagesTableName: schemaKindTopic}); err != nil {
+			return err
+		}
+		p.knownTopics[topic] = struct{}{}
+		return nil
+	}
+	if err = createTopicAndOffsetsTablesIfAbsent(
+		conn,
+		p.SchemaAdapter,
+		p.OffsetsAdapter,
+		SchemaInitializingQueriesParams{
+			Topic:        topic,
+			TopicTable:   messagesTableName,
+			OffsetsTable: p.OffsetsTableNameGenerator(topic),
+			UniqueUUIDs:  p.IgnoreDuplicateUUIDs,
+		},
+	); err != nil {
+		return err
+	}
+	if conn.AutocommitEnabled() {
+		// tables created within a transaction are gone, if the transaction is rolled back
+		p.knownTopics[topic] = struct{}{}
+	}
+	return nil
+}
+
+// IsClosed returns true if the publisher is closed.
+func (p *publisher) IsClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
 }
 
 func (p *publisher) Close() error {
@@ -137,3 +323,42 @@ func (p *publisher) Close() error {
 func (p *publisher) String() string {
 	return "sqlite3-zombiezen-publisher-" + p.UUID
 }
+
+// maxBoundParameters is the default SQLite limit on the number of parameters bound to a statement.
+const maxBoundParameters = 32766
+
+// validateMaxBatchSize returns the default batch size if the given one is zero.
+// Returns an error if a statement inserting a batch binds more parameters than SQLite allows.
+func validateMaxBatchSize(maxBatchSize int, tng TableNameGenerators, adapter SchemaAdapter) (int, error) {
+	// parameters bound per message are counted by the difference between
+	// insert queries of two messages and one message
+	params := InsertQueryParams{
+		Topic:      "probe",
+		TopicTable: tng.Topic("probe"),
+		Messages: message.Messages{
+			message.NewMessage("probe", []byte{}),
+			message.NewMessage("probe", []byte{}),
+		},
+	}
+	_, two, err := adapter.InsertQuery(params)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count insert query parameters: %w", err)
+	}
+	params.Messages = params.Messages[:1]
+	_, one, err := adapter.InsertQuery(params)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count insert query parameters: %w", err)
+	}
+	perMessage := len(two) - len(one)
+	if perMessage <= 0 {
+		return cmpOrTODO(maxBatchSize, 1000), nil
+	}
+	limit := (maxBoundParameters - (len(one) - perMessage)) / perMessage
+	if maxBatchSize == 0 {
+		return min(1000, limit), nil
+	}
+	if maxBatchSize > limit {
+		return 0, fmt.Errorf("MaxBatchSize must not exceed %d, because the schema adapter binds %d parameters per message", limit, perMessage)
+	}
+	return maxBatchSize, nil
+}
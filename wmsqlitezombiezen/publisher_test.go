@@ -1,7 +1,10 @@
 package wmsqlitezombiezen
 
 import (
+	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
@@ -42,3 +45,293 @@ func TestPublisher(t *testing.T) {
 
 	// t.Fatal("implement")
 }
+
+func TestPoolPublisher(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	pool, err := sqlitex.NewPool(DSN, sqlitex.PoolOptions{PoolSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	pub, err := NewPoolPublisher(pool, PublisherOptions{
+		InitializeSchema: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{})
+
+	topic := "TestPoolPublisher"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const concurrent = 8
+	errs := make(chan error, concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func(i int) {
+			errs <- pub.Publish(topic, message.NewMessage(strconv.Itoa(i), []byte{}))
+		}(i)
+	}
+	for i := 0; i < concurrent; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := pool.Take(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishInTransaction := func(id string, commit bool) (err error) {
+		defer sqlitex.Transaction(conn)(&err)
+		if err = pub.PublishInTransaction(conn, topic, message.NewMessage(id, []byte{})); err != nil {
+			return err
+		}
+		if !commit {
+			return errors.New("rolled back")
+		}
+		return nil
+	}
+	if err = publishInTransaction("rolled back", false); err == nil {
+		t.Fatal("transaction must be rolled back")
+	}
+	if err = publishInTransaction("committed", true); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn)
+
+	received := make(map[string]struct{})
+	for len(received) < concurrent+1 {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("expected %d messages, received %d", concurrent+1, len(received))
+		}
+	}
+	if _, ok := received["committed"]; !ok {
+		t.Fatal("message published in committed transaction was not received")
+	}
+	if _, ok := received["rolled back"]; ok {
+		t.Fatal("message published in rolled back transaction was received")
+	}
+}
+
+func TestBatchingPublisher(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	pub, err := NewBatchingPublisher(newTestConnection(t, DSN), BatchingPublisherOptions{
+		PublisherOptions: PublisherOptions{
+			InitializeSchema: true,
+		},
+		Window: time.Millisecond * 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{})
+
+	topic := "TestBatchingPublisher"
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const concurrent = 32
+	errs := make(chan error, concurrent+1)
+	for i := 0; i < concurrent; i++ {
+		go func(i int) {
+			errs <- pub.Publish(topic, message.NewMessage(strconv.Itoa(i), []byte{}))
+		}(i)
+	}
+	go func() {
+		// fails the batch it lands in, which must not fail other publishing calls
+		invalid := message.NewMessage("invalid", []byte{})
+		invalid.Metadata.Set(MetadataKeyDeliverAt, "tomorrow")
+		errs <- pub.Publish(topic, invalid)
+	}()
+	failed := 0
+	for i := 0; i < concurrent+1; i++ {
+		if err = <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected only the invalid message to fail publishing, got %d failures", failed)
+	}
+
+	received := make(map[string]struct{})
+	for len(received) < concurrent {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("expected %d messages, received %d", concurrent, len(received))
+		}
+	}
+
+	if err = pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(topic, message.NewMessage("closed", []byte{})); !errors.Is(err, ErrPublisherIsClosed) {
+		t.Fatalf("expected %q error, got %v", ErrPublisherIsClosed, err)
+	}
+}
+
+func TestPublishInChunks(t *testing.T) {
+	countMessages := func(t *testing.T, conn *sqlite.Conn, topic string) (count int) {
+		t.Helper()
+		if err := sqlitex.ExecuteTransient(conn, `SELECT COUNT(*) FROM 'watermill_`+topic+`';`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				count = stmt.ColumnInt(0)
+				return nil
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	t.Run("hundreds of thousands of messages", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("publishing hundreds of thousands of messages takes several seconds")
+		}
+		conn := newTestConnection(t, ":memory:")
+		pub := newTestPublisher(t, conn, PublisherOptions{})
+
+		const total = 200_000
+		messages := make(message.Messages, total)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		topic := "TestPublishInChunks"
+		if err := pub.Publish(topic, messages...); err != nil {
+			t.Fatal(err)
+		}
+		if count := countMessages(t, conn, topic); count != total {
+			t.Fatalf("expected %d published messages, got %d", total, count)
+		}
+	})
+
+	t.Run("failed chunk rolls back publishing", func(t *testing.T) {
+		conn := newTestConnection(t, ":memory:")
+		pub := newTestPublisher(t, conn, PublisherOptions{
+			MaxBatchSize: 10,
+		})
+
+		messages := make(message.Messages, 25)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		messages[24].Metadata.Set(MetadataKeyDeliverAt, "tomorrow")
+		topic := "TestPublishInChunksRollback"
+		if err := pub.Publish(topic, messages...); err == nil {
+			t.Fatal("publishing must fail on the invalid message in the last chunk")
+		}
+		if count := countMessages(t, conn, topic); count != 0 {
+			t.Fatalf("expected chunks inserted before the failure to be rolled back, got %d messages", count)
+		}
+	})
+
+	t.Run("batch size within the bound parameter limit", func(t *testing.T) {
+		conn := newTestConnection(t, ":memory:")
+		singleTable := PublisherOptions{
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+		}
+		for _, tc := range []struct {
+			options PublisherOptions
+			limit   int
+		}{
+			{options: PublisherOptions{}, limit: 6553},
+			{options: singleTable, limit: 5461},
+		} {
+			tc.options.MaxBatchSize = tc.limit + 1
+			if _, err := NewPublisher(conn, tc.options); err == nil {
+				t.Fatalf("MaxBatchSize of %d messages must be rejected", tc.options.MaxBatchSize)
+			}
+		}
+
+		singleTable.MaxBatchSize = 5461
+		pub := newTestPublisher(t, conn, singleTable)
+		messages := make(message.Messages, singleTable.MaxBatchSize)
+		for i := range messages {
+			messages[i] = message.NewMessage(strconv.Itoa(i), []byte("test"))
+		}
+		if err := pub.Publish("TestPublishInChunksLimit", messages...); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPublishIgnoringDuplicateUUIDs(t *testing.T) {
+	newMessages := func(UUIDs ...string) (messages message.Messages) {
+		for _, UUID := range UUIDs {
+			messages = append(messages, message.NewMessage(UUID, []byte(UUID)))
+		}
+		return messages
+	}
+
+	for name, options := range map[string]PublisherOptions{
+		"table per topic": {},
+		"single table": {
+			TableNameGenerators: SingleTableNameGenerators(),
+			SchemaAdapter:       SingleTableSchemaAdapter{},
+			OffsetsAdapter:      SingleTableOffsetsAdapter{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := newTestConnection(t, ":memory:")
+			options.InitializeSchema = true
+			options.IgnoreDuplicateUUIDs = true
+			options.MaxBatchSize = 2
+			pub, err := NewPublisher(conn, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+			countMessages := func(t *testing.T, topic string) (count int) {
+				t.Helper()
+				query := `SELECT COUNT(*) FROM '` + tng.Topic(topic) + `'`
+				if tng.sharesTables() {
+					query += ` WHERE topic='` + topic + `'`
+				}
+				count, err := sqlitex.ResultInt(conn.Prep(query + `;`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return count
+			}
+
+			topic := "TestPublishIgnoringDuplicateUUIDs"
+			if err = pub.Publish(topic, newMessages("1", "2", "3")...); err != nil {
+				t.Fatal(err)
+			}
+			// retried publishing overlaps with the previous one and repeats a message
+			if err = pub.Publish(topic, newMessages("2", "3", "4", "4")...); err != nil {
+				t.Fatal(err)
+			}
+			if count := countMessages(t, topic); count != 4 {
+				t.Fatalf("expected four unique messages, got %d", count)
+			}
+
+			if err = pub.Publish(topic+"Other", newMessages("1")...); err != nil {
+				t.Fatal(err)
+			}
+			if count := countMessages(t, topic+"Other"); count != 1 {
+				t.Fatalf("UUIDs must be unique within a topic only, got %d messages", count)
+			}
+		})
+	}
+}
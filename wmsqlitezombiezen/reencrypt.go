@@ -0,0 +1,173 @@
+package wmsqlitezombiezen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ReEncryptOptions configure [ReEncryptTopics].
+type ReEncryptOptions struct {
+	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
+	// Must match the generators used by the [Publisher] and the [Subscriber].
+	// Defaults to [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// Topics limits re-encryption to the listed topics. If empty,
+	// topics are discovered by matching SQLite table names against TableNameGenerators.
+	Topics []string
+
+	// KeyProvider supplies the current key, which encrypts data keys of rewritten rows,
+	// and the keys named by existing rows. Required.
+	KeyProvider KeyProvider
+
+	// EncryptPlaintext also encrypts rows that were published without encryption.
+	EncryptPlaintext bool
+}
+
+// reEncryptionBatchSize limits the number of rows rewritten by one transaction,
+// so that publishers and subscribers are not blocked for long.
+const reEncryptionBatchSize = 500
+
+// ReEncryptTopics rewrites rows whose data keys are encrypted by keys other than
+// the current key of the provider. Payloads of encrypted rows are not rewritten,
+// because only their data keys are encrypted again. Once it completes,
+// rotated keys can be removed from the provider. Returns the number of rewritten rows.
+func ReEncryptTopics(conn *sqlite.Conn, options ReEncryptOptions) (rewritten int64, err error) {
+	if conn == nil {
+		return 0, ErrDatabaseConnectionIsNil
+	}
+	if options.KeyProvider == nil {
+		return 0, errors.New("KeyProvider is required")
+	}
+	for _, topic := range options.Topics {
+		if err = validateTopicName(topic); err != nil {
+			return 0, err
+		}
+	}
+	keyID, key, err := options.KeyProvider.CurrentKey()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get current encryption key: %w", err)
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return 0, ErrSingleTableStorageIsNotSupported
+	}
+	topics := options.Topics
+	if len(topics) == 0 {
+		if topics, err = findTopics(conn, tng); err != nil {
+			return 0, err
+		}
+	}
+
+	selectQuery := `SELECT "offset", uuid, payload, metadata FROM '%s'
+		WHERE "offset">? AND json_extract(metadata, '$.` + MetadataKeyEncryptionKeyID + `') IS NOT ?`
+	if !options.EncryptPlaintext {
+		selectQuery += ` AND json_extract(metadata, '$.` + MetadataKeyEncryptionKeyID + `') IS NOT NULL`
+	}
+	selectQuery += fmt.Sprintf(` ORDER BY "offset" LIMIT %d;`, reEncryptionBatchSize)
+
+	for _, topic := range topics {
+		table := tng.Topic(topic)
+		var offset, affected int64
+		for {
+			offset, affected, err = reEncryptBatch(conn, table, fmt.Sprintf(selectQuery, table), options.KeyProvider, keyID, key, offset)
+			rewritten += affected
+			if err != nil {
+				return rewritten, fmt.Errorf("unable to re-encrypt topic %q: %w", topic, err)
+			}
+			if affected == 0 {
+				break
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+type reEncryptedRow struct {
+	Offset   int64
+	Payload  []byte
+	Metadata []byte
+}
+
+// reEncryptBatch rewrites rows following the offset within one transaction
+// and returns the offset of the last rewritten row.
+func reEncryptBatch(
+	conn *sqlite.Conn,
+	table string,
+	selectQuery string,
+	keys KeyProvider,
+	keyID string,
+	key []byte,
+	offset int64,
+) (last int64, rewritten int64, err error) {
+	defer sqlitex.Transaction(conn)(&err)
+
+	batch := make([]reEncryptedRow, 0, reEncryptionBatchSize)
+	if err = sqlitex.Execute(conn, selectQuery, &sqlitex.ExecOptions{
+		Args: []any{offset, keyID},
+		ResultFunc: func(stmt *sqlite.Stmt) (err error) {
+			row := reEncryptedRow{
+				Offset:  stmt.ColumnInt64(0),
+				Payload: make([]byte, stmt.ColumnLen(2)),
+			}
+			stmt.ColumnBytes(2, row.Payload)
+			rawMetadata := make([]byte, stmt.ColumnLen(3))
+			stmt.ColumnBytes(3, rawMetadata)
+			if row.Payload, row.Metadata, err = reEncryptRow(keys, keyID, key, stmt.ColumnText(1), row.Payload, rawMetadata); err != nil {
+				return err
+			}
+			batch = append(batch, row)
+			return nil
+		},
+	}); err != nil {
+		return offset, 0, err
+	}
+
+	for _, row := range batch {
+		if err = sqlitex.Execute(conn, `UPDATE '`+table+`' SET payload=?, metadata=? WHERE "offset"=?;`, &sqlitex.ExecOptions{
+			Args: []any{row.Payload, row.Metadata, row.Offset},
+		}); err != nil {
+			return offset, 0, err
+		}
+	}
+	if len(batch) == 0 {
+		return offset, 0, nil
+	}
+	return batch[len(batch)-1].Offset, int64(len(batch)), nil
+}
+
+// reEncryptRow encrypts the data key of an encrypted row with the current key
+// or encrypts a plain text row entirely.
+func reEncryptRow(keys KeyProvider, keyID string, key []byte, id string, payload, rawMetadata []byte) ([]byte, []byte, error) {
+	metadata := message.Metadata{}
+	if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse message %q metadata JSON: %w", id, err)
+	}
+	if metadata.Get(MetadataKeyEncryptionKeyID) == "" {
+		msg := message.NewMessage(id, payload)
+		msg.Metadata = metadata
+		encrypted, err := encryptMessage(keyID, key, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, metadata = encrypted.Payload, encrypted.Metadata
+	} else {
+		dataKey, err := unwrapDataKey(keys, metadata)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decrypt message %q data key: %w", id, err)
+		}
+		if err = wrapDataKey(metadata, keyID, key, dataKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	rawMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode message %q metadata to JSON: %w", id, err)
+	}
+	return payload, rawMetadata, nil
+}
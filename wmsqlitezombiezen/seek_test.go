@@ -0,0 +1,112 @@
+package wmsqlitezombiezen
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestSeek(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+
+	topic := "TestSeek"
+	for i := 1; i <= 3; i++ {
+		if err := pub.Publish(topic, message.NewMessage(strconv.Itoa(i), []byte{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 5) // SQLite time functions have millisecond precision
+	afterPublishing := time.Now()
+	time.Sleep(time.Millisecond * 5)
+
+	receive := func(t *testing.T, options SubscriberOptions, expected string) {
+		t.Helper()
+		options.PollInterval = time.Millisecond * 20
+		options.LockTimeout = time.Second
+		options.InitializeSchema = true
+		sub, err := NewSubscriber(DSN, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := sub.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		subCtx, subCancel := context.WithCancel(ctx)
+		defer subCancel()
+		messages, err := sub.Subscribe(subCtx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-messages:
+			msg.Ack()
+			if msg.UUID != expected {
+				t.Fatalf("expected message %q, got %q", expected, msg.UUID)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("message %q was not delivered", expected)
+		}
+	}
+
+	t.Run("new consumer group starts from the latest message", func(t *testing.T) {
+		if err := pub.Publish(topic, message.NewMessage("4", []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, SubscriberOptions{
+			InitialPosition: PositionAtTime(afterPublishing),
+		}, "4")
+	})
+
+	for _, tc := range []struct {
+		Position    Position
+		OffsetAcked int64
+	}{
+		{Position: PositionAtOffset(2), OffsetAcked: 1},
+		{Position: PositionAtTime(afterPublishing), OffsetAcked: 3},
+		{Position: PositionLatest(), OffsetAcked: 4},
+		{Position: PositionEarliest(), OffsetAcked: 0},
+	} {
+		t.Run("seek to "+tc.Position.String(), func(t *testing.T) {
+			offsetAcked, err := Seek(ctx, conn, SeekOptions{
+				Topic:    topic,
+				Position: tc.Position,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offsetAcked != tc.OffsetAcked {
+				t.Fatalf("expected acknowledged offset %d, got %d", tc.OffsetAcked, offsetAcked)
+			}
+		})
+	}
+
+	t.Run("replay after seeking", func(t *testing.T) {
+		receive(t, SubscriberOptions{}, "1")
+	})
+
+	t.Run("offsets table that was not migrated", func(t *testing.T) {
+		if err := sqlitex.ExecuteScript(conn, `
+			CREATE TABLE 'watermill_legacy' ("offset" INTEGER PRIMARY KEY AUTOINCREMENT, uuid TEXT NOT NULL, created_at TEXT NOT NULL, payload BLOB NOT NULL, metadata JSON NOT NULL);
+			CREATE TABLE 'watermill_offsets_legacy' (consumer_group TEXT NOT NULL, offset_acked INTEGER NOT NULL, locked_until INTEGER NOT NULL, PRIMARY KEY(consumer_group));
+		`, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Seek(ctx, conn, SeekOptions{
+			Topic:    "legacy",
+			Position: PositionLatest(),
+		}); !errors.Is(err, ErrSchemaIsOlder) {
+			t.Fatalf("expected %v, got %v", ErrSchemaIsOlder, err)
+		}
+	})
+}
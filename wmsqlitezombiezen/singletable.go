@@ -0,0 +1,481 @@
+package wmsqlitezombiezen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	// SingleTableMessagesTableName is the table that stores messages of every topic
+	// in single-table storage. The name never collides with tables of the default generators.
+	SingleTableMessagesTableName = "watermill.messages"
+
+	// SingleTableOffsetsTableName is the table that stores consumer group offsets
+	// of every topic in single-table storage.
+	SingleTableOffsetsTableName = "watermill.offsets"
+
+	// SingleTableDeliveriesTableName is the table that stores message deliveries
+	// of every topic in single-table storage.
+	SingleTableDeliveriesTableName = "watermill.deliveries"
+)
+
+// SingleTableNameGenerators name the shared tables of single-table storage for every topic.
+// Use them together with [SingleTableSchemaAdapter] and [SingleTableOffsetsAdapter]
+// when many topics would otherwise create thousands of tables.
+//
+// Offsets are shared by every topic, so offsets of a topic are increasing, but not consecutive.
+//
+// Operations that address topics by their tables do not support single-table storage:
+//   - [Seek], [NewInspector], [CleanUpTopics], [ReEncryptTopics], and [Migrate]
+//     return [ErrSingleTableStorageIsNotSupported];
+//   - subscribing to a topic pattern returns [ErrSingleTableStorageIsNotSupported];
+//   - the wmsqlite command line tool only reads table-per-topic storage.
+//
+// Use [MigrateToSingleTable] to move topics from the table-per-topic layout.
+// The migration is one way: there is no migration back to table-per-topic storage.
+func SingleTableNameGenerators() TableNameGenerators {
+	return TableNameGenerators{
+		Topic: func(topic string) string {
+			return SingleTableMessagesTableName
+		},
+		Offsets: func(topic string) string {
+			return SingleTableOffsetsTableName
+		},
+		Deliveries: func(topic string) string {
+			return SingleTableDeliveriesTableName
+		},
+	}
+}
+
+// sharesTables reports whether generators name one table for every topic.
+func (t TableNameGenerators) sharesTables() bool {
+	return t.Topic("a") == t.Topic("b")
+}
+
+// singleTableAdapter is satisfied by adapters, including the ones that embed them,
+// that store every topic in one table with a topic column.
+type singleTableAdapter interface {
+	storesTopicColumn()
+}
+
+func (a SingleTableSchemaAdapter) storesTopicColumn()  {}
+func (a SingleTableOffsetsAdapter) storesTopicColumn() {}
+
+// maxOffsetQuery selects the offset of the latest message of the subscription topic.
+func maxOffsetQuery(adapter SchemaAdapter, params SubscriptionQueryParams) string {
+	if _, ok := adapter.(singleTableAdapter); ok {
+		return `SELECT COALESCE(MAX("offset"), 0) FROM '` + params.TopicTable + `' WHERE topic='` + params.Topic + `';`
+	}
+	return `SELECT COALESCE(MAX("offset"), 0) FROM '` + params.TopicTable + `';`
+}
+
+// validateAdapters rejects the default adapters combined with table name generators
+// that name one table for every topic, because they would mix up messages of different topics.
+func validateAdapters(tng TableNameGenerators, schemaAdapter SchemaAdapter, offsetsAdapter OffsetsAdapter) error {
+	if !tng.sharesTables() {
+		return nil
+	}
+	if _, ok := schemaAdapter.(DefaultSchemaAdapter); ok {
+		return fmt.Errorf("table %q is shared by every topic: use SingleTableSchemaAdapter", tng.Topic("a"))
+	}
+	if _, ok := offsetsAdapter.(DefaultOffsetsAdapter); ok {
+		return fmt.Errorf("table %q is shared by every topic: use SingleTableOffsetsAdapter", tng.Offsets("a"))
+	}
+	return nil
+}
+
+// SingleTableSchemaAdapter is the [SchemaAdapter] that stores every topic in one table
+// with a topic column and a composite index on the topic and offset.
+// Use it with [SingleTableNameGenerators].
+type SingleTableSchemaAdapter struct{}
+
+// SchemaInitializingQueries satisfies the [SchemaAdapter] interface.
+func (a SingleTableSchemaAdapter) SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string {
+	queries := []string{`CREATE TABLE IF NOT EXISTS '` + params.TopicTable + `' (
+		'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		topic TEXT NOT NULL,
+		uuid TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		metadata JSON NOT NULL,
+		deliver_at INTEGER NOT NULL DEFAULT 0
+	);`, `CREATE INDEX IF NOT EXISTS '` + params.TopicTable + `_topic_offset' ON '` + params.TopicTable + `' (topic, "offset");`}
+	if params.UniqueUUIDs {
+		queries = append(queries, `CREATE UNIQUE INDEX IF NOT EXISTS '`+params.TopicTable+`_topic_uuid' ON '`+params.TopicTable+`' (topic, uuid);`)
+	}
+	return queries
+}
+
+// InsertQuery satisfies the [SchemaAdapter] interface.
+func (a SingleTableSchemaAdapter) InsertQuery(params InsertQueryParams) (query string, args []any, err error) {
+	b := strings.Builder{}
+	_, _ = b.WriteString("INSERT INTO '")
+	_, _ = b.WriteString(params.TopicTable)
+	_, _ = b.WriteString("' (topic, uuid, created_at, payload, metadata, deliver_at) VALUES ")
+
+	args = make([]any, 0, len(params.Messages)*6)
+	for _, msg := range params.Messages {
+		metadata, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to encode message %q metadata to JSON: %w", msg.UUID, err)
+		}
+		deliverAt, err := parseDeliverAt(msg)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, params.Topic, msg.UUID, time.Now().UTC().Format(createdAtLayout), msg.Payload, metadata, deliverAt)
+		b.WriteString(`(?,?,?,?,?,?),`)
+	}
+	query = strings.TrimRight(b.String(), ",")
+	if params.UniqueUUIDs {
+		query += ` ON CONFLICT(topic, uuid) DO NOTHING`
+	}
+	return query + ";", args, nil
+}
+
+// NextBatchQuery satisfies the [SchemaAdapter] interface.
+func (a SingleTableSchemaAdapter) NextBatchQuery(params SubscriptionQueryParams) string {
+	if params.DeliveriesTable == "" {
+		var condition string
+		if len(params.MetadataFilter) > 0 {
+			condition = ` AND ` + params.MetadataFilter.Condition("metadata")
+		}
+		return fmt.Sprintf(`
+			SELECT "offset", uuid, created_at, %s, metadata, 0
+			FROM '%s'
+			WHERE topic='%s' AND "offset">?%s ORDER BY "offset" LIMIT %d;`,
+			payloadColumn("payload", params.PayloadStreamingThreshold), params.TopicTable, params.Topic, condition, params.BatchSize)
+	}
+
+	var condition string
+	if len(params.MetadataFilter) > 0 {
+		condition = ` AND ` + params.MetadataFilter.Condition("t.metadata")
+	}
+	if params.DelayedDelivery {
+		condition += ` AND t.deliver_at<=CAST(unixepoch('subsec')*1000 AS INTEGER)`
+	}
+	if params.DelayedDelivery || params.MessageLeases {
+		condition += ` AND COALESCE(d.acked, 0)=0`
+	}
+	if params.MessageLeases {
+		condition += ` AND ` + lockedUntil("d.leased_until") + `<CAST(unixepoch('subsec')*1000 AS INTEGER)`
+	}
+	return fmt.Sprintf(`
+		SELECT t."offset", t.uuid, t.created_at, %s, t.metadata, COALESCE(d.attempts, 0)
+		FROM '%s' AS t LEFT JOIN '%s' AS d ON d.topic=t.topic AND d.consumer_group='%s' AND d."offset"=t."offset"
+		WHERE t.topic='%s' AND t."offset">?%s ORDER BY t."offset" LIMIT %d;`,
+		payloadColumn("t.payload", params.PayloadStreamingThreshold), params.TopicTable, params.DeliveriesTable, params.ConsumerGroup, params.Topic, condition, params.BatchSize)
+}
+
+// SingleTableOffsetsAdapter is the [OffsetsAdapter] that keeps consumer groups
+// of every topic in one offsets table and one deliveries table, keyed by topic
+// and consumer group. Use it with [SingleTableNameGenerators].
+type SingleTableOffsetsAdapter struct{}
+
+// SchemaInitializingQueries satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) SchemaInitializingQueries(params SchemaInitializingQueriesParams) []string {
+	queries := []string{`CREATE TABLE IF NOT EXISTS '` + params.OffsetsTable + `' (
+		topic TEXT NOT NULL,
+		consumer_group TEXT NOT NULL,
+		offset_acked INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL,
+		locked_until_ms INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(topic, consumer_group)
+	);`}
+	if params.DeliveriesTable != "" {
+		queries = append(queries, `CREATE TABLE IF NOT EXISTS '`+params.DeliveriesTable+`' (
+			topic TEXT NOT NULL,
+			consumer_group TEXT NOT NULL,
+			'offset' INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			acked INTEGER NOT NULL DEFAULT 0,
+			leased_until INTEGER NOT NULL DEFAULT 0,
+			leased_until_ms INTEGER NOT NULL DEFAULT 0,
+			lease_owner TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY(topic, consumer_group, 'offset')
+		) WITHOUT ROWID;`)
+	}
+	return queries
+}
+
+// ConsumerGroupInitializingQuery satisfies the [OffsetsAdapter] interface.
+// Position expressions read offsets of every topic, which preserves their meaning,
+// because offsets of the topic are increasing.
+func (a SingleTableOffsetsAdapter) ConsumerGroupInitializingQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (topic, consumer_group, offset_acked, locked_until)
+		VALUES ('%s', '%s', %s, 0)
+		ON CONFLICT(topic, consumer_group) DO NOTHING;`,
+		params.OffsetsTable, params.Topic, params.ConsumerGroup, params.InitialPosition.OffsetAckedExpression(params.TopicTable))
+}
+
+// LockConsumerGroupQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) LockConsumerGroupQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		return a.advanceOffsetQuery(params) + ` RETURNING offset_acked;`
+	}
+	return fmt.Sprintf(
+		`UPDATE '%s' SET %s WHERE topic='%s' AND consumer_group='%s' AND %s<CAST(unixepoch('subsec')*1000 AS INTEGER) RETURNING offset_acked`,
+		params.OffsetsTable,
+		lockUntil("locked_until", params.LockTimeout),
+		params.Topic,
+		params.ConsumerGroup,
+		lockedUntil("locked_until"),
+	)
+}
+
+// ExtendLockQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) ExtendLockQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		return fmt.Sprintf(
+			`UPDATE '%s' SET %s WHERE topic='%s' AND consumer_group='%s' AND lease_owner='%s' AND acked=0;`,
+			params.DeliveriesTable,
+			lockUntil("leased_until", params.LockTimeout),
+			params.Topic,
+			params.ConsumerGroup,
+			params.LeaseOwner,
+		)
+	}
+	return fmt.Sprintf(
+		`UPDATE '%s' SET %s, offset_acked=? WHERE topic='%s' AND consumer_group='%s' AND offset_acked=? AND %s>=CAST(unixepoch('subsec')*1000 AS INTEGER) RETURNING locked_until_ms`,
+		params.OffsetsTable,
+		lockUntil("locked_until", params.LockTimeout),
+		params.Topic,
+		params.ConsumerGroup,
+		lockedUntil("locked_until"),
+	)
+}
+
+// AcknowledgeMessagesQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) AcknowledgeMessagesQuery(params SubscriptionQueryParams) string {
+	if params.MessageLeases {
+		return a.advanceOffsetQuery(params) + `;`
+	}
+	if params.DelayedDelivery {
+		// offset advances up to the first message that was not acknowledged yet
+		return fmt.Sprintf(`
+			UPDATE '%[1]s' SET locked_until=0, locked_until_ms=0, offset_acked=COALESCE(
+				(SELECT MIN(t."offset")-1 FROM '%[2]s' AS t WHERE t.topic='%[4]s' AND t."offset">?2 AND NOT EXISTS (
+					SELECT 1 FROM '%[3]s' AS d WHERE d.topic='%[4]s' AND d.consumer_group='%[5]s' AND d."offset"=t."offset" AND d.acked=1
+				)),
+				(SELECT MAX("offset") FROM '%[2]s' WHERE topic='%[4]s' AND "offset">?2),
+				?2
+			) WHERE topic='%[4]s' AND consumer_group='%[5]s' AND offset_acked=?2;`,
+			params.OffsetsTable, params.TopicTable, params.DeliveriesTable, params.Topic, params.ConsumerGroup)
+	}
+	return fmt.Sprintf(`
+		UPDATE '%s' SET offset_acked=?, locked_until=0, locked_until_ms=0 WHERE topic='%s' AND consumer_group='%s' AND offset_acked = ?;`,
+		params.OffsetsTable, params.Topic, params.ConsumerGroup)
+}
+
+// advanceOffsetQuery moves the consumer group offset up to the first message that was not acknowledged yet.
+func (a SingleTableOffsetsAdapter) advanceOffsetQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		UPDATE '%[1]s' SET offset_acked=COALESCE(
+			(SELECT MIN(t."offset")-1 FROM '%[2]s' AS t WHERE t.topic='%[4]s' AND t."offset">offset_acked AND NOT EXISTS (
+				SELECT 1 FROM '%[3]s' AS d WHERE d.topic='%[4]s' AND d.consumer_group='%[5]s' AND d."offset"=t."offset" AND d.acked=1
+			)),
+			(SELECT MAX("offset") FROM '%[2]s' WHERE topic='%[4]s' AND "offset">offset_acked),
+			offset_acked
+		) WHERE topic='%[4]s' AND consumer_group='%[5]s'`,
+		params.OffsetsTable, params.TopicTable, params.DeliveriesTable, params.Topic, params.ConsumerGroup)
+}
+
+// AcknowledgeDeliveryQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) AcknowledgeDeliveryQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (topic, consumer_group, "offset", acked) VALUES ('%s', '%s', ?, 1)
+		ON CONFLICT(topic, consumer_group, "offset") DO UPDATE SET acked=1;`,
+		params.DeliveriesTable, params.Topic, params.ConsumerGroup)
+}
+
+// CountDeliveryAttemptQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) CountDeliveryAttemptQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (topic, consumer_group, "offset", attempts) VALUES ('%s', '%s', ?, 1)
+		ON CONFLICT(topic, consumer_group, "offset") DO UPDATE SET attempts=attempts+1
+		RETURNING attempts;`,
+		params.DeliveriesTable, params.Topic, params.ConsumerGroup)
+}
+
+// ForgetDeliveriesQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) ForgetDeliveriesQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(
+		`DELETE FROM '%[1]s' WHERE topic='%[3]s' AND consumer_group='%[4]s' AND "offset"<=(SELECT offset_acked FROM '%[2]s' WHERE topic='%[3]s' AND consumer_group='%[4]s');`,
+		params.DeliveriesTable,
+		params.OffsetsTable,
+		params.Topic,
+		params.ConsumerGroup,
+	)
+}
+
+// LeaseMessageQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) LeaseMessageQuery(params SubscriptionQueryParams) string {
+	seconds, milliseconds := lockExpiry(params.LockTimeout)
+	return fmt.Sprintf(`
+		INSERT INTO '%s' (topic, consumer_group, "offset", leased_until, leased_until_ms, lease_owner) VALUES ('%s', '%s', ?, %s, %s, '%s')
+		ON CONFLICT(topic, consumer_group, "offset") DO UPDATE SET leased_until=excluded.leased_until, leased_until_ms=excluded.leased_until_ms, lease_owner=excluded.lease_owner;`,
+		params.DeliveriesTable, params.Topic, params.ConsumerGroup, seconds, milliseconds, params.LeaseOwner)
+}
+
+// ReleaseLeasesQuery satisfies the [OffsetsAdapter] interface.
+func (a SingleTableOffsetsAdapter) ReleaseLeasesQuery(params SubscriptionQueryParams) string {
+	return fmt.Sprintf(
+		`UPDATE '%s' SET leased_until=0, leased_until_ms=0, lease_owner='' WHERE topic='%s' AND consumer_group='%s' AND lease_owner='%s' AND acked=0;`,
+		params.DeliveriesTable,
+		params.Topic,
+		params.ConsumerGroup,
+		params.LeaseOwner,
+	)
+}
+
+// MigrateToSingleTableOptions configure [MigrateToSingleTable].
+type MigrateToSingleTableOptions struct {
+	// TableNameGenerators locate topic, offsets, and deliveries tables of the table-per-topic layout.
+	// Default value is [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	TableNameGenerators TableNameGenerators
+
+	// Topics limits the migration to the listed topics. If empty,
+	// topics are discovered by matching SQLite table names against TableNameGenerators.
+	Topics []string
+}
+
+// MigrateToSingleTable moves messages, consumer group offsets, and deliveries of every topic
+// from the table-per-topic layout into the tables named by [SingleTableNameGenerators]
+// and drops the emptied tables. Each topic is moved within its own transaction,
+// so an interrupted migration resumes with the remaining topics. Messages receive
+// new offsets in their original order, and acknowledged offsets are translated to match.
+//
+// Stop publishers and subscribers of the topics before the migration and restart them
+// with [SingleTableSchemaAdapter] and [SingleTableOffsetsAdapter]. Returns the number of moved messages.
+func MigrateToSingleTable(conn *sqlite.Conn, options MigrateToSingleTableOptions) (moved int64, err error) {
+	if conn == nil {
+		return 0, ErrDatabaseConnectionIsNil
+	}
+	for _, topic := range options.Topics {
+		if err = validateTopicName(topic); err != nil {
+			return 0, err
+		}
+	}
+	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	if tng.sharesTables() {
+		return 0, ErrSingleTableStorageIsNotSupported
+	}
+	topics := options.Topics
+	if len(topics) == 0 {
+		if topics, err = findTopics(conn, tng); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, query := range append(
+		SingleTableSchemaAdapter{}.SchemaInitializingQueries(SchemaInitializingQueriesParams{
+			TopicTable: SingleTableMessagesTableName,
+		}),
+		SingleTableOffsetsAdapter{}.SchemaInitializingQueries(SchemaInitializingQueriesParams{
+			OffsetsTable:    SingleTableOffsetsTableName,
+			DeliveriesTable: SingleTableDeliveriesTableName,
+		})...,
+	) {
+		if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return 0, fmt.Errorf("unable to initialize single-table schema: %w", err)
+		}
+	}
+
+	for _, topic := range topics {
+		affected, err := migrateTopicToSingleTable(conn, tng, topic)
+		moved += affected
+		if err != nil {
+			return moved, fmt.Errorf("unable to migrate topic %q to single-table storage: %w", topic, err)
+		}
+	}
+	return moved, nil
+}
+
+func migrateTopicToSingleTable(conn *sqlite.Conn, tng TableNameGenerators, topic string) (moved int64, err error) {
+	defer sqlitex.Transaction(conn)(&err)
+
+	present := false
+	if err = sqlitex.Execute(conn, `SELECT EXISTS(SELECT 1 FROM '`+SingleTableOffsetsTableName+`' WHERE topic=?1)
+		OR EXISTS(SELECT 1 FROM '`+SingleTableMessagesTableName+`' WHERE topic=?1);`, &sqlitex.ExecOptions{
+		Args: []any{topic},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			present = stmt.ColumnBool(0)
+			return nil
+		},
+	}); err != nil {
+		return 0, err
+	}
+	if present {
+		return 0, errors.New("topic is already present in single-table storage")
+	}
+
+	topicTable, offsetsTable, deliveriesTable := tng.Topic(topic), tng.Offsets(topic), tng.Deliveries(topic)
+	// older tables lack the columns that are copied
+	if err = migrateTable(conn, schemaKindTopic, topicTable); err != nil {
+		return 0, err
+	}
+	if err = migrateTableIfPresent(conn, schemaKindDeliveries, deliveriesTable); err != nil {
+		return 0, err
+	}
+
+	// AUTOINCREMENT assigns consecutive offsets following the sequence to the inserted rows
+	stmt := conn.Prep(`SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name=?), 0);`)
+	stmt.BindText(1, SingleTableMessagesTableName)
+	base, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, err
+	}
+	if err = sqlitex.ExecuteTransient(conn, `
+		INSERT INTO '`+SingleTableMessagesTableName+`' (topic, uuid, created_at, payload, metadata, deliver_at)
+		SELECT ?, uuid, created_at, payload, metadata, deliver_at FROM '`+topicTable+`' ORDER BY "offset";`,
+		&sqlitex.ExecOptions{Args: []any{topic}},
+	); err != nil {
+		return 0, fmt.Errorf("unable to move messages: %w", err)
+	}
+	moved = int64(conn.Changes())
+	if err = sqlitex.ExecuteTransient(conn, `
+		INSERT INTO '`+SingleTableOffsetsTableName+`' (topic, consumer_group, offset_acked, locked_until)
+		SELECT ?, o.consumer_group, ?+(SELECT COUNT(*) FROM '`+topicTable+`' AS t WHERE t."offset"<=o.offset_acked), 0
+		FROM '`+offsetsTable+`' AS o;`,
+		&sqlitex.ExecOptions{Args: []any{topic, base}},
+	); err != nil {
+		return 0, fmt.Errorf("unable to move consumer group offsets: %w", err)
+	}
+
+	dropped := []string{topicTable, offsetsTable}
+	if present, err = tableExists(conn, deliveriesTable); err != nil {
+		return 0, err
+	}
+	if present {
+		if err = sqlitex.ExecuteTransient(conn, `
+			INSERT INTO '`+SingleTableDeliveriesTableName+`' (topic, consumer_group, "offset", attempts, acked, leased_until, leased_until_ms, lease_owner)
+			SELECT ?, d.consumer_group, ?+r.n, d.attempts, d.acked, d.leased_until, d.leased_until_ms, d.lease_owner
+			FROM '`+deliveriesTable+`' AS d JOIN (
+				SELECT "offset", ROW_NUMBER() OVER (ORDER BY "offset") AS n FROM '`+topicTable+`'
+			) AS r ON r."offset"=d."offset";`,
+			&sqlitex.ExecOptions{Args: []any{topic, base}},
+		); err != nil {
+			return 0, fmt.Errorf("unable to move deliveries: %w", err)
+		}
+		dropped = append(dropped, deliveriesTable)
+	}
+
+	for _, table := range dropped {
+		if err = sqlitex.ExecuteTransient(conn, `DROP TABLE '`+table+`';`, nil); err != nil {
+			return 0, fmt.Errorf("unable to drop table %q: %w", table, err)
+		}
+		if err = sqlitex.ExecuteTransient(conn, `DELETE FROM '`+SchemaVersionsTableName+`' WHERE table_name=?;`, &sqlitex.ExecOptions{
+			Args: []any{table},
+		}); err != nil {
+			return 0, fmt.Errorf("unable to forget table %q schema version: %w", table, err)
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,208 @@
+package wmsqlitezombiezen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// StreamingPublisher copies payloads from readers directly into topic tables
+// with incremental BLOB I/O, so that large payloads are never held in memory whole.
+// Subscribers read such payloads lazily with [PayloadReader], when
+// [SubscriberOptions.PayloadStreamingThreshold] is set.
+type StreamingPublisher struct {
+	publisher *publisher
+}
+
+// NewStreamingPublisher creates a [message.Publisher] that also publishes payloads from readers.
+// Streamed payloads are written as they are, so the publisher does not accept a KeyProvider,
+// and PayloadCodec applies only to messages published with [StreamingPublisher.Publish].
+func NewStreamingPublisher(conn *sqlite.Conn, options PublisherOptions) (*StreamingPublisher, error) {
+	if conn == nil {
+		return nil, ErrDatabaseConnectionIsNil
+	}
+	if options.KeyProvider != nil {
+		return nil, errors.New("KeyProvider cannot be combined with payload streaming")
+	}
+	pub, err := newPublisher(options)
+	if err != nil {
+		return nil, err
+	}
+	pub.connection = conn
+	return &StreamingPublisher{publisher: pub}, nil
+}
+
+// Publish pushes messages into a topic the same way as the publisher created by [NewPublisher].
+func (p *StreamingPublisher) Publish(topic string, messages ...*message.Message) error {
+	return p.publisher.Publish(topic, messages...)
+}
+
+// PublishStream pushes a message into a topic with a payload of exactly size bytes
+// copied from the reader. The payload of the message itself is ignored.
+// Returns [ErrPublisherIsClosed] if the publisher is closed.
+func (p *StreamingPublisher) PublishStream(topic string, msg *message.Message, payload io.Reader, size int64) (err error) {
+	if size < 0 {
+		return errors.New("payload size must not be negative")
+	}
+	p.publisher.mu.Lock()
+	defer p.publisher.mu.Unlock()
+	if p.publisher.closed {
+		return ErrPublisherIsClosed
+	}
+
+	conn := p.publisher.connection
+	messagesTableName := p.publisher.TopicTableNameGenerator(topic)
+	start := time.Now()
+	if err = p.publisher.initializeSchema(conn, topic, messagesTableName); err != nil {
+		return err
+	}
+	spans := p.publisher.Tracer.Start(topic, message.Messages{msg})
+	defer func() {
+		spans.End(err)
+	}()
+	inserted, err := p.insertStream(conn, topic, messagesTableName, msg, payload, size)
+	if err != nil {
+		return err
+	}
+	p.publisher.Metrics.Published(topic, message.Messages{msg}, inserted, start)
+	if conn.AutocommitEnabled() {
+		// messages inserted within a transaction are not visible until the commit
+		published.Notify(messagesTableName)
+	}
+	return nil
+}
+
+// insertStream inserts the message with an empty payload, reserves size bytes
+// for the payload, and writes the payload into the reserved BLOB within one savepoint.
+// Returns zero if the message UUID was already published.
+func (p *StreamingPublisher) insertStream(
+	conn *sqlite.Conn,
+	topic string,
+	messagesTableName string,
+	msg *message.Message,
+	payload io.Reader,
+	size int64,
+) (inserted int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	row := message.NewMessage(msg.UUID, []byte{})
+	row.Metadata = msg.Metadata
+	if inserted, err = p.publisher.insertChunks(conn, topic, messagesTableName, message.Messages{row}); err != nil {
+		return 0, err
+	}
+	if inserted == 0 {
+		return 0, nil // message UUID was already published
+	}
+	offset := conn.LastInsertRowID()
+	if err = sqlitex.Execute(conn, `UPDATE '`+messagesTableName+`' SET payload=zeroblob(?) WHERE "offset"=?;`, &sqlitex.ExecOptions{
+		Args: []any{size, offset},
+	}); err != nil {
+		return 0, fmt.Errorf("unable to reserve message %q payload: %w", msg.UUID, err)
+	}
+	blob, err := conn.OpenBlob("", messagesTableName, "payload", offset, true)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open message %q payload: %w", msg.UUID, err)
+	}
+	defer func() {
+		err = errors.Join(err, blob.Close())
+	}()
+	written, err := io.Copy(blob, io.LimitReader(payload, size))
+	if err != nil {
+		return 0, fmt.Errorf("unable to write message %q payload: %w", msg.UUID, err)
+	}
+	if written < size {
+		return 0, fmt.Errorf("message %q payload ended after %d of %d bytes: %w", msg.UUID, written, size, io.ErrUnexpectedEOF)
+	}
+	return inserted, nil
+}
+
+// Close stops accepting messages. The connection remains open.
+func (p *StreamingPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+type payloadContextKey struct{}
+
+// streamedPayload locates a payload that was not selected with the message batch.
+type streamedPayload struct {
+	ConnectionDSN string
+	TopicTable    string
+	Offset        int64
+}
+
+// PayloadReader reads the payload of a delivered message. Payloads of at least
+// [SubscriberOptions.PayloadStreamingThreshold] bytes are not loaded with message batches,
+// and such messages are delivered with an empty payload. The reader then reads the payload
+// from the topic table with incremental BLOB I/O until it is closed. It uses the delivery
+// connection of [ConnFromContext], if present, or opens a connection of its own.
+// Other payloads are read from memory.
+//
+// Close the reader before acknowledging the message, because acknowledged messages
+// may be removed from the topic table.
+func PayloadReader(msg *message.Message) (io.ReadCloser, error) {
+	stream, ok := msg.Context().Value(payloadContextKey{}).(streamedPayload)
+	if !ok {
+		return io.NopCloser(bytes.NewReader(msg.Payload)), nil
+	}
+	if conn, ok := ConnFromContext(msg.Context()); ok {
+		return openPayload(conn, stream.TopicTable, stream.Offset)
+	}
+	conn, err := sqlite.OpenConn(stream.ConnectionDSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open connection for reading message payload: %w", err)
+	}
+	blob, err := openPayload(conn, stream.TopicTable, stream.Offset)
+	if err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return &payloadReader{Blob: blob, conn: conn}, nil
+}
+
+func openPayload(conn *sqlite.Conn, table string, offset int64) (*sqlite.Blob, error) {
+	blob, err := conn.OpenBlob("", table, "payload", offset, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open message payload at offset %d: %w", offset, err)
+	}
+	return blob, nil
+}
+
+// payloadReader closes the connection it owns together with the BLOB.
+type payloadReader struct {
+	*sqlite.Blob
+	conn *sqlite.Conn
+}
+
+func (r *payloadReader) Close() error {
+	return errors.Join(r.Blob.Close(), r.conn.Close())
+}
+
+// payloadColumn selects NULL in place of payloads that are at least
+// streamingThreshold bytes long. SQLite measures the length of a BLOB without reading it.
+func payloadColumn(column string, streamingThreshold int) string {
+	if streamingThreshold <= 0 {
+		return column
+	}
+	return fmt.Sprintf(`IIF(length(%[1]s)<%[2]d, %[1]s, NULL)`, column, streamingThreshold)
+}
+
+// ReadPayload loads a payload that was not selected with the message batch.
+func (s *subscription) ReadPayload(offset int64) (payload []byte, err error) {
+	blob, err := openPayload(s.Connection, s.topicTable, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, blob.Close())
+	}()
+	payload = make([]byte, blob.Size())
+	if _, err = io.ReadFull(blob, payload); err != nil {
+		return nil, fmt.Errorf("unable to read message payload at offset %d: %w", offset, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,126 @@
+package wmsqlitezombiezen
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestPayloadStreaming(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub, err := NewStreamingPublisher(conn, PublisherOptions{
+		InitializeSchema: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := pub.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	topic := "TestPayloadStreaming"
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<17) // two megabytes
+	for i := 0; i < 2; i++ {
+		if err = pub.PublishStream(topic, message.NewMessage(strconv.Itoa(i), nil), bytes.NewReader(large), int64(len(large))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = pub.Publish(topic, message.NewMessage("2", []byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("short payload reader is rolled back", func(t *testing.T) {
+		err := pub.PublishStream(topic, message.NewMessage("short", nil), bytes.NewReader(large[:10]), 11)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+		count, err := sqlitex.ResultInt(conn.Prep(`SELECT COUNT(*) FROM 'watermill_` + topic + `' WHERE uuid='short';`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Fatal("message with a short payload was inserted")
+		}
+	})
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		ConsumerGroupMatcher:      NewStaticConsumerGroupMatcher("x"),
+		PayloadStreamingThreshold: 1 << 20,
+		MaxDeliveryAttempts:       1,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range [][]byte{large, large, []byte("small")} {
+		select {
+		case msg := <-messages:
+			if msg.UUID != strconv.Itoa(i) {
+				t.Fatalf("expected message %d, got %q", i, msg.UUID)
+			}
+			if len(expected) == len(large) && len(msg.Payload) != 0 {
+				t.Fatalf("streamed payload of message %q was loaded with the batch", msg.UUID)
+			}
+			r, err := PayloadReader(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, expected) {
+				t.Fatalf("message %q payload of %d bytes does not match the published payload", msg.UUID, len(payload))
+			}
+			if i == 1 {
+				msg.Nack()
+				continue
+			}
+			msg.Ack()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("message %d was not delivered", i)
+		}
+	}
+
+	t.Run("dead-lettered payload is copied whole", func(t *testing.T) {
+		deadline := time.Now().Add(time.Second * 3)
+		for {
+			stmt := conn.Prep(`SELECT COALESCE(SUM(length(payload)), 0) FROM 'watermill_` + DefaultDeadLetterTopic(topic) + `' WHERE uuid='1';`)
+			size, err := sqlitex.ResultInt(stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size == len(large) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected dead-lettered payload of %d bytes, got %d", len(large), size)
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	})
+
+	if _, err = NewStreamingPublisher(conn, PublisherOptions{
+		KeyProvider: KeyRing{
+			CurrentKeyID: "first",
+			Keys:         map[string][]byte{"first": make([]byte, 32)},
+		},
+	}); err == nil {
+		t.Fatal("streaming publisher must not accept a key provider")
+	}
+}
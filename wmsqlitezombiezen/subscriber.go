@@ -5,7 +5,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +12,9 @@ import (
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
@@ -24,7 +26,7 @@ const (
 	DefaultMessageBatchSize = 100
 
 	// DefaultSubscriberLockTimeout is the default duration of the row lock
-	// setting for [SubscriberOptions]. Must be in full seconds.
+	// setting for [SubscriberOptions].
 	DefaultSubscriberLockTimeout = 5 * time.Second
 
 	// DefaultAckDeadline is the default duration of the message acknowledgement deadline
@@ -87,27 +89,47 @@ type SubscriberOptions struct {
 
 	// TableNameGenerators is a set of functions that generate table names for topics and offsets.
 	// Default value is [TableNameGenerators.WithDefaultGeneratorsInsteadOfNils].
+	// [SingleTableNameGenerators] keep every topic in shared tables, which does not support
+	// [Seek], [NewInspector], [CleanUpTopics], [ReEncryptTopics], [Migrate], or topic patterns.
 	TableNameGenerators TableNameGenerators
 
+	// SchemaAdapter produces queries that create topic tables and select message batches.
+	// Publishers must use a compatible adapter.
+	// Default value is [DefaultSchemaAdapter].
+	SchemaAdapter SchemaAdapter
+
+	// OffsetsAdapter produces queries that lock consumer groups and acknowledge messages.
+	// Default value is [DefaultOffsetsAdapter].
+	OffsetsAdapter OffsetsAdapter
+
 	// PollInterval is the interval to wait between subsequent SELECT queries, if no more messages were found in the database (Prefer using the BackoffManager instead).
+	// Publishers within the same process wake up subscriptions immediately,
+	// so polling is a safety net for messages inserted by other processes
+	// or within transactions.
 	// Must be non-negative. Default value is one second.
 	PollInterval time.Duration
 
+	// DataVersionInterval enables waking up subscriptions when messages are published
+	// by other processes. Each subscription checks PRAGMA data_version on its connection
+	// at this interval, which only reads the database header. When the data version changes,
+	// the subscription looks up the topic table AUTOINCREMENT sequence to tell
+	// whether new messages arrived, before querying for messages.
+	//
+	// Zero value disables the check.
+	DataVersionInterval time.Duration
+
 	// LockTimeout is the maximum duration of the row lock. If the subscription
 	// is unable to extend the lock before this time out ends, the lock will expire.
 	// Then, another subscriber in the same consumer group name may
 	// acquire the lock and continue processing messages.
 	//
-	// Duration must not be less than one second, because seconds are added
-	// to the SQLite `unixepoch` function, rounded to the nearest second.
-	// A zero duration would create a lock that expires immediately.
-	// There is no reason to set higher precision fractional duration,
-	// because the lock timeout will rarely ever trigger in a healthy system.
+	// Locks are stored with millisecond precision, so the duration must not be
+	// less than one millisecond. A zero duration would create a lock that expires immediately.
 	// Normally, the row lock is set to zero after each batch of messages is processed. LockTimeout might occur if a consuming node shuts down unexpectedly,
 	// before it is able to complete processing a batch of messages. Only
-	// in such rare cases the time out matters. And, it is better to set it
-	// to a higher value in order to avoid unnecessary batch re-processing.
-	// Therefore, a value lower than one second is impractical.
+	// in such rare cases the time out matters. A short time out lets another subscriber
+	// take over sooner, but the lock is extended more often, and a subscription that
+	// stalls for longer than the time out loses the lock and its batch is re-processed.
 	//
 	// Defaults to [DefaultLockTimeout].
 	LockTimeout time.Duration
@@ -124,6 +146,72 @@ type SubscriberOptions struct {
 	// Must be non-negative. Default value is [DefaultAckDeadline].
 	AckDeadline *time.Duration
 
+	// MaxDeliveryAttempts limits the number of times a message is delivered to a consumer group.
+	// The attempt count is persisted per consumer group and offset in the deliveries table,
+	// so it survives subscriber restarts. Once the limit is reached, the message is moved
+	// to the dead-letter topic with the last failure reason in its metadata,
+	// and the consumer group offset advances past it.
+	//
+	// Zero value disables the limit: a message is re-delivered until it is acknowledged.
+	MaxDeliveryAttempts int
+
+	// DeadLetterTopic names the topic that receives messages exceeding MaxDeliveryAttempts.
+	// Dead-letter topic tables are created on subscription if InitializeSchema is enabled.
+	// Default value is [DefaultDeadLetterTopic].
+	DeadLetterTopic func(topic string) string
+
+	// DelayedDelivery holds back messages until their delivery time set by [PublishAt]
+	// or [MetadataKeyDeliverAt] metadata. Messages that are already due are delivered
+	// without waiting for the earlier messages that are not due yet.
+	//
+	// Acknowledgements of messages delivered ahead of pending ones
+	// are tracked in the deliveries table, so the consumer group offset
+	// never advances past a message that was not delivered yet.
+	DelayedDelivery bool
+
+	// MessageLeases replaces the consumer group row lock with a lease on each message,
+	// turning the consumer group into a work queue. Several subscribers of the same
+	// consumer group process different messages of the same topic in parallel,
+	// and messages may be processed out of order.
+	//
+	// A leased message is invisible to other subscribers of the consumer group
+	// until it is acknowledged or its lease expires after LockTimeout.
+	// Leases of a whole batch are taken at once, so a small BatchSize
+	// spreads messages more evenly between subscribers.
+	//
+	// All subscribers of a consumer group must use the same setting.
+	MessageLeases bool
+
+	// ConsumeInTransaction delivers each message with an open savepoint on the subscription
+	// connection, which the handler obtains with [ConnFromContext]. The message is acknowledged
+	// within the savepoint, so handler writes and the consumer group offset
+	// are committed together when the message is acked, and both are rolled back
+	// when the message is nacked. Local side effects are applied exactly once.
+	//
+	// The savepoint holds the database write lock from message delivery until
+	// acknowledgement. The handler must write only through the subscription connection,
+	// because writes through other connections wait for the lock until they time out.
+	// The connection is not safe for concurrent use, so the handler must stop using it
+	// before acknowledging the message. The subscription does not touch the connection
+	// until the message is acked or nacked, even after the acknowledgement deadline passes
+	// or the subscription is closed. The consumer group lock is extended afterwards,
+	// and a message acked after its deadline is rolled back like a nacked message.
+	ConsumeInTransaction bool
+
+	// InitialPosition is the first message received by a consumer group that does not exist yet.
+	// Existing consumer groups resume after their acknowledged offset; use [Seek] to move them.
+	//
+	// Default value is [PositionEarliest].
+	InitialPosition Position
+
+	// MetadataFilter delivers only messages whose metadata holds every key with the given value.
+	// Other messages are skipped by the batch query and acknowledged along with the delivered ones,
+	// so filtered subscribers need a consumer group of their own.
+	// Cannot be combined with DelayedDelivery or MessageLeases. Cannot be combined with
+	// KeyProvider either, because the metadata of encrypted messages is sealed with the payload,
+	// so the batch query would skip every encrypted message.
+	MetadataFilter MetadataFilter
+
 	// BufferPool is a pool of buffers used for reading message payload and metadata from the database.
 	// If not provided, a default pool will be used. The pool may leak message metadata, but never the payload.
 	// Warning: If sync.Pool does not return a buffer, subscription will panic.
@@ -132,25 +220,75 @@ type SubscriberOptions struct {
 	// InitializeSchema option enables initializing schema on making a subscription.
 	InitializeSchema bool
 
+	// PayloadCodec decodes payloads compressed by a custom publisher [PayloadCodec].
+	// Payloads compressed by [GzipPayloadCodec] or [ZstdPayloadCodec] are decoded
+	// without configuration, and payloads without the [MetadataKeyPayloadCodec]
+	// metadata value are delivered as they are.
+	PayloadCodec PayloadCodec
+
+	// PayloadStreamingThreshold is the smallest payload size in bytes that is not loaded
+	// with message batches, so that batches of large messages do not hold every payload in memory.
+	// Such messages are delivered with an empty payload, which handlers read with [PayloadReader].
+	// Compressed and encrypted payloads are always loaded, because they can only be decoded whole.
+	//
+	// Zero value loads every payload.
+	PayloadStreamingThreshold int
+
+	// KeyProvider decrypts messages encrypted by publishers with the key recorded on each row.
+	// Dead-lettered messages are encrypted again with the current key.
+	// Messages published without encryption are delivered as they are.
+	KeyProvider KeyProvider
+
+	// MeterProvider records consumer group lock acquisitions, batch sizes,
+	// acknowledgements, and consumer lag. Nil value disables metrics.
+	MeterProvider metric.MeterProvider
+
+	// TracerProvider creates a consumer span for each delivery attempt.
+	// The span is a child of the publisher span extracted from message metadata
+	// and is set as the message context. Nil value disables tracing.
+	TracerProvider trace.TracerProvider
+
+	// Propagator extracts the publisher span context from message metadata.
+	// Must match the propagator of the publisher.
+	// Default value is [propagation.TraceContext], which reads W3C Trace Context headers.
+	Propagator propagation.TextMapPropagator
+
 	// Logger reports message consumption errors and traces. Defaults to [watermill.NopLogger].
 	Logger watermill.LoggerAdapter
 }
 
 type subscriber struct {
-	ConnectionDSN             string
-	UUID                      string
-	PollInterval              time.Duration
-	LockTimeoutInSeconds      int
-	InitializeSchema          bool
-	ConsumerGroupMatcher      ConsumerGroupMatcher
-	BatchSize                 int
-	NackChannel               func() <-chan time.Time
-	Closed                    chan struct{}
-	TopicTableNameGenerator   TableNameGenerator
-	OffsetsTableNameGenerator TableNameGenerator
-	BufferPool                *sync.Pool
-	Logger                    watermill.LoggerAdapter
-	Subscriptions             *sync.WaitGroup
+	ConnectionDSN                string
+	UUID                         string
+	PollInterval                 time.Duration
+	LockTimeout                  time.Duration
+	InitializeSchema             bool
+	ConsumerGroupMatcher         ConsumerGroupMatcher
+	BatchSize                    int
+	NackChannel                  func() <-chan time.Time
+	MaxDeliveryAttempts          int
+	DeadLetterTopic              func(topic string) string
+	DelayedDelivery              bool
+	MessageLeases                bool
+	ConsumeInTransaction         bool
+	InitialPosition              Position
+	MetadataFilter               MetadataFilter
+	DataVersionInterval          time.Duration
+	Closed                       chan struct{}
+	TopicTableNameGenerator      TableNameGenerator
+	OffsetsTableNameGenerator    TableNameGenerator
+	DeliveriesTableNameGenerator TableNameGenerator
+	SchemaAdapter                SchemaAdapter
+	OffsetsAdapter               OffsetsAdapter
+	BufferPool                   *sync.Pool
+	PayloadCodec                 PayloadCodec
+	PayloadStreamingThreshold    int
+	KeyProvider                  KeyProvider
+	Metrics                      *subscriberMetrics
+	TracerProvider               trace.TracerProvider
+	Propagator                   propagation.TextMapPropagator
+	Logger                       watermill.LoggerAdapter
+	Subscriptions                *sync.WaitGroup
 }
 
 // NewSubscriber creates a new subscriber with the given options.
@@ -176,14 +314,21 @@ func NewSubscriber(connectionDSN string, options SubscriberOptions) (message.Sub
 	if options.PollInterval > time.Hour*24*7 {
 		return nil, errors.New("PollInterval must be less than a week")
 	}
-	if options.LockTimeout < time.Second {
+	if options.LockTimeout < time.Millisecond {
 		if options.LockTimeout == 0 {
 			options.LockTimeout = DefaultSubscriberLockTimeout
 		} else {
-			return nil, errors.New("LockTimeout must be greater than one second")
+			return nil, errors.New("LockTimeout must be greater than one millisecond")
 		}
 	}
 
+	if options.MaxDeliveryAttempts < 0 {
+		return nil, errors.New("MaxDeliveryAttempts must not be negative")
+	}
+	if options.DeadLetterTopic == nil {
+		options.DeadLetterTopic = DefaultDeadLetterTopic
+	}
+
 	nackChannel := func() <-chan time.Time {
 		// by default, Nack messages if they take longer than 30 seconds to process
 		return time.After(DefaultAckDeadline)
@@ -212,21 +357,67 @@ func NewSubscriber(connectionDSN string, options SubscriberOptions) (message.Sub
 		return nil, errors.New("BufferPool.Get() did not return a *bytes.Buffer")
 	}
 
-	ID := uuid.New().String()
+	if options.DataVersionInterval < 0 {
+		return nil, errors.New("DataVersionInterval must not be negative")
+	}
+	if options.PayloadStreamingThreshold < 0 {
+		return nil, errors.New("PayloadStreamingThreshold must not be negative")
+	}
+	if len(options.MetadataFilter) > 0 {
+		if options.DelayedDelivery || options.MessageLeases {
+			return nil, errors.New("MetadataFilter cannot be combined with DelayedDelivery or MessageLeases")
+		}
+		if options.KeyProvider != nil {
+			return nil, errors.New("MetadataFilter cannot be combined with KeyProvider, because encrypted metadata cannot be filtered")
+		}
+		if err := options.MetadataFilter.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	tng := options.TableNameGenerators.WithDefaultGeneratorsInsteadOfNils()
+	schemaAdapter := cmpOrTODO[SchemaAdapter](options.SchemaAdapter, DefaultSchemaAdapter{})
+	offsetsAdapter := cmpOrTODO[OffsetsAdapter](options.OffsetsAdapter, DefaultOffsetsAdapter{})
+	if err := validateAdapters(tng, schemaAdapter, offsetsAdapter); err != nil {
+		return nil, err
+	}
+
+	metrics, err := newSubscriberMetrics(options.MeterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create subscriber metrics: %w", err)
+	}
+
+	ID := uuid.New().String()
 	return &subscriber{
-		ConnectionDSN:             connectionDSN,
-		UUID:                      ID,
-		PollInterval:              cmpOrTODO(options.PollInterval, time.Second),
-		LockTimeoutInSeconds:      int(math.Round(options.LockTimeout.Seconds())),
-		InitializeSchema:          options.InitializeSchema,
-		ConsumerGroupMatcher:      options.ConsumerGroupMatcher,
-		BatchSize:                 cmpOrTODO(options.BatchSize, DefaultMessageBatchSize),
-		NackChannel:               nackChannel,
-		Closed:                    make(chan struct{}),
-		TopicTableNameGenerator:   tng.Topic,
-		OffsetsTableNameGenerator: tng.Offsets,
-		BufferPool:                options.BufferPool,
+		ConnectionDSN:                connectionDSN,
+		UUID:                         ID,
+		PollInterval:                 cmpOrTODO(options.PollInterval, time.Second),
+		LockTimeout:                  options.LockTimeout,
+		InitializeSchema:             options.InitializeSchema,
+		ConsumerGroupMatcher:         options.ConsumerGroupMatcher,
+		BatchSize:                    cmpOrTODO(options.BatchSize, DefaultMessageBatchSize),
+		NackChannel:                  nackChannel,
+		MaxDeliveryAttempts:          options.MaxDeliveryAttempts,
+		DeadLetterTopic:              options.DeadLetterTopic,
+		DelayedDelivery:              options.DelayedDelivery,
+		MessageLeases:                options.MessageLeases,
+		MetadataFilter:               options.MetadataFilter,
+		ConsumeInTransaction:         options.ConsumeInTransaction,
+		PayloadCodec:                 options.PayloadCodec,
+		PayloadStreamingThreshold:    options.PayloadStreamingThreshold,
+		KeyProvider:                  options.KeyProvider,
+		InitialPosition:              options.InitialPosition,
+		DataVersionInterval:          options.DataVersionInterval,
+		Closed:                       make(chan struct{}),
+		TopicTableNameGenerator:      tng.Topic,
+		OffsetsTableNameGenerator:    tng.Offsets,
+		DeliveriesTableNameGenerator: tng.Deliveries,
+		SchemaAdapter:                schemaAdapter,
+		OffsetsAdapter:               offsetsAdapter,
+		BufferPool:                   options.BufferPool,
+		Metrics:                      metrics,
+		TracerProvider:               options.TracerProvider,
+		Propagator:                   options.Propagator,
 		Logger: cmpOrTODO[watermill.LoggerAdapter](
 			options.Logger,
 			defaultLogger,
@@ -238,11 +429,16 @@ func NewSubscriber(connectionDSN string, options SubscriberOptions) (message.Sub
 }
 
 // Subscribe streams messages from the topic. Satisfies [watermill.Subscriber] interface.
+// A topic with [path.Match] wildcards, such as "orders.*", subscribes to every matching topic,
+// and sets [MetadataKeyTopic] on each message.
 // Returns [ErrSubscriberIsClosed] if the subscriber is closed.
 func (s *subscriber) Subscribe(ctx context.Context, topic string) (c <-chan *message.Message, err error) {
 	if s.IsClosed() {
 		return nil, ErrSubscriberIsClosed
 	}
+	if isTopicPattern(topic) {
+		return s.subscribePattern(ctx, topic)
+	}
 
 	consumerGroup, err := s.ConsumerGroupMatcher.MatchTopic(topic)
 	if err != nil {
@@ -264,74 +460,188 @@ func (s *subscriber) Subscribe(ctx context.Context, topic string) (c <-chan *mes
 	}()
 
 	messagesTableName := s.TopicTableNameGenerator(topic)
-	offsetsTableName := s.OffsetsTableNameGenerator(topic)
+	deadLetterTopic := s.DeadLetterTopic(topic)
+	params := SubscriptionQueryParams{
+		Topic:           topic,
+		TopicTable:      messagesTableName,
+		OffsetsTable:    s.OffsetsTableNameGenerator(topic),
+		ConsumerGroup:   consumerGroup,
+		BatchSize:       s.BatchSize,
+		LockTimeout:     s.LockTimeout,
+		DelayedDelivery: s.DelayedDelivery,
+		MessageLeases:   s.MessageLeases,
+		InitialPosition: s.InitialPosition,
+		MetadataFilter:  s.MetadataFilter,
+
+		PayloadStreamingThreshold: s.PayloadStreamingThreshold,
+	}
+	if s.MaxDeliveryAttempts > 0 || s.DelayedDelivery || s.MessageLeases {
+		params.DeliveriesTable = s.DeliveriesTableNameGenerator(topic)
+	}
+	if s.MessageLeases {
+		params.LeaseOwner = uuid.New().String()
+	}
+	if s.MaxDeliveryAttempts > 0 {
+		if err = validateTopicName(deadLetterTopic); err != nil {
+			return nil, fmt.Errorf("dead-letter topic name must follow topic name validation rules: %w", err)
+		}
+	}
 	if s.InitializeSchema {
 		if err = createTopicAndOffsetsTablesIfAbsent(
 			conn,
-			messagesTableName,
-			offsetsTableName,
+			s.SchemaAdapter,
+			s.OffsetsAdapter,
+			SchemaInitializingQueriesParams{
+				Topic:           topic,
+				TopicTable:      messagesTableName,
+				OffsetsTable:    params.OffsetsTable,
+				DeliveriesTable: params.DeliveriesTable,
+			},
 		); err != nil {
 			return nil, fmt.Errorf("unable to initialize schema: %w", err)
 		}
+		if s.MaxDeliveryAttempts > 0 {
+			if err = createTopicAndOffsetsTablesIfAbsent(
+				conn,
+				s.SchemaAdapter,
+				s.OffsetsAdapter,
+				SchemaInitializingQueriesParams{
+					Topic:        deadLetterTopic,
+					TopicTable:   s.TopicTableNameGenerator(deadLetterTopic),
+					OffsetsTable: s.OffsetsTableNameGenerator(deadLetterTopic),
+				},
+			); err != nil {
+				return nil, fmt.Errorf("unable to initialize dead-letter topic schema: %w", err)
+			}
+		}
+	} else {
+		tables := map[string]string{
+			messagesTableName:   schemaKindTopic,
+			params.OffsetsTable: schemaKindOffsets,
+		}
+		if params.DeliveriesTable != "" {
+			tables[params.DeliveriesTable] = schemaKindDeliveries
+		}
+		if err = checkSchemaVersions(conn, tables); err != nil {
+			return nil, err
+		}
 	}
 
 	if err = sqlitex.ExecuteTransient(
 		conn,
-		fmt.Sprintf(`
-			INSERT INTO "%s" (consumer_group, offset_acked, locked_until)
-			VALUES ('%s', 0, 0)
-			ON CONFLICT(consumer_group) DO NOTHING;`,
-			offsetsTableName, consumerGroup),
+		s.OffsetsAdapter.ConsumerGroupInitializingQuery(params),
 		nil,
 	); err != nil {
 		return nil, fmt.Errorf("failed zero-value insertion: %w", err)
 	}
 
-	stmtLockConsumerGroup, err := conn.Prepare(fmt.Sprintf(
-		`UPDATE '%s' SET locked_until=(unixepoch()+%d) WHERE consumer_group='%s' AND locked_until < unixepoch() RETURNING offset_acked;`,
-		offsetsTableName,
-		s.LockTimeoutInSeconds,
-		consumerGroup,
-	))
+	stmtLockConsumerGroup, err := conn.Prepare(s.OffsetsAdapter.LockConsumerGroupQuery(params))
 	if err != nil {
 		return nil, fmt.Errorf("invalid lock consumer group statement: %w", err)
 	}
-	stmtExtendLock, err := conn.Prepare(fmt.Sprintf(
-		`UPDATE '%s' SET locked_until=(unixepoch()+%d), offset_acked=? WHERE consumer_group='%s' AND offset_acked=? AND locked_until>=unixepoch() RETURNING COALESCE(locked_until, 0);`,
-		offsetsTableName,
-		s.LockTimeoutInSeconds,
-		consumerGroup,
-	))
+	stmtExtendLock, err := conn.Prepare(s.OffsetsAdapter.ExtendLockQuery(params))
 	if err != nil {
 		return nil, fmt.Errorf("invalid extend lock statement: %w", err)
 	}
-	stmtNextMessageBatch, err := conn.Prepare(fmt.Sprintf(`
-		SELECT "offset", uuid, payload, metadata
-		FROM '%s'
-		WHERE "offset">? ORDER BY offset LIMIT %d;`,
-		messagesTableName, s.BatchSize))
+	stmtNextMessageBatch, err := conn.Prepare(s.SchemaAdapter.NextBatchQuery(params))
 	if err != nil {
 		return nil, fmt.Errorf("invalid message batch query statement: %w", err)
 	}
-	stmtAcknowledgeMessages, err := conn.Prepare(fmt.Sprintf(`
-		UPDATE '%s' SET offset_acked=?, locked_until=0 WHERE consumer_group='%s' AND offset_acked=?;`,
-		offsetsTableName, consumerGroup))
+	stmtAcknowledgeMessages, err := conn.Prepare(s.OffsetsAdapter.AcknowledgeMessagesQuery(params))
 	if err != nil {
 		return nil, fmt.Errorf("invalid acknowledge messages statement: %w", err)
 	}
+	var (
+		stmtForgetDeliveries, stmtAcknowledgeDelivery *sqlite.Stmt
+		stmtCountDeliveryAttempt                      *sqlite.Stmt
+		stmtLeaseMessage, stmtReleaseLeases           *sqlite.Stmt
+		stmtDataVersion, stmtTopicSequence            *sqlite.Stmt
+		stmtMaxOffset                                 *sqlite.Stmt
+	)
+	if params.DeliveriesTable != "" {
+		if stmtForgetDeliveries, err = conn.Prepare(s.OffsetsAdapter.ForgetDeliveriesQuery(params)); err != nil {
+			return nil, fmt.Errorf("invalid forget deliveries statement: %w", err)
+		}
+	}
+	if s.DelayedDelivery || s.MessageLeases {
+		if stmtAcknowledgeDelivery, err = conn.Prepare(s.OffsetsAdapter.AcknowledgeDeliveryQuery(params)); err != nil {
+			return nil, fmt.Errorf("invalid acknowledge delivery statement: %w", err)
+		}
+	}
+	if s.MessageLeases {
+		if stmtLeaseMessage, err = conn.Prepare(s.OffsetsAdapter.LeaseMessageQuery(params)); err != nil {
+			return nil, fmt.Errorf("invalid lease message statement: %w", err)
+		}
+		if stmtReleaseLeases, err = conn.Prepare(s.OffsetsAdapter.ReleaseLeasesQuery(params)); err != nil {
+			return nil, fmt.Errorf("invalid release leases statement: %w", err)
+		}
+	}
+	if s.MaxDeliveryAttempts > 0 {
+		if stmtCountDeliveryAttempt, err = conn.Prepare(s.OffsetsAdapter.CountDeliveryAttemptQuery(params)); err != nil {
+			return nil, fmt.Errorf("invalid count delivery attempt statement: %w", err)
+		}
+	}
+	if s.DataVersionInterval > 0 {
+		if stmtDataVersion, err = conn.Prepare(`PRAGMA data_version;`); err != nil {
+			return nil, fmt.Errorf("invalid data version statement: %w", err)
+		}
+		if stmtTopicSequence, err = conn.Prepare(fmt.Sprintf(
+			`SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name='%s'), 0);`,
+			messagesTableName,
+		)); err != nil {
+			return nil, fmt.Errorf("invalid topic sequence statement: %w", err)
+		}
+	}
+	if s.Metrics != nil || len(s.MetadataFilter) > 0 {
+		if stmtMaxOffset, err = conn.Prepare(maxOffsetQuery(s.SchemaAdapter, params)); err != nil {
+			return nil, fmt.Errorf("invalid topic max offset statement: %w", err)
+		}
+	}
 
 	sub := &subscription{
 		Connection:   conn,
 		pollTicker:   time.NewTicker(s.PollInterval),
-		lockDuration: time.Second*time.Duration(s.LockTimeoutInSeconds) - (time.Millisecond * 300), // less than the lock timeout
+		lockDuration: s.LockTimeout - min(s.LockTimeout/4, time.Second), // extended before the lock times out
 		nackChannel:  s.NackChannel,
 
 		stmtLockConsumerGroup:   stmtLockConsumerGroup,
 		stmtExtendLock:          stmtExtendLock,
 		stmtNextMessageBatch:    stmtNextMessageBatch,
 		stmtAcknowledgeMessages: stmtAcknowledgeMessages,
-		destination:             make(chan *message.Message),
-		bufferPool:              s.BufferPool,
+		stmtMaxOffset:           stmtMaxOffset,
+
+		maxDeliveryAttempts:      int64(s.MaxDeliveryAttempts),
+		stmtCountDeliveryAttempt: stmtCountDeliveryAttempt,
+		stmtForgetDeliveries:     stmtForgetDeliveries,
+		schemaAdapter:            s.SchemaAdapter,
+		deadLetterTopic:          deadLetterTopic,
+		deadLetterTable:          s.TopicTableNameGenerator(deadLetterTopic),
+
+		acknowledgesDeliveries:  s.DelayedDelivery || s.MessageLeases,
+		stmtAcknowledgeDelivery: stmtAcknowledgeDelivery,
+
+		messageLeases:     s.MessageLeases,
+		stmtLeaseMessage:  stmtLeaseMessage,
+		stmtReleaseLeases: stmtReleaseLeases,
+
+		consumesInTransaction: s.ConsumeInTransaction,
+		filtersMetadata:       len(s.MetadataFilter) > 0,
+		batchSize:             s.BatchSize,
+		payloadCodec:          s.PayloadCodec,
+		keyProvider:           s.KeyProvider,
+		connectionDSN:         s.ConnectionDSN,
+		topicTable:            messagesTableName,
+
+		stmtDataVersion:   stmtDataVersion,
+		stmtTopicSequence: stmtTopicSequence,
+
+		topic:         topic,
+		consumerGroup: consumerGroup,
+		destination:   make(chan *message.Message),
+		wake:          make(chan struct{}, 1),
+		bufferPool:    s.BufferPool,
+		metrics:       s.Metrics.Subscription(topic, consumerGroup),
+		tracer:        newSubscriptionTracer(s.TracerProvider, s.Propagator, topic, consumerGroup),
 		logger: s.Logger.With(
 			watermill.LogFields{
 				"topic":          topic,
@@ -340,7 +650,11 @@ func (s *subscriber) Subscribe(ctx context.Context, topic string) (c <-chan *mes
 		),
 	}
 	sub.lockTicker = time.NewTicker(sub.lockDuration)
+	if s.DataVersionInterval > 0 {
+		sub.dataVersionTicker = time.NewTicker(s.DataVersionInterval)
+	}
 
+	published.Listen(messagesTableName, sub.wake)
 	s.Subscriptions.Add(1)
 	ctx, cancel := context.WithCancel(ctx)
 	go func(done <-chan struct{}) {
@@ -350,6 +664,7 @@ func (s *subscriber) Subscribe(ctx context.Context, topic string) (c <-chan *mes
 	go func(ctx context.Context) {
 		defer s.Subscriptions.Done()
 		sub.Run(ctx)
+		published.Forget(messagesTableName, sub.wake)
 		close(sub.destination)
 		cancel()
 	}(ctx)
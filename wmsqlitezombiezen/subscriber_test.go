@@ -7,6 +7,8 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 func TestBasicSendRecieve(t *testing.T) {
@@ -75,3 +77,144 @@ func TestBasicSendRecieve(t *testing.T) {
 		}
 	})
 }
+
+func TestSubSecondLockTimeout(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	if _, err := NewSubscriber(DSN, SubscriberOptions{LockTimeout: time.Microsecond}); err == nil {
+		t.Fatal("lock timeout shorter than one millisecond must be rejected")
+	}
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	topic := "TestSubSecondLockTimeout"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	// consumer group lock left behind by a crashed subscription
+	if err := sqlitex.ExecuteTransient(conn, `
+		INSERT INTO 'watermill_offsets_`+topic+`' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, (CAST(unixepoch('subsec')*1000 AS INTEGER)+1199)/1000, CAST(unixepoch('subsec')*1000 AS INTEGER)+200);`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		LockTimeout: time.Millisecond * 200,
+	})
+	start := time.Now()
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-time.After(time.Second * 3):
+		t.Fatal("message was not delivered after the lock expired")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("consumer group lock was taken over after %s", elapsed)
+	}
+
+	// the lock is extended for as long as the message is processed
+	time.Sleep(time.Millisecond * 500)
+	var locked, roundedUp bool
+	if err = sqlitex.Execute(
+		conn,
+		`SELECT locked_until_ms>=CAST(unixepoch('subsec')*1000 AS INTEGER), locked_until*1000>=locked_until_ms FROM 'watermill_offsets_`+topic+`' WHERE consumer_group='default';`,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				locked = stmt.ColumnBool(0)
+				roundedUp = stmt.ColumnBool(1)
+				return nil
+			},
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("consumer group lock was not extended")
+	}
+	if !roundedUp {
+		t.Fatal("lock expiry in seconds must not precede the expiry in milliseconds")
+	}
+	msg.Ack()
+}
+
+func TestLockHeldByAnotherSubscription(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	topic := "TestLockHeldByAnotherSubscription"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	lockedUntil, err := sqlitex.ResultInt64(conn.Prep(`
+		INSERT INTO 'watermill_offsets_` + topic + `' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, unixepoch()+60, CAST(unixepoch('subsec')*1000 AS INTEGER)+60000) RETURNING locked_until_ms;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %q was delivered while another subscription held the lock", msg.UUID)
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	stillLockedUntil, err := sqlitex.ResultInt64(conn.Prep(
+		`SELECT locked_until_ms FROM 'watermill_offsets_` + topic + `' WHERE consumer_group='default';`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stillLockedUntil != lockedUntil {
+		t.Fatal("subscription that could not acquire the consumer group lock released it")
+	}
+}
+
+func TestLockTakenByOlderVersion(t *testing.T) {
+	ctx := newTestContext(t)
+
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	pub := newTestPublisher(t, conn, PublisherOptions{})
+	topic := "TestLockTakenByOlderVersion"
+	if err := pub.Publish(topic, message.NewMessage("1", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	// lock in seconds extended by a version that predates the milliseconds column
+	// over an expired lock in milliseconds
+	lockedUntil, err := sqlitex.ResultInt64(conn.Prep(`
+		INSERT INTO 'watermill_offsets_` + topic + `' (consumer_group, offset_acked, locked_until, locked_until_ms)
+		VALUES ('default', 0, unixepoch()+1, CAST(unixepoch('subsec')*1000 AS INTEGER)-2000) RETURNING locked_until;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestSubscriber(t, DSN, SubscriberOptions{
+		LockTimeout: time.Millisecond * 200,
+	})
+	messages, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		if now := time.Now(); now.Before(time.Unix(lockedUntil+1, 0)) {
+			t.Fatalf("consumer group lock held until the end of second %d was taken over at %s", lockedUntil, now)
+		}
+		msg.Ack()
+	case <-time.After(time.Second * 4):
+		t.Fatal("message was not delivered after the lock expired")
+	}
+}
@@ -13,6 +13,8 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
@@ -28,24 +30,83 @@ type subscription struct {
 	stmtExtendLock          *sqlite.Stmt
 	stmtNextMessageBatch    *sqlite.Stmt
 	stmtAcknowledgeMessages *sqlite.Stmt
+	stmtMaxOffset           *sqlite.Stmt
 
+	maxDeliveryAttempts      int64
+	stmtCountDeliveryAttempt *sqlite.Stmt
+	stmtForgetDeliveries     *sqlite.Stmt
+	schemaAdapter            SchemaAdapter
+	deadLetterTopic          string
+	deadLetterTable          string
+
+	acknowledgesDeliveries  bool
+	stmtAcknowledgeDelivery *sqlite.Stmt
+
+	messageLeases     bool
+	stmtLeaseMessage  *sqlite.Stmt
+	stmtReleaseLeases *sqlite.Stmt
+
+	consumesInTransaction bool
+	filtersMetadata       bool
+	batchSize             int
+	payloadCodec          PayloadCodec
+	keyProvider           KeyProvider
+	connectionDSN         string
+	topicTable            string
+
+	dataVersionTicker *time.Ticker
+	stmtDataVersion   *sqlite.Stmt
+	stmtTopicSequence *sqlite.Stmt
+	dataVersion       int64
+	topicSequence     int64
+
+	topic           string
+	consumerGroup   string
 	lockedOffset    int64
 	lastAckedOffset int64
+	scannedOffset   int64
 	destination     chan *message.Message
+	wake            chan struct{}
 	bufferPool      *sync.Pool
+	metrics         *subscriptionMetrics
+	tracer          *subscriptionTracer
 	logger          watermill.LoggerAdapter
 }
 
 type rawMessage struct {
-	Offset   int64
-	UUID     string
-	Payload  []byte
-	Metadata message.Metadata
+	Offset    int64
+	UUID      string
+	CreatedAt string
+	Payload   []byte
+	Metadata  message.Metadata
+	Attempts  int64
+
+	// Streamed is set when the payload was not selected with the batch.
+	Streamed bool
+
+	// Unreadable is the reason why the stored payload or metadata could not be restored.
+	// Such a message is kept as it is stored and never delivered.
+	Unreadable error
+}
+
+// restore decrypts and decodes a stored message. A message that cannot be restored
+// fails on its own in [subscription.Send] instead of failing the whole batch.
+func (s *subscription) restore(next *rawMessage) {
+	stored := *next
+	err := decryptMessage(s.keyProvider, next)
+	if err == nil {
+		err = decodePayload(s.payloadCodec, next)
+	}
+	if err != nil {
+		*next = stored
+		next.Unreadable = err
+	}
 }
 
 // NextBatch fetches the next batch of messages from the database.
 // Returns [ErrConsumerGroupIsLocked] if row lock could not be acquired.
 func (s *subscription) NextBatch() (batch []rawMessage, err error) {
+	s.scannedOffset = 0
 	// TODO: or ExclusiveTransaction?
 	closeTransaction, err := sqlitex.ImmediateTransaction(s.Connection)
 	if err != nil {
@@ -59,11 +120,14 @@ func (s *subscription) NextBatch() (batch []rawMessage, err error) {
 	}
 	ok, err := s.stmtLockConsumerGroup.Step()
 	if err != nil {
+		s.metrics.LockAcquisition(lockFailed)
 		return nil, fmt.Errorf("unable to read offset_acked value: %w", err)
 	}
 	if !ok {
+		s.metrics.LockAcquisition(lockBusy)
 		return nil, ErrConsumerGroupIsLocked
 	}
+	s.metrics.LockAcquisition(lockAcquired)
 	s.lockedOffset = s.stmtLockConsumerGroup.ColumnInt64(0)
 	s.lastAckedOffset = s.lockedOffset
 	ok, err = s.stmtLockConsumerGroup.Step()
@@ -89,41 +153,113 @@ func (s *subscription) NextBatch() (batch []rawMessage, err error) {
 			break
 		}
 		next := rawMessage{
-			Offset: s.stmtNextMessageBatch.ColumnInt64(0),
-			UUID:   s.stmtNextMessageBatch.ColumnText(1),
+			Offset:    s.stmtNextMessageBatch.ColumnInt64(0),
+			UUID:      s.stmtNextMessageBatch.ColumnText(1),
+			CreatedAt: s.stmtNextMessageBatch.ColumnText(2),
+			Attempts:  s.stmtNextMessageBatch.ColumnInt64(5),
 		}
 		b.Reset() // might be full from pool; note that pool may leak message metadata
-		if _, err = io.Copy(b, s.stmtNextMessageBatch.ColumnReader(2)); err != nil {
-			return nil, fmt.Errorf("unable to read message payload: %w", err)
+		if s.stmtNextMessageBatch.ColumnType(3) == sqlite.TypeNull {
+			next.Streamed = true
+		} else {
+			if _, err = io.Copy(b, s.stmtNextMessageBatch.ColumnReader(3)); err != nil {
+				return nil, fmt.Errorf("unable to read message payload: %w", err)
+			}
+			next.Payload = slices.Clone(b.Bytes())
+			b.Reset()
 		}
-		next.Payload = slices.Clone(b.Bytes())
-		b.Reset()
-		if _, err = io.Copy(b, s.stmtNextMessageBatch.ColumnReader(3)); err != nil {
+		if _, err = io.Copy(b, s.stmtNextMessageBatch.ColumnReader(4)); err != nil {
 			return nil, fmt.Errorf("unable to read message metadata: %w", err)
 		}
 
 		if err = json.Unmarshal(b.Bytes(), &next.Metadata); err != nil {
 			return nil, fmt.Errorf("unable to parse message metadata JSON: %w", err)
 		}
+		if next.Streamed && (next.Metadata.Get(MetadataKeyEncryptionKeyID) != "" || next.Metadata.Get(MetadataKeyPayloadCodec) != "") {
+			// sealed and compressed payloads can only be decoded whole
+			if next.Payload, err = s.ReadPayload(next.Offset); err != nil {
+				return nil, err
+			}
+			next.Streamed = false
+		}
+		s.restore(&next)
 		batch = append(batch, next)
 	}
 
+	if s.messageLeases {
+		for _, next := range batch {
+			if err = s.stmtLeaseMessage.Reset(); err != nil {
+				return nil, err
+			}
+			s.stmtLeaseMessage.BindInt64(1, next.Offset)
+			if _, err = s.stmtLeaseMessage.Step(); err != nil {
+				return nil, fmt.Errorf("unable to lease message: %w", err)
+			}
+		}
+	}
+	if s.stmtMaxOffset != nil {
+		maxOffset, err := sqlitex.ResultInt64(s.stmtMaxOffset)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read topic max offset: %w", err)
+		}
+		s.metrics.Batch(len(batch), maxOffset-s.lockedOffset)
+		if s.filtersMetadata && len(batch) < s.batchSize {
+			// a short batch means that every other message up to the last one did not match the filter
+			s.scannedOffset = maxOffset
+		}
+	}
 	return batch, nil
 }
 
 func (s *subscription) ExtendLock() (err error) {
+	if s.messageLeases {
+		if err = s.stmtExtendLock.Reset(); err != nil {
+			return err
+		}
+		if _, err = s.stmtExtendLock.Step(); err != nil {
+			return fmt.Errorf("unable to extend message leases: %w", err)
+		}
+		s.metrics.LockExtended()
+		s.resetLockTicker()
+		return nil
+	}
+	if err = s.extendLock(s.lastAckedOffset, s.lockedOffset); err != nil {
+		return err
+	}
+	s.resetLockTicker()
+	s.lockedOffset = s.lastAckedOffset
+	return nil
+}
+
+// resetLockTicker postpones the next lock extension and discards a pending tick,
+// which could have been left over while the handler held the connection.
+func (s *subscription) resetLockTicker() {
+	s.lockTicker.Reset(s.lockDuration)
+	select {
+	case <-s.lockTicker.C:
+	default:
+	}
+}
+
+var errLockLost = errors.New("lock extension did not return any rows")
+
+// extendLock moves the consumer group offset from the locked offset
+// to the acknowledged offset and extends the consumer group lock.
+// Returns [errLockLost] if the lock expired and another subscription took over the consumer group.
+func (s *subscription) extendLock(lastAckedOffset, lockedOffset int64) (err error) {
 	if err = s.stmtExtendLock.Reset(); err != nil {
 		return err
 	}
-	s.stmtExtendLock.BindInt64(1, s.lastAckedOffset)
-	s.stmtExtendLock.BindInt64(2, s.lockedOffset)
+	s.stmtExtendLock.BindInt64(1, lastAckedOffset)
+	s.stmtExtendLock.BindInt64(2, lockedOffset)
 
 	ok, err := s.stmtExtendLock.Step()
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return errors.New("lock extension did not return any rows")
+		s.metrics.LockLost()
+		return errLockLost
 	}
 	ok, err = s.stmtExtendLock.Step()
 	if err != nil {
@@ -132,17 +268,26 @@ func (s *subscription) ExtendLock() (err error) {
 	if ok {
 		return ErrMoreRowStepsThanExpected
 	}
-	s.lockTicker.Reset(s.lockDuration)
-	s.lockedOffset = s.lastAckedOffset
+	s.metrics.LockExtended()
 	return nil
 }
 
 func (s *subscription) ReleaseLock() (err error) {
+	if s.messageLeases {
+		if err = s.stmtReleaseLeases.Reset(); err != nil {
+			return err
+		}
+		if _, err = s.stmtReleaseLeases.Step(); err != nil {
+			return fmt.Errorf("unable to release message leases: %w", err)
+		}
+	}
 	if err = s.stmtAcknowledgeMessages.Reset(); err != nil {
 		return err
 	}
-	s.stmtAcknowledgeMessages.BindInt64(1, s.lastAckedOffset)
-	s.stmtAcknowledgeMessages.BindInt64(2, s.lockedOffset)
+	if !s.messageLeases {
+		s.stmtAcknowledgeMessages.BindInt64(1, s.lastAckedOffset)
+		s.stmtAcknowledgeMessages.BindInt64(2, s.lockedOffset)
+	}
 
 	ok, err := s.stmtAcknowledgeMessages.Step()
 	if err != nil {
@@ -152,55 +297,314 @@ func (s *subscription) ReleaseLock() (err error) {
 		// return errors.New("acknowledgement returned a result")
 		return ErrMoreRowStepsThanExpected
 	}
+	if s.stmtForgetDeliveries != nil {
+		if err = s.stmtForgetDeliveries.Reset(); err != nil {
+			return err
+		}
+		if _, err = s.stmtForgetDeliveries.Step(); err != nil {
+			return fmt.Errorf("unable to remove deliveries of acknowledged messages: %w", err)
+		}
+	}
+	return nil
+}
+
+// Acknowledge records the acknowledgement of a message. Offset of a delayed delivery
+// or message lease consumer group advances when the lock is released,
+// because acknowledgements may arrive out of order.
+func (s *subscription) Acknowledge(offset int64) (err error) {
+	if !s.acknowledgesDeliveries {
+		s.lastAckedOffset = offset
+		return nil
+	}
+	if err = s.stmtAcknowledgeDelivery.Reset(); err != nil {
+		return err
+	}
+	s.stmtAcknowledgeDelivery.BindInt64(1, offset)
+	if _, err = s.stmtAcknowledgeDelivery.Step(); err != nil {
+		return fmt.Errorf("unable to acknowledge delivery: %w", err)
+	}
+	return nil
+}
+
+// TopicChanged reports whether another connection inserted messages into the topic table
+// since the last check. Data version is checked first, because it only reads the database header.
+func (s *subscription) TopicChanged() (changed bool, err error) {
+	version, err := sqlitex.ResultInt64(s.stmtDataVersion)
+	if err != nil {
+		return false, fmt.Errorf("unable to read data version: %w", err)
+	}
+	if version == s.dataVersion {
+		return false, nil
+	}
+	s.dataVersion = version
+	sequence, err := sqlitex.ResultInt64(s.stmtTopicSequence)
+	if err != nil {
+		return false, fmt.Errorf("unable to read topic sequence: %w", err)
+	}
+	if sequence == s.topicSequence {
+		return false, nil
+	}
+	s.topicSequence = sequence
+	return true, nil
+}
+
+// dataVersionChanges returns the data version check channel
+// or nil, which blocks forever, if the checks are disabled.
+func (s *subscription) dataVersionChanges() <-chan time.Time {
+	if s.dataVersionTicker == nil {
+		return nil
+	}
+	return s.dataVersionTicker.C
+}
+
+// CountDeliveryAttempt increments the persisted number of delivery attempts of the message at the given offset.
+func (s *subscription) CountDeliveryAttempt(offset int64) (attempts int64, err error) {
+	if err = s.stmtCountDeliveryAttempt.Reset(); err != nil {
+		return 0, err
+	}
+	s.stmtCountDeliveryAttempt.BindInt64(1, offset)
+	ok, err := s.stmtCountDeliveryAttempt.Step()
+	if err != nil {
+		return 0, fmt.Errorf("unable to count delivery attempt: %w", err)
+	}
+	if !ok {
+		return 0, errors.New("delivery attempt count did not return any rows")
+	}
+	attempts = s.stmtCountDeliveryAttempt.ColumnInt64(0)
+	if ok, err = s.stmtCountDeliveryAttempt.Step(); err != nil {
+		return 0, err
+	}
+	if ok {
+		return 0, ErrMoreRowStepsThanExpected
+	}
+	return attempts, nil
+}
+
+// DeadLetter moves the message into the dead-letter topic and advances
+// the consumer group offset past it within the same savepoint.
+func (s *subscription) DeadLetter(next rawMessage, reason string) (err error) {
+	if next.Streamed {
+		if next.Payload, err = s.ReadPayload(next.Offset); err != nil {
+			return fmt.Errorf("unable to read dead-letter message %q payload: %w", next.UUID, err)
+		}
+	}
+	msg := message.NewMessage(next.UUID, next.Payload)
+	msg.Metadata = deadLetterMetadata(next.Metadata, s.topic, s.consumerGroup, next.Attempts, reason)
+	messages := message.Messages{msg}
+	if next.Unreadable == nil { // unreadable messages are moved as they are stored
+		if messages, err = encryptMessages(s.keyProvider, messages); err != nil {
+			return fmt.Errorf("unable to encrypt dead-letter message %q: %w", next.UUID, err)
+		}
+	}
+	query, arguments, err := s.schemaAdapter.InsertQuery(InsertQueryParams{
+		Topic:      s.deadLetterTopic,
+		TopicTable: s.deadLetterTable,
+		Messages:   messages,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to build dead-letter message %q insert query: %w", next.UUID, err)
+	}
+	lastAckedOffset, lockedOffset := s.lastAckedOffset, s.lockedOffset
+	defer func() {
+		if err != nil {
+			s.lastAckedOffset, s.lockedOffset = lastAckedOffset, lockedOffset
+		} else {
+			published.Notify(s.deadLetterTable)
+		}
+	}()
+	release := sqlitex.Save(s.Connection)
+	defer release(&err)
+
+	if err = sqlitex.Execute(s.Connection, query, &sqlitex.ExecOptions{
+		Args: arguments,
+	}); err != nil {
+		return fmt.Errorf("unable to insert message into dead-letter topic: %w", err)
+	}
+	if s.acknowledgesDeliveries {
+		if err = s.Acknowledge(next.Offset); err != nil {
+			return err
+		}
+		s.lockTicker.Reset(s.lockDuration)
+	} else {
+		s.lastAckedOffset = next.Offset
+		if err = s.ExtendLock(); err != nil {
+			return fmt.Errorf("unable to advance offset past dead-lettered message: %w", err)
+		}
+	}
+	s.logger.Info("message moved to dead-letter topic", watermill.LogFields{
+		"uuid":     next.UUID,
+		"offset":   next.Offset,
+		"attempts": next.Attempts,
+		"reason":   reason,
+	})
 	return nil
 }
 
-func (s *subscription) Send(parent context.Context, next rawMessage) error {
+// SkipUnreadable counts a failed delivery attempt of a message that could not be restored
+// and moves it into the dead-letter topic once delivery attempts are exhausted.
+// Until then, or without dead-lettering, the returned error stops the batch and
+// the message is retried on the next poll, for example, after a missing key is provided.
+func (s *subscription) SkipUnreadable(next rawMessage) (err error) {
+	if s.maxDeliveryAttempts > 0 {
+		if next.Attempts < s.maxDeliveryAttempts {
+			if next.Attempts, err = s.CountDeliveryAttempt(next.Offset); err != nil {
+				return err
+			}
+		}
+		if next.Attempts >= s.maxDeliveryAttempts {
+			return s.DeadLetter(next, deadLetterReasonUnreadable)
+		}
+	}
+	return fmt.Errorf("unable to restore message at offset %d: %w", next.Offset, next.Unreadable)
+}
+
+func (s *subscription) Send(parent context.Context, next rawMessage) (err error) {
 	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
 	s.lockTicker.Reset(s.lockDuration)
-	for {
+	if next.Unreadable != nil {
+		return s.SkipUnreadable(next)
+	}
+	if s.maxDeliveryAttempts > 0 && next.Attempts >= s.maxDeliveryAttempts {
+		// previous deliveries were interrupted, for example, by a crashed consumer
+		return s.DeadLetter(next, deadLetterReasonExhausted)
+	}
+	var (
+		reason  string
+		span    trace.Span
+		release func(*error)
+	)
+	defer func() {
+		if release != nil {
+			s.RollbackDelivery(release)
+		}
+		if span != nil {
+			span.End()
+		}
+	}()
+	for attempt := next.Attempts + 1; ; attempt++ {
+		var msgCtx context.Context
+		msgCtx, span = s.tracer.Start(ctx, next, attempt)
+		lockExtensions := s.lockTicker.C
+		if s.maxDeliveryAttempts > 0 {
+			// counted before emission and outside of the delivery savepoint,
+			// so that the attempt is recorded even if the consumer crashes or the handler fails
+			if next.Attempts, err = s.CountDeliveryAttempt(next.Offset); err != nil {
+				return err
+			}
+		}
+		if s.consumesInTransaction {
+			if release, err = s.BeginDelivery(next.Offset); err != nil {
+				return err
+			}
+			msgCtx = context.WithValue(msgCtx, connContextKey{}, s.Connection)
+			// the handler owns the connection until acknowledgement, so the lock is
+			// extended once it returns; the lock cannot be taken over in the meantime,
+			// because the savepoint holds the database write lock
+			lockExtensions = nil
+		}
+		if next.Streamed {
+			msgCtx = context.WithValue(msgCtx, payloadContextKey{}, streamedPayload{
+				ConnectionDSN: s.connectionDSN,
+				TopicTable:    s.topicTable,
+				Offset:        next.Offset,
+			})
+		}
 		msg := message.NewMessage(next.UUID, next.Payload)
 		msg.Metadata = next.Metadata
-		msg.SetContext(ctx) // required for passing official PubSub test tests.TestMessageCtx
+		setDeliveryMetadata(msg, next)
+		msg.SetContext(msgCtx) // required for passing official PubSub test tests.TestMessageCtx
 
 		select { // wait for message emission
 		case <-ctx.Done():
 			return nil
 		case <-s.lockTicker.C:
+			if release != nil {
+				s.RollbackDelivery(release)
+				release = nil
+			}
 			return s.ReleaseLock()
 		case s.destination <- msg:
 		}
 
+		// the handler owns the connection of a delivery savepoint until it acknowledges
+		// the message, so cancellation and the acknowledgement deadline are only
+		// recorded until then, and the savepoint is rolled back after the handler returns
+		var (
+			done     = ctx.Done()
+			deadline = s.nackChannel()
+			canceled bool
+		)
+		reason = ""
 	waitForMessageAcknowledgement:
 		select {
-		case <-ctx.Done():
+		case <-done:
+			if release != nil {
+				done, canceled = nil, true
+				goto waitForMessageAcknowledgement
+			}
 			msg.Nack()
 			return nil
-		case <-s.lockTicker.C:
-			if err := s.ExtendLock(); err != nil {
+		case <-lockExtensions:
+			if err = s.ExtendLock(); err != nil {
 				return err
 			}
 			goto waitForMessageAcknowledgement
 		case <-msg.Acked():
-			s.lastAckedOffset = next.Offset
-			return nil
-		case <-s.nackChannel():
+			s.metrics.Acked()
+			if release == nil {
+				return s.Acknowledge(next.Offset)
+			}
+			if reason == "" {
+				err = s.CommitDelivery(release, next.Offset)
+				release = nil
+				return err
+			}
+		case <-deadline:
 			s.logger.Debug("message took too long to be acknowledged", nil)
+			s.metrics.AckDeadlineExpired()
+			reason = deadLetterReasonDeadlineExceeded
+			if release != nil {
+				deadline = nil
+				goto waitForMessageAcknowledgement
+			}
 			msg.Nack()
-			if err := s.ExtendLock(); err != nil {
+		case <-msg.Nacked():
+			s.metrics.Nacked()
+			if reason == "" {
+				reason = deadLetterReasonNacked
+			}
+		}
+		if release != nil {
+			s.RollbackDelivery(release)
+			release = nil
+			if canceled {
+				return nil
+			}
+			// lock extensions were postponed while the handler held the connection
+			if err = s.ExtendLock(); err != nil {
 				return err
 			}
-		case <-msg.Nacked():
+		} else if reason == deadLetterReasonDeadlineExceeded {
+			if err = s.ExtendLock(); err != nil {
+				return err
+			}
+		}
+		span.SetStatus(codes.Error, reason)
+		span.End()
+
+		if s.maxDeliveryAttempts > 0 && next.Attempts >= s.maxDeliveryAttempts {
+			return s.DeadLetter(next, reason)
 		}
 	}
 }
 
 func (s *subscription) Run(ctx context.Context) {
 	var (
-		batch []rawMessage
-		err   error
+		batch   []rawMessage
+		changed bool
+		err     error
 	)
 
 	for {
@@ -212,12 +616,33 @@ func (s *subscription) Run(ctx context.Context) {
 				s.stmtExtendLock.Finalize(),
 				s.stmtNextMessageBatch.Finalize(),
 				s.stmtAcknowledgeMessages.Finalize(),
+				finalizeOptional(
+					s.stmtCountDeliveryAttempt,
+					s.stmtForgetDeliveries,
+					s.stmtAcknowledgeDelivery,
+					s.stmtLeaseMessage,
+					s.stmtReleaseLeases,
+					s.stmtDataVersion,
+					s.stmtTopicSequence,
+					s.stmtMaxOffset,
+				),
 				s.Connection.Close(),
 			); err != nil && !errors.Is(err, context.Canceled) {
 				s.logger.Error("subscription ended with error", err, nil)
 			}
 			return
 		case <-s.pollTicker.C:
+		case <-s.wake:
+		case <-s.dataVersionChanges():
+			if changed, err = s.TopicChanged(); err != nil {
+				if !isInterrupt(err) {
+					s.logger.Error("data version check failed", err, nil)
+				}
+				continue
+			}
+			if !changed {
+				continue
+			}
 		}
 
 		batch, err = s.NextBatch()
@@ -233,9 +658,14 @@ func (s *subscription) Run(ctx context.Context) {
 				if !isInterrupt(err) {
 					s.logger.Error("failed to process queued message", err, nil)
 				}
-				continue
+				break // messages after a failed one must not be acknowledged
 			}
 		}
+		if err == nil && s.scannedOffset > s.lastAckedOffset &&
+			(len(batch) == 0 || s.lastAckedOffset == batch[len(batch)-1].Offset) {
+			// skip messages that did not match the metadata filter once the whole batch is acknowledged
+			s.lastAckedOffset = s.scannedOffset
+		}
 
 		if err = s.ReleaseLock(); err != nil {
 			if !isInterrupt(err) {
@@ -245,6 +675,17 @@ func (s *subscription) Run(ctx context.Context) {
 	}
 }
 
+// finalizeOptional finalizes prepared statements that are only present
+// when their subscription features are enabled.
+func finalizeOptional(statements ...*sqlite.Stmt) (err error) {
+	for _, stmt := range statements {
+		if stmt != nil {
+			err = errors.Join(err, stmt.Finalize())
+		}
+	}
+	return err
+}
+
 func isInterrupt(err error) bool {
 	if sqlite.ErrCode(err) == sqlite.ResultInterrupt {
 		return true
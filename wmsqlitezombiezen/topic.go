@@ -1,8 +1,11 @@
 package wmsqlitezombiezen
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
@@ -22,31 +25,79 @@ func validateTopicName(topic string) error {
 	return nil
 }
 
-func createTopicAndOffsetsTablesIfAbsent(conn *sqlite.Conn, messagesTableName, offsetsTableName string) (err error) {
-	if err = validateTopicName(messagesTableName); err != nil {
+func createTopicAndOffsetsTablesIfAbsent(
+	conn *sqlite.Conn,
+	schemaAdapter SchemaAdapter,
+	offsetsAdapter OffsetsAdapter,
+	params SchemaInitializingQueriesParams,
+) (err error) {
+	if err = validateTopicName(params.TopicTable); err != nil {
 		return err
 	}
+	for _, query := range append(
+		schemaAdapter.SchemaInitializingQueries(params),
+		offsetsAdapter.SchemaInitializingQueries(params)...,
+	) {
+		if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := schemaAdapter.(schemaMigrator); ok {
+		if err = migrateTable(conn, schemaKindTopic, params.TopicTable); err != nil {
+			return err
+		}
+	}
+	if _, ok := offsetsAdapter.(schemaMigrator); ok {
+		if err = migrateTable(conn, schemaKindOffsets, params.OffsetsTable); err != nil {
+			return err
+		}
+		if params.DeliveriesTable != "" {
+			if err = migrateTable(conn, schemaKindDeliveries, params.DeliveriesTable); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	// adding UNIQUE(uuid) constraint slows the driver down without benefit
+// findTopics discovers topics by matching SQLite table names against
+// table name generators. A topic is discovered only if both of its
+// topic and offsets tables are present.
+func findTopics(conn *sqlite.Conn, tng TableNameGenerators) (topics []string, err error) {
+	const probe = "topic"
+	sample := tng.Topic(probe)
+	i := strings.LastIndex(sample, probe)
+	if i < 0 {
+		return nil, errors.New("unable to discover topics: topic table name generator does not contain the topic name")
+	}
+	prefix, suffix := sample[:i], sample[i+len(probe):]
+
+	tables := make(map[string]struct{})
 	if err = sqlitex.ExecuteTransient(
 		conn,
-		`CREATE TABLE IF NOT EXISTS '`+messagesTableName+`' (
-			'offset' INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-			uuid TEXT NOT NULL,
-			created_at TEXT NOT NULL,
-			payload BLOB NOT NULL,
-			metadata JSON NOT NULL
-		);`,
-		nil); err != nil {
-		return err
+		`SELECT name FROM sqlite_schema WHERE type='table' AND name NOT LIKE 'sqlite_%';`,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				tables[stmt.ColumnText(0)] = struct{}{}
+				return nil
+			},
+		}); err != nil {
+		return nil, fmt.Errorf("unable to list SQLite tables: %w", err)
 	}
-	return sqlitex.ExecuteTransient(
-		conn,
-		`CREATE TABLE IF NOT EXISTS '`+offsetsTableName+`' (
-			consumer_group TEXT NOT NULL,
-			offset_acked INTEGER NOT NULL,
-			locked_until INTEGER NOT NULL,
-			PRIMARY KEY(consumer_group)
-		);`,
-		nil)
+
+	for name := range tables {
+		if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		topic := name[len(prefix) : len(name)-len(suffix)]
+		if validateTopicName(topic) != nil || tng.Topic(topic) != name {
+			continue
+		}
+		if _, ok := tables[tng.Offsets(topic)]; ok {
+			topics = append(topics, topic)
+		}
+	}
+	slices.Sort(topics)
+	return topics, nil
 }
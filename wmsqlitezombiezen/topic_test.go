@@ -12,8 +12,12 @@ func TestTopicTableCreation(t *testing.T) {
 
 	err := createTopicAndOffsetsTablesIfAbsent(
 		conn,
-		"messagesTableName",
-		"offsetsTableName",
+		DefaultSchemaAdapter{},
+		DefaultOffsetsAdapter{},
+		SchemaInitializingQueriesParams{
+			TopicTable:   "messagesTableName",
+			OffsetsTable: "offsetsTableName",
+		},
 	)
 	if err != nil {
 		t.Fatal("unable to create topic and offsets tables", err)
@@ -35,7 +39,7 @@ func TestTopicTableCreation(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(tables) != 2 {
-		t.Fatal("Expected 2 tables, got", len(tables))
+	if len(tables) != 3 { // topic, offsets, and schema versions
+		t.Fatal("Expected 3 tables, got", len(tables))
 	}
 }
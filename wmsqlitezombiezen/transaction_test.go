@@ -20,8 +20,13 @@ func TestPublishingInTransaction(t *testing.T) {
 	tg := TableNameGenerators{}.WithDefaultGeneratorsInsteadOfNils()
 	if err := createTopicAndOffsetsTablesIfAbsent(
 		conn,
-		tg.Topic(topic),
-		tg.Offsets(topic),
+		DefaultSchemaAdapter{},
+		DefaultOffsetsAdapter{},
+		SchemaInitializingQueriesParams{
+			Topic:        topic,
+			TopicTable:   tg.Topic(topic),
+			OffsetsTable: tg.Offsets(topic),
+		},
 	); err != nil {
 		t.Fatal("unable to manually initialize tables:", err)
 	}
@@ -1,6 +1,7 @@
 package wmsqlitezombiezen
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -27,6 +28,59 @@ func newTestConnection(t *testing.T, connectionDSN string) *sqlite.Conn {
 	return conn
 }
 
+// newTestContext returns a context that is canceled when the test ends.
+func newTestContext(t *testing.T) context.Context {
+	// TODO: replace with t.Context() after Watermill bumps to Golang 1.24
+	ctx, cancel := context.WithCancel(context.TODO())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newTestDSN returns the connection string of a new shared in-memory database.
+func newTestDSN() string {
+	return "file:" + uuid.New().String() + "?mode=memory&journal_mode=WAL&busy_timeout=1000&secure_delete=true&foreign_keys=true&cache=shared"
+}
+
+// newTestPublisher returns a publisher that initializes the schema.
+func newTestPublisher(t *testing.T, conn *sqlite.Conn, options PublisherOptions) message.Publisher {
+	t.Helper()
+	options.InitializeSchema = true
+	pub, err := NewPublisher(conn, options)
+	if err != nil {
+		t.Fatal("unable to initialize publisher:", err)
+	}
+	return pub
+}
+
+// newTestSubscriber returns a subscriber that initializes the schema
+// and is closed when the test ends. Polls every 20 milliseconds by default.
+func newTestSubscriber(t *testing.T, connectionDSN string, options SubscriberOptions) message.Subscriber {
+	t.Helper()
+	options.InitializeSchema = true
+	if options.PollInterval == 0 {
+		options.PollInterval = time.Millisecond * 20
+	}
+	sub, err := NewSubscriber(connectionDSN, options)
+	if err != nil {
+		t.Fatal("unable to initialize subscriber:", err)
+	}
+	t.Cleanup(func() {
+		if err := sub.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return sub
+}
+
+// newTestPubSub returns a connection to a new in-memory database
+// with a publisher and a subscriber made by [newTestPublisher] and [newTestSubscriber].
+func newTestPubSub(t *testing.T, options SubscriberOptions) (*sqlite.Conn, message.Publisher, message.Subscriber) {
+	t.Helper()
+	DSN := newTestDSN()
+	conn := newTestConnection(t, DSN)
+	return conn, newTestPublisher(t, conn, PublisherOptions{}), newTestSubscriber(t, DSN, options)
+}
+
 func NewPubSubFixture(connectionDSN string) tests.PubSubFixture {
 	return func(t *testing.T, consumerGroup string) (message.Publisher, message.Subscriber) {
 		publisherDB := newTestConnection(t, connectionDSN)
@@ -99,3 +153,79 @@ func TestFullConfirmityToModerncImplementation(t *testing.T) {
 		t.Run("memory bound transactions", tests.OfficialImplementationAcceptance(tests.PubSubFixture(NewEphemeralDB(t))))
 	})
 }
+
+func BenchmarkBatchingPublisher(b *testing.B) {
+	DSN := "file:" + filepath.Join(b.TempDir(), uuid.New().String()+".sqlite3") + "?journal_mode=WAL&busy_timeout=5000&secure_delete=true&foreign_keys=true&cache=shared"
+	openConnection := func() *sqlite.Conn {
+		conn, err := sqlite.OpenConn(DSN)
+		if err != nil {
+			b.Fatal("unable to create test SQLite connetion", err)
+		}
+		b.Cleanup(func() {
+			if err := conn.Close(); err != nil {
+				b.Fatal("unable to close test SQLite connetion", err)
+			}
+		})
+		return conn
+	}
+
+	pub, err := NewPublisher(openConnection(), PublisherOptions{
+		InitializeSchema: true,
+	})
+	if err != nil {
+		b.Fatal("unable to create test publisher", err)
+	}
+	unique, err := NewPublisher(openConnection(), PublisherOptions{
+		TableNameGenerators: TableNameGenerators{
+			Topic: func(topic string) string {
+				return "watermill_unique_" + topic
+			},
+		},
+		InitializeSchema:     true,
+		IgnoreDuplicateUUIDs: true,
+	})
+	if err != nil {
+		b.Fatal("unable to create test publisher", err)
+	}
+	batched, err := NewBatchingPublisher(openConnection(), BatchingPublisherOptions{
+		PublisherOptions: PublisherOptions{
+			InitializeSchema: true,
+		},
+	})
+	if err != nil {
+		b.Fatal("unable to create test batching publisher", err)
+	}
+	b.Cleanup(func() {
+		if err := batched.Close(); err != nil {
+			b.Fatal("unable to close test batching publisher", err)
+		}
+	})
+	b.Run("SQLite concurrent publishing to file", newConcurrentPublishingBenchmark(pub))
+	b.Run("SQLite concurrent publishing to file with unique UUIDs", newConcurrentPublishingBenchmark(unique))
+	b.Run("SQLite concurrent batched publishing to file", newConcurrentPublishingBenchmark(batched))
+}
+
+// newConcurrentPublishingBenchmark publishes single messages from parallel goroutines,
+// which is the worst case for publishers that commit each publishing call separately.
+//
+// It mirrors the helper in the wmsqlitemodernc/tests package, which is not part of
+// the released version of the module this module depends on.
+func newConcurrentPublishingBenchmark(p message.Publisher) func(*testing.B) {
+	return func(b *testing.B) {
+		if p == nil {
+			b.Fatal("publisher is nil")
+		}
+
+		b.SetParallelism(64)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				msg := message.NewMessage(uuid.New().String(), []byte("test"))
+				if err := p.Publish("benchmark", msg); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+}